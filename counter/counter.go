@@ -0,0 +1,127 @@
+// Package counter provides counters that many goroutines can add to without transaction conflicts
+package counter
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/blbgo/record/store"
+)
+
+// ErrInvalidCounterValue indicates a stored counter value that is not 8 bytes
+var ErrInvalidCounterValue = errors.New("invalid counter value")
+
+// ErrNoMergeOperators indicates a store that does not implement store.MergeOperatorStore
+var ErrNoMergeOperators = errors.New("store does not provide merge operators")
+
+// mergeInterval is how often the values added to a counter are merged in the background
+const mergeInterval = time.Second
+
+// counterPrefix starts the key of every counter, record type prefixes always start with a
+// lowercase letter so can not collide with it
+var counterPrefix = []byte("_counters\x00")
+
+// Counters are named int64 values changed by adding to them.  Adds are blind writes merged when
+// read or in the background so they never conflict with each other
+type Counters interface {
+	// Add adds delta to the named counter, a counter that does not exist starts at 0
+	Add(name string, delta int64) error
+
+	// Get returns the value of the named counter, 0 if it does not exist
+	Get(name string) (int64, error)
+
+	// Reset subtracts the value of the named counter returned by Get from it and returns that
+	// value.  Adds made at the same time as Reset are kept
+	Reset(name string) (int64, error)
+}
+
+type counters struct {
+	store store.MergeOperatorStore
+
+	// mergeOperators holds the merge operator of each counter used so far, each merges its
+	// counter in its own goroutine until the store is closed
+	mutex          sync.Mutex
+	mergeOperators map[string]store.MergeOperator
+}
+
+// New creates Counters kept in st, which must implement store.MergeOperatorStore
+func New(st store.Store) (Counters, error) {
+	mergeStore, ok := st.(store.MergeOperatorStore)
+	if !ok {
+		return nil, ErrNoMergeOperators
+	}
+	return &counters{
+		store:          mergeStore,
+		mergeOperators: make(map[string]store.MergeOperator),
+	}, nil
+}
+
+// **************** implement Counters
+
+func (r *counters) Add(name string, delta int64) error {
+	return r.mergeOperator(name).Add(encode(delta))
+}
+
+func (r *counters) Get(name string) (int64, error) {
+	data, err := r.mergeOperator(name).Get()
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return decode(data)
+}
+
+func (r *counters) Reset(name string) (int64, error) {
+	value, err := r.Get(name)
+	if err != nil || value == 0 {
+		return value, err
+	}
+	return value, r.Add(name, -value)
+}
+
+// **************** helpers
+
+func (r *counters) mergeOperator(name string) store.MergeOperator {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	mergeOperator, ok := r.mergeOperators[name]
+	if !ok {
+		key := append(counterPrefix[:len(counterPrefix):len(counterPrefix)], name...)
+		mergeOperator = r.store.GetMergeOperator(key, add, mergeInterval)
+		r.mergeOperators[name] = mergeOperator
+	}
+	return mergeOperator
+}
+
+// add is the badger.MergeFunc of counters, existing is kept unchanged if either value can not be
+// decoded so a bad value is not silently replaced by a count starting from 0
+func add(existing, value []byte) []byte {
+	a, err := decode(existing)
+	if err != nil {
+		return existing
+	}
+	b, err := decode(value)
+	if err != nil {
+		return existing
+	}
+	return encode(a + b)
+}
+
+func encode(value int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(value))
+	return data
+}
+
+func decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, ErrInvalidCounterValue
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
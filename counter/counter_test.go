@@ -0,0 +1,151 @@
+package counter
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/blbgo/general"
+	"github.com/blbgo/record/store"
+	"github.com/blbgo/testing/assert"
+)
+
+type dirConfig string
+
+func (r dirConfig) DataPath() string {
+	return string(r)
+}
+
+func closeStore(a *assert.Assert, st store.Store) {
+	doneChan := make(chan error)
+	st.(general.DelayCloser).Close(doneChan)
+	a.NoError(<-doneChan)
+}
+
+func TestCounters(t *testing.T) {
+	a := assert.New(t)
+
+	dir := dirConfig(t.TempDir())
+	st, err := store.New(dir)
+	a.NoError(err)
+	c, err := New(st)
+	a.NoError(err)
+
+	value, err := c.Get("hits")
+	a.NoError(err)
+	a.Equal(int64(0), value)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				a.NoError(c.Add("hits", 2))
+				a.NoError(c.Add("misses", -1))
+			}
+		}()
+	}
+	wg.Wait()
+	value, err = c.Get("hits")
+	a.NoError(err)
+	a.Equal(int64(1600), value)
+
+	value, err = c.Reset("hits")
+	a.NoError(err)
+	a.Equal(int64(1600), value)
+	a.NoError(c.Add("hits", 5))
+
+	// closing the store merges and saves every counter
+	closeStore(a, st)
+	st, err = store.New(dir)
+	a.NoError(err)
+	defer closeStore(a, st)
+	c, err = New(st)
+	a.NoError(err)
+	value, err = c.Get("hits")
+	a.NoError(err)
+	a.Equal(int64(5), value)
+	value, err = c.Get("misses")
+	a.NoError(err)
+	a.Equal(int64(-800), value)
+
+	// a value that can not be decoded is kept rather than counted as 0
+	bad := []byte{1, 2, 3}
+	a.Equal(string(bad), string(add(bad, encode(1))))
+	a.Equal(string(encode(2)), string(add(encode(2), bad)))
+	a.Equal(string(encode(3)), string(add(encode(2), encode(1))))
+
+	// stores without merge operators can not keep counters
+	_, err = New(struct{ store.Store }{st})
+	a.Equal(ErrNoMergeOperators, err)
+}
+
+func BenchmarkMergeAdd(b *testing.B) {
+	st, err := store.New(store.NewConfigInMem())
+	if err != nil {
+		b.Fatal(err)
+	}
+	c, err := New(st)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := c.Add("bench", 1)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkTxnAdd increments a counter by reading and writing it in a transaction, retrying
+// conflicts, for comparison with BenchmarkMergeAdd
+func BenchmarkTxnAdd(b *testing.B) {
+	st, err := store.New(store.NewConfigInMem())
+	if err != nil {
+		b.Fatal(err)
+	}
+	db := st.BadgerDB()
+	key := []byte("bench")
+	var conflicts int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for {
+				err := db.Update(func(txn *badger.Txn) error {
+					var value uint64
+					item, err := txn.Get(key)
+					if err == nil {
+						err = item.Value(func(val []byte) error {
+							value = binary.BigEndian.Uint64(val)
+							return nil
+						})
+					}
+					if err != nil && err != badger.ErrKeyNotFound {
+						return err
+					}
+					data := make([]byte, 8)
+					binary.BigEndian.PutUint64(data, value+1)
+					return txn.Set(key, data)
+				})
+				if err != badger.ErrConflict {
+					if err != nil {
+						b.Error(err)
+					}
+					break
+				}
+				atomic.AddInt64(&conflicts, 1)
+			}
+		}
+	})
+	b.ReportMetric(float64(conflicts)/float64(b.N), "conflicts/op")
+}
@@ -6,6 +6,7 @@ require (
 	github.com/blbgo/general v0.1.1
 	github.com/blbgo/testing v0.1.0
 	github.com/dgraph-io/badger/v2 v2.2007.4
+	github.com/klauspost/compress v1.13.6
 )
 
 require (
@@ -17,7 +18,6 @@ require (
 	github.com/golang/glog v1.0.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/net v0.0.0-20211216030914-fe4d6282115f // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
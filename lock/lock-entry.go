@@ -0,0 +1,75 @@
+package lock
+
+import (
+	"time"
+)
+
+// lockEntry is the record held while a lock is leased
+type lockEntry struct {
+	name string
+	ttl  time.Duration
+
+	Owner     string
+	Token     uint64
+	ExpiresAt time.Time
+}
+
+// **************** implement record.Record
+
+var lockRecordName = "lck"
+
+func (r *lockEntry) Name() string {
+	return lockRecordName
+}
+
+func (r *lockEntry) Key() ([]byte, error) {
+	return []byte(r.name), nil
+}
+
+func (r *lockEntry) SetKey(data []byte) error {
+	r.name = string(data)
+	return nil
+}
+
+// TTL outlives ExpiresAt by a second because the store expires records on whole seconds,
+// ExpiresAt decides when the lease ends
+func (r *lockEntry) TTL() time.Duration {
+	return r.ttl + time.Second
+}
+
+func (r *lockEntry) Record() interface{} {
+	return r
+}
+
+// fenceEntry keeps the last fencing token issued for a lock name so tokens for the name always
+// increase even when issued from sequences leased by different processes
+type fenceEntry struct {
+	name string
+
+	Token uint64
+}
+
+// **************** implement record.Record
+
+var fenceRecordName = "lcf"
+
+func (r *fenceEntry) Name() string {
+	return fenceRecordName
+}
+
+func (r *fenceEntry) Key() ([]byte, error) {
+	return []byte(r.name), nil
+}
+
+func (r *fenceEntry) SetKey(data []byte) error {
+	r.name = string(data)
+	return nil
+}
+
+func (r *fenceEntry) TTL() time.Duration {
+	return 0
+}
+
+func (r *fenceEntry) Record() interface{} {
+	return r
+}
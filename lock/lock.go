@@ -0,0 +1,231 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+// ErrLocked indicates TryAcquire found the lock leased by another owner
+var ErrLocked = errors.New("lock is held")
+
+// ErrLeaseLost indicates Renew or Release was called with a lease that has expired or been
+// released, the lock may now be held by another owner
+var ErrLeaseLost = errors.New("lock lease lost")
+
+// pollInterval is the longest Acquire waits before trying a held lock again
+const pollInterval = 10 * time.Millisecond
+
+// Lease is a held lock
+type Lease struct {
+	Name string
+
+	// Token is the fencing token of the lease.  Tokens for a lock name always increase so a
+	// resource that records the highest token it has seen can reject writes from older leases
+	Token uint64
+
+	ExpiresAt time.Time
+
+	owner string
+}
+
+// Locker provides locks shared by every goroutine and process using the same store.  A lock is
+// held until its lease is released or expires, an expired lease can be taken by another owner
+type Locker interface {
+	// Acquire waits until the named lock is free or its lease has expired, or ctx is done, and
+	// leases it for ttl
+	Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error)
+
+	// TryAcquire leases the named lock for ttl or returns ErrLocked if it is held
+	TryAcquire(name string, ttl time.Duration) (*Lease, error)
+
+	// Renew extends lease to ttl from now.  ErrLeaseLost is returned if it has expired or been
+	// released
+	Renew(lease *Lease, ttl time.Duration) error
+
+	// Release frees the lock of lease.  ErrLeaseLost is returned if it has expired or been
+	// released
+	Release(lease *Lease) error
+}
+
+type locker struct {
+	recorderDB record.RecorderDB
+	sequence   store.Sequence
+}
+
+// New creates a Locker
+func New(recorderDB record.RecorderDB) (Locker, error) {
+	sequence, err := recorderDB.GetSequence(&fenceEntry{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &locker{recorderDB: recorderDB, sequence: sequence}, nil
+}
+
+// NewRecords returns an instance of each record type in this package
+func NewRecords() (record.Record, record.Record) {
+	return &lockEntry{}, &fenceEntry{}
+}
+
+// **************** implement Locker
+
+func (r *locker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	for {
+		lease, expiresAt, err := r.tryAcquire(name, ttl)
+		if err == nil {
+			return lease, nil
+		}
+		if !errors.Is(err, ErrLocked) && !errors.Is(err, badger.ErrConflict) {
+			return nil, err
+		}
+		wait := time.Until(expiresAt)
+		if wait > pollInterval || wait <= 0 {
+			wait = pollInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *locker) TryAcquire(name string, ttl time.Duration) (*Lease, error) {
+	lease, _, err := r.tryAcquire(name, ttl)
+	return lease, err
+}
+
+func (r *locker) Renew(lease *Lease, ttl time.Duration) error {
+	var expiresAt time.Time
+	err := r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		entry, version, err := readHeld(txn, lease)
+		if err != nil {
+			return err
+		}
+		entry.ttl = ttl
+		entry.ExpiresAt = time.Now().Add(ttl).UTC()
+		expiresAt = entry.ExpiresAt
+		return txn.WriteIfVersion(entry, version)
+	})
+	if err != nil {
+		return err
+	}
+	lease.ExpiresAt = expiresAt
+	return nil
+}
+
+func (r *locker) Release(lease *Lease) error {
+	return r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		entry, _, err := readHeld(txn, lease)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(entry)
+	})
+}
+
+// **************** helpers
+
+// tryAcquire leases the named lock or returns ErrLocked and when the current lease expires
+func (r *locker) tryAcquire(name string, ttl time.Duration) (*Lease, time.Time, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var lease *Lease
+	var heldUntil time.Time
+	err = r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		now := time.Now()
+		entry := &lockEntry{name: name}
+		version, err := txn.ReadVersion(entry)
+		if errors.Is(err, record.ErrNotFound) {
+			version = 0
+		} else if err != nil {
+			return err
+		} else if now.Before(entry.ExpiresAt) {
+			heldUntil = entry.ExpiresAt
+			return fmt.Errorf("%w name: %v", ErrLocked, name)
+		}
+		token, err := r.nextToken(txn, name)
+		if err != nil {
+			return err
+		}
+		entry = &lockEntry{
+			name:      name,
+			ttl:       ttl,
+			Owner:     owner,
+			Token:     token,
+			ExpiresAt: now.Add(ttl).UTC(),
+		}
+		err = txn.WriteIfVersion(entry, version)
+		if err != nil {
+			return err
+		}
+		lease = &Lease{Name: name, Token: token, ExpiresAt: entry.ExpiresAt, owner: owner}
+		return nil
+	})
+	if err != nil {
+		return nil, heldUntil, err
+	}
+	return lease, time.Time{}, nil
+}
+
+// nextToken returns a fencing token for the named lock greater than any issued for it before
+func (r *locker) nextToken(txn record.RecorderTxn, name string) (uint64, error) {
+	token, err := r.sequence.Next()
+	if err != nil {
+		return 0, err
+	}
+	// sequences start at 0, tokens start at 1
+	token++
+	fence := &fenceEntry{name: name}
+	err = txn.Read(fence)
+	if err != nil && !errors.Is(err, record.ErrNotFound) {
+		return 0, err
+	}
+	if token <= fence.Token {
+		token = fence.Token + 1
+	}
+	fence.Token = token
+	err = txn.Write(fence)
+	if err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+// readHeld reads the lock entry of lease and its version returning ErrLeaseLost if lease no
+// longer holds it
+func readHeld(txn record.RecorderTxn, lease *Lease) (*lockEntry, uint64, error) {
+	entry := &lockEntry{name: lease.Name}
+	version, err := txn.ReadVersion(entry)
+	if errors.Is(err, record.ErrNotFound) {
+		return nil, 0, fmt.Errorf("%w name: %v", ErrLeaseLost, lease.Name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.Owner != lease.owner || !time.Now().Before(entry.ExpiresAt) {
+		return nil, 0, fmt.Errorf("%w name: %v", ErrLeaseLost, lease.Name)
+	}
+	return entry, version, nil
+}
+
+func newOwner() (string, error) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
@@ -0,0 +1,116 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blbgo/testing/assert"
+)
+
+func TestAcquireAndRelease(t *testing.T) {
+	a := assert.New(t)
+
+	l := createLocker(a, createRecorderDB(a))
+
+	lease, err := l.TryAcquire("job", time.Minute)
+	a.NoError(err)
+	a.Equal("job", lease.Name)
+
+	_, err = l.TryAcquire("job", time.Minute)
+	a.True(errors.Is(err, ErrLocked))
+
+	other, err := l.TryAcquire("other", time.Minute)
+	a.NoError(err)
+	a.True(other.Token > lease.Token)
+
+	expiresAt := lease.ExpiresAt
+	a.NoError(l.Renew(lease, 2*time.Minute))
+	a.True(lease.ExpiresAt.After(expiresAt))
+
+	a.NoError(l.Release(lease))
+	a.True(errors.Is(l.Release(lease), ErrLeaseLost))
+	a.True(errors.Is(l.Renew(lease, time.Minute), ErrLeaseLost))
+
+	again, err := l.TryAcquire("job", time.Minute)
+	a.NoError(err)
+	a.True(again.Token > other.Token)
+}
+
+func TestStealExpired(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	// two lockers over one store act like two processes with their own sequences
+	first := createLocker(a, db)
+	second := createLocker(a, db)
+
+	lease, err := second.TryAcquire("job", 30*time.Millisecond)
+	a.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = first.Acquire(ctx, "job", time.Minute)
+	a.True(errors.Is(err, context.DeadlineExceeded))
+
+	// Acquire waits for the lease to expire then steals it
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stolen, err := first.Acquire(ctx, "job", time.Minute)
+	a.NoError(err)
+	a.True(stolen.Token > lease.Token)
+
+	a.True(errors.Is(second.Renew(lease, time.Minute), ErrLeaseLost))
+	a.True(errors.Is(second.Release(lease), ErrLeaseLost))
+	a.NoError(first.Release(stolen))
+}
+
+func TestRace(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	lockers := []Locker{createLocker(a, db), createLocker(a, db), createLocker(a, db)}
+
+	const workers = 12
+	const rounds = 20
+	var holders int32
+	var mutex sync.Mutex
+	var lastToken uint64
+	counter := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(l Locker) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				lease, err := l.Acquire(ctx, "shared", time.Minute)
+				cancel()
+				if err != nil {
+					a.NoError(err)
+					return
+				}
+				a.Equal(int32(1), atomic.AddInt32(&holders, 1))
+
+				mutex.Lock()
+				// each lease gets a higher token than the one before it
+				a.True(lease.Token > lastToken)
+				lastToken = lease.Token
+				mutex.Unlock()
+
+				// not atomic, the lock is what protects it
+				value := counter
+				time.Sleep(50 * time.Microsecond)
+				counter = value + 1
+
+				atomic.AddInt32(&holders, -1)
+				a.NoError(l.Release(lease))
+			}
+		}(lockers[w%len(lockers)])
+	}
+	wg.Wait()
+	a.Equal(workers*rounds, counter)
+}
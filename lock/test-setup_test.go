@@ -0,0 +1,28 @@
+package lock
+
+import (
+	"github.com/blbgo/testing/assert"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+func createRecorderDB(a *assert.Assert) record.RecorderDB {
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	lockRecord, fenceRecord := NewRecords()
+	db, err := record.New(st, []record.Record{lockRecord, fenceRecord})
+	a.NoError(err)
+	a.NotNil(db)
+
+	return db
+}
+
+func createLocker(a *assert.Assert, db record.RecorderDB) Locker {
+	l, err := New(db)
+	a.NoError(err)
+	a.NotNil(l)
+
+	return l
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blbgo/record/record"
+)
+
+// message is the record of a queued message.  Exactly one of Ready, Due and Dead is set, each is
+// indexed so the queue can find the next message to deliver, messages whose delay or lease has
+// passed and dead letters
+type message struct {
+	queue string
+	id    uint64
+
+	Payload    []byte
+	Priority   uint8
+	Attempts   int
+	EnqueuedAt time.Time
+
+	// LeaseID identifies the current lease while the message is delivered and not yet acked
+	LeaseID string `json:",omitempty"`
+
+	// Ready is the queue name then the inverted priority while the message can be delivered
+	Ready string `json:",omitempty"`
+
+	// Due is the queue name then the time the delay or lease ends
+	Due string `json:",omitempty"`
+
+	// Dead is the queue name while the message is a dead letter
+	Dead string `json:",omitempty"`
+}
+
+// indexPrefix returns the start of the values of the queues messages in each index
+func indexPrefix(queue string) string {
+	return queue + "\x00"
+}
+
+func (r *message) setReady() {
+	r.Ready = fmt.Sprintf("%v%02x", indexPrefix(r.queue), 0xff-r.Priority)
+	r.Due = ""
+	r.Dead = ""
+}
+
+func (r *message) setDue(t time.Time) {
+	r.Ready = ""
+	r.Due = dueValue(r.queue, t)
+	r.Dead = ""
+}
+
+func (r *message) setDead() {
+	r.Ready = ""
+	r.Due = ""
+	r.Dead = indexPrefix(r.queue)
+	r.LeaseID = ""
+}
+
+// dueValue returns the Due index value of a message of queue due at t
+func dueValue(queue string, t time.Time) string {
+	return fmt.Sprintf("%v%016x", indexPrefix(queue), uint64(t.UnixNano()))
+}
+
+func (r *message) toMessage() *Message {
+	return &Message{
+		ID:         r.id,
+		Payload:    r.Payload,
+		Priority:   r.Priority,
+		Attempts:   r.Attempts,
+		EnqueuedAt: r.EnqueuedAt,
+		leaseID:    r.LeaseID,
+	}
+}
+
+// **************** implement record.Record
+
+var messageRecordName = "qmg"
+
+func (r *message) Name() string {
+	return messageRecordName
+}
+
+// Key is the uvarint length of the queue name, the queue name then the big endian id so messages
+// of a queue sort in the order they were enqueued
+func (r *message) Key() ([]byte, error) {
+	key := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(r.queue)+8)
+	key = key[:binary.PutUvarint(key, uint64(len(r.queue)))]
+	key = append(key, r.queue...)
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], r.id)
+	return append(key, id[:]...), nil
+}
+
+func (r *message) SetKey(data []byte) error {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != length+8 {
+		return errors.New("queue: invalid message key")
+	}
+	data = data[n:]
+	r.queue = string(data[:length])
+	r.id = binary.BigEndian.Uint64(data[length:])
+	return nil
+}
+
+func (r *message) TTL() time.Duration {
+	return 0
+}
+
+func (r *message) Record() interface{} {
+	return r
+}
+
+// **************** implement record.Indexer
+
+func (r *message) Indexes() []record.Index {
+	return []record.Index{
+		{Name: "ready", Path: "Ready"},
+		{Name: "due", Path: "Due"},
+		{Name: "dead", Path: "Dead"},
+	}
+}
@@ -0,0 +1,387 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+// ErrInvalidQueueName indicates a queue name that is empty or contains a 0 byte
+var ErrInvalidQueueName = errors.New("invalid queue name")
+
+// ErrLeaseLost indicates Ack or Nack was called with a message whose lease has ended, it may
+// have been delivered again
+var ErrLeaseLost = errors.New("message lease lost")
+
+// ErrNotDeadLetter indicates Redrive was called with the id of a message that is not a dead letter
+var ErrNotDeadLetter = errors.New("message is not a dead letter")
+
+// promoteBatch is the most due messages Dequeue makes ready in one transaction
+const promoteBatch = 100
+
+// Config controls delivery attempts and polling of a Queue
+type Config struct {
+	// MaxAttempts is how many times a message is delivered before it becomes a dead letter,
+	// values less than 1 mean 5
+	MaxAttempts int
+
+	// Backoff is the delay before a message that was nacked is delivered again, it doubles for
+	// each attempt after the first
+	Backoff time.Duration
+
+	// MaxBackoff limits how long the delay before delivering a message again can grow
+	MaxBackoff time.Duration
+
+	// PollInterval is how often a waiting Dequeue looks for messages made ready by other
+	// processes or whose delay or lease has passed, values less than 1 mean 100ms
+	PollInterval time.Duration
+}
+
+// Message is a message delivered by Dequeue
+type Message struct {
+	ID         uint64
+	Payload    []byte
+	Priority   uint8
+	Attempts   int
+	EnqueuedAt time.Time
+
+	leaseID string
+}
+
+// Queue is a durable queue of messages delivered at least once.  Messages are delivered highest
+// priority first then in the order they were enqueued.  A delivered message is leased to its
+// consumer until it is acked, nacked or the visibility timeout passes, after which it is
+// delivered again, so messages leased by a process that crashed are recovered
+type Queue interface {
+	// Enqueue adds a message that can be delivered after delay and returns its ID
+	Enqueue(payload []byte, delay time.Duration, priority uint8) (uint64, error)
+
+	// Dequeue waits until a message can be delivered or ctx is done and returns it leased for
+	// visibilityTimeout
+	Dequeue(ctx context.Context, visibilityTimeout time.Duration) (*Message, error)
+
+	// Ack removes a delivered message from the queue
+	Ack(m *Message) error
+
+	// Nack ends the lease of a delivered message so it is delivered again after the backoff, or
+	// makes it a dead letter if it has been delivered MaxAttempts times
+	Nack(m *Message) error
+
+	// RangeDead calls cb with each dead letter in the order they were enqueued until cb returns
+	// false
+	RangeDead(cb func(m *Message) bool) error
+
+	// Redrive makes the dead letter with id ready to be delivered with its attempts reset
+	Redrive(id uint64) error
+}
+
+type queue struct {
+	recorderDB record.RecorderDB
+	name       string
+	config     Config
+	sequence   store.Sequence
+
+	// ready is closed and replaced when this queue makes a message ready so waiting Dequeue
+	// calls try again
+	mutex sync.Mutex
+	ready chan struct{}
+}
+
+// New creates a Queue named name.  Queues with different names share the record type
+func New(recorderDB record.RecorderDB, name string, config Config) (Queue, error) {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return nil, fmt.Errorf("%w name: %q", ErrInvalidQueueName, name)
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 5
+	}
+	if config.PollInterval < 1 {
+		config.PollInterval = 100 * time.Millisecond
+	}
+	sequence, err := recorderDB.GetSequence(&message{}, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return &queue{
+		recorderDB: recorderDB,
+		name:       name,
+		config:     config,
+		sequence:   sequence,
+		ready:      make(chan struct{}),
+	}, nil
+}
+
+// NewRecords returns an instance of each record type in this package
+func NewRecords() record.Record {
+	return &message{}
+}
+
+// **************** implement Queue
+
+func (r *queue) Enqueue(payload []byte, delay time.Duration, priority uint8) (uint64, error) {
+	id, err := r.sequence.Next()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	m := &message{
+		queue:      r.name,
+		id:         id,
+		Payload:    payload,
+		Priority:   priority,
+		EnqueuedAt: now,
+	}
+	if delay > 0 {
+		m.setDue(now.Add(delay))
+	} else {
+		m.setReady()
+	}
+	err = r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		return txn.Write(m)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if delay <= 0 {
+		r.signalReady()
+	}
+	return id, nil
+}
+
+func (r *queue) Dequeue(ctx context.Context, visibilityTimeout time.Duration) (*Message, error) {
+	for {
+		r.mutex.Lock()
+		ready := r.ready
+		r.mutex.Unlock()
+		m, err := r.tryDequeue(ctx, visibilityTimeout)
+		if errors.Is(err, badger.ErrConflict) {
+			// other consumers took the messages this one tried to, look again
+			continue
+		}
+		if err != nil || m != nil {
+			return m, err
+		}
+		timer := time.NewTimer(r.config.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-ready:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *queue) Ack(m *Message) error {
+	return r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		stored, err := r.readLeased(txn, m)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(stored)
+	})
+}
+
+func (r *queue) Nack(m *Message) error {
+	err := r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		stored, err := r.readLeased(txn, m)
+		if err != nil {
+			return err
+		}
+		stored.LeaseID = ""
+		if stored.Attempts >= r.config.MaxAttempts {
+			stored.setDead()
+		} else {
+			stored.setDue(time.Now().UTC().Add(r.backoff(stored.Attempts)))
+		}
+		return txn.Write(stored)
+	})
+	if err != nil {
+		return err
+	}
+	if r.backoff(m.Attempts) <= 0 {
+		r.signalReady()
+	}
+	return nil
+}
+
+func (r *queue) RangeDead(cb func(m *Message) bool) error {
+	m := &message{}
+	prefix := record.EncodeIndexPrefix(indexPrefix(r.name))
+	return r.recorderDB.RangeIndex(
+		m,
+		"dead",
+		&record.RangeOptions{Prefix: prefix},
+		func(record.Record) bool {
+			more := cb(m.toMessage())
+			*m = message{}
+			return more
+		},
+	)
+}
+
+func (r *queue) Redrive(id uint64) error {
+	err := r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		m := &message{queue: r.name, id: id}
+		err := txn.Read(m)
+		if err != nil {
+			return err
+		}
+		if m.Dead == "" {
+			return fmt.Errorf("%w queue: %v id: %v", ErrNotDeadLetter, r.name, id)
+		}
+		m.Attempts = 0
+		m.setReady()
+		return txn.Write(m)
+	})
+	if err != nil {
+		return err
+	}
+	r.signalReady()
+	return nil
+}
+
+// **************** helpers
+
+// tryDequeue makes messages whose delay or lease has passed ready then leases the first ready
+// message, nil is returned if there is none
+func (r *queue) tryDequeue(ctx context.Context, visibilityTimeout time.Duration) (*Message, error) {
+	leaseID, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	var leased *Message
+	err = r.recorderDB.Update(ctx, func(txn record.RecorderTxn) error {
+		leased = nil
+		now := time.Now().UTC()
+		err := r.promoteDue(txn, now)
+		if err != nil {
+			return err
+		}
+		m := &message{}
+		found := false
+		err = txn.RangeIndex(
+			m,
+			"ready",
+			&record.RangeOptions{Prefix: record.EncodeIndexPrefix(indexPrefix(r.name)), Limit: 1},
+			func(record.Record) bool {
+				found = true
+				return false
+			},
+		)
+		if err != nil || !found {
+			return err
+		}
+		m.Attempts++
+		m.LeaseID = leaseID
+		m.setDue(now.Add(visibilityTimeout))
+		err = txn.Write(m)
+		if err != nil {
+			return err
+		}
+		leased = m.toMessage()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leased, nil
+}
+
+// promoteDue makes messages whose delay or lease ended by now ready, or dead letters if their
+// lease ended on their last attempt
+func (r *queue) promoteDue(txn record.RecorderTxn, now time.Time) error {
+	var due []message
+	m := &message{}
+	err := txn.RangeIndex(
+		m,
+		"due",
+		&record.RangeOptions{
+			Prefix: record.EncodeIndexPrefix(indexPrefix(r.name)),
+			End:    record.EncodeIndexPrefix(dueValue(r.name, now.Add(1))),
+			Limit:  promoteBatch,
+		},
+		func(record.Record) bool {
+			due = append(due, *m)
+			*m = message{}
+			return true
+		},
+	)
+	if err != nil {
+		return err
+	}
+	for i := range due {
+		v := &due[i]
+		if v.LeaseID != "" && v.Attempts >= r.config.MaxAttempts {
+			v.setDead()
+		} else {
+			v.LeaseID = ""
+			v.setReady()
+		}
+		err = txn.Write(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLeased reads the stored message of m returning ErrLeaseLost if it is no longer leased by
+// the consumer m was delivered to
+func (r *queue) readLeased(txn record.RecorderTxn, m *Message) (*message, error) {
+	stored := &message{queue: r.name, id: m.ID}
+	err := txn.Read(stored)
+	if errors.Is(err, record.ErrNotFound) {
+		return nil, fmt.Errorf("%w queue: %v id: %v", ErrLeaseLost, r.name, m.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.LeaseID == "" || stored.LeaseID != m.leaseID ||
+		stored.Due < dueValue(r.name, time.Now().UTC()) {
+		return nil, fmt.Errorf("%w queue: %v id: %v", ErrLeaseLost, r.name, m.ID)
+	}
+	return stored, nil
+}
+
+// backoff returns the delay before a message nacked after attempts deliveries is delivered again
+func (r *queue) backoff(attempts int) time.Duration {
+	backoff := r.config.Backoff
+	for i := 1; i < attempts && backoff > 0; i++ {
+		backoff *= 2
+		if r.config.MaxBackoff > 0 && backoff >= r.config.MaxBackoff {
+			break
+		}
+	}
+	if r.config.MaxBackoff > 0 && backoff > r.config.MaxBackoff {
+		backoff = r.config.MaxBackoff
+	}
+	return backoff
+}
+
+func (r *queue) signalReady() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	close(r.ready)
+	r.ready = make(chan struct{})
+}
+
+func newLeaseID() (string, error) {
+	data := make([]byte, 8)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
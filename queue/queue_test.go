@@ -0,0 +1,208 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blbgo/testing/assert"
+)
+
+func dequeueNow(a *assert.Assert, q Queue, visibilityTimeout time.Duration) *Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	m, err := q.Dequeue(ctx, visibilityTimeout)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	a.NoError(err)
+	return m
+}
+
+func TestOrdering(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	_, err := New(db, "", Config{})
+	a.True(errors.Is(err, ErrInvalidQueueName))
+
+	q := createQueue(a, db, "jobs", Config{PollInterval: time.Millisecond})
+	other := createQueue(a, db, "other", Config{})
+
+	for _, v := range []struct {
+		payload  string
+		delay    time.Duration
+		priority uint8
+	}{
+		{"low1", 0, 1},
+		{"high1", 0, 9},
+		{"low2", 0, 1},
+		{"delayed", 50 * time.Millisecond, 9},
+		{"high2", 0, 9},
+	} {
+		_, err := q.Enqueue([]byte(v.payload), v.delay, v.priority)
+		a.NoError(err)
+	}
+	_, err = other.Enqueue([]byte("other"), 0, 0)
+	a.NoError(err)
+
+	var payloads []string
+	for m := dequeueNow(a, q, time.Minute); m != nil; m = dequeueNow(a, q, time.Minute) {
+		payloads = append(payloads, string(m.Payload))
+		a.Equal(1, m.Attempts)
+		a.NoError(q.Ack(m))
+	}
+	a.Equal("[high1 high2 low1 low2]", fmt.Sprint(payloads))
+
+	// Dequeue waits for the delay to pass
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := q.Dequeue(ctx, time.Minute)
+	a.NoError(err)
+	a.Equal("delayed", string(m.Payload))
+	a.NoError(q.Ack(m))
+	a.True(errors.Is(q.Ack(m), ErrLeaseLost))
+
+	m = dequeueNow(a, other, time.Minute)
+	a.True(m != nil)
+	a.Equal("other", string(m.Payload))
+}
+
+func TestNackAndDeadLetter(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	q := createQueue(a, db, "jobs", Config{
+		MaxAttempts:  3,
+		Backoff:      40 * time.Millisecond,
+		MaxBackoff:   60 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	id, err := q.Enqueue([]byte("fails"), 0, 0)
+	a.NoError(err)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		m := dequeueNow(a, q, time.Minute)
+		a.True(m != nil)
+		a.Equal(id, m.ID)
+		a.Equal(attempt, m.Attempts)
+		a.NoError(q.Nack(m))
+		// backoff keeps it from being delivered straight away
+		a.True(dequeueNow(a, q, time.Minute) == nil)
+		time.Sleep(70 * time.Millisecond)
+	}
+	a.True(dequeueNow(a, q, time.Minute) == nil)
+
+	var dead []uint64
+	a.NoError(q.RangeDead(func(m *Message) bool {
+		dead = append(dead, m.ID)
+		a.Equal(3, m.Attempts)
+		return true
+	}))
+	a.Equal(fmt.Sprint([]uint64{id}), fmt.Sprint(dead))
+
+	a.NoError(q.Redrive(id))
+	a.True(errors.Is(q.Redrive(id), ErrNotDeadLetter))
+	m := dequeueNow(a, q, time.Minute)
+	a.True(m != nil)
+	a.Equal(1, m.Attempts)
+	a.NoError(q.Ack(m))
+}
+
+func TestLeaseRecovery(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	q := createQueue(a, db, "jobs", Config{MaxAttempts: 2, PollInterval: time.Millisecond})
+	_, err := q.Enqueue([]byte("crash"), 0, 0)
+	a.NoError(err)
+
+	// the consumer crashes without acking
+	m := dequeueNow(a, q, 30*time.Millisecond)
+	a.True(m != nil)
+	a.True(dequeueNow(a, q, time.Minute) == nil)
+
+	// a new queue over the same store, as after a restart, gets it once the lease ends
+	restarted := createQueue(a, db, "jobs", Config{MaxAttempts: 2, PollInterval: time.Millisecond})
+	time.Sleep(30 * time.Millisecond)
+	again := dequeueNow(a, restarted, 30*time.Millisecond)
+	a.True(again != nil)
+	a.Equal(m.ID, again.ID)
+	a.Equal(2, again.Attempts)
+	a.True(errors.Is(q.Ack(m), ErrLeaseLost))
+
+	// the lease ending on the last attempt makes it a dead letter
+	time.Sleep(40 * time.Millisecond)
+	a.True(dequeueNow(a, restarted, time.Minute) == nil)
+	a.True(errors.Is(restarted.Ack(again), ErrLeaseLost))
+	count := 0
+	a.NoError(restarted.RangeDead(func(m *Message) bool {
+		count++
+		return true
+	}))
+	a.Equal(1, count)
+}
+
+func TestConcurrentConsumers(t *testing.T) {
+	a := assert.New(t)
+
+	db := createRecorderDB(a)
+	q := createQueue(a, db, "jobs", Config{PollInterval: time.Millisecond})
+	const messages = 300
+	const consumers = 16
+
+	var wg sync.WaitGroup
+	for p := 0; p < 3; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := p; i < messages; i += 3 {
+				_, err := q.Enqueue([]byte(fmt.Sprint(i)), 0, uint8(i%4))
+				a.NoError(err)
+			}
+		}(p)
+	}
+
+	var mutex sync.Mutex
+	seen := make(map[string]int)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mutex.Lock()
+				done := len(seen) == messages
+				mutex.Unlock()
+				if done {
+					return
+				}
+				waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				m, err := q.Dequeue(waitCtx, time.Minute)
+				waitCancel()
+				if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+					continue
+				}
+				if err != nil {
+					a.NoError(err)
+					return
+				}
+				mutex.Lock()
+				seen[string(m.Payload)]++
+				mutex.Unlock()
+				a.NoError(q.Ack(m))
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.Equal(messages, len(seen))
+	for _, v := range seen {
+		a.Equal(1, v)
+	}
+	a.True(dequeueNow(a, q, time.Minute) == nil)
+}
@@ -0,0 +1,27 @@
+package queue
+
+import (
+	"github.com/blbgo/testing/assert"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+func createRecorderDB(a *assert.Assert) record.RecorderDB {
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := record.New(st, []record.Record{NewRecords()})
+	a.NoError(err)
+	a.NotNil(db)
+
+	return db
+}
+
+func createQueue(a *assert.Assert, db record.RecorderDB, name string, config Config) Queue {
+	q, err := New(db, name, config)
+	a.NoError(err)
+	a.NotNil(q)
+
+	return q
+}
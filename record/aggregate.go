@@ -0,0 +1,197 @@
+package record
+
+import (
+	"encoding/json"
+	"math"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Aggregate is the result of aggregating a numeric field over a set of records
+type Aggregate struct {
+	// Count is the number of records that had a number at the aggregated path
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// Avg returns the average of the aggregated values, 0 if there were none
+func (r *Aggregate) Avg() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Sum / float64(r.Count)
+}
+
+func (r *Aggregate) add(value float64) {
+	if r.Count == 0 {
+		r.Min = value
+		r.Max = value
+	} else {
+		r.Min = math.Min(r.Min, value)
+		r.Max = math.Max(r.Max, value)
+	}
+	r.Count++
+	r.Sum += value
+}
+
+func (r *recorderDB) Exists(record Record) (bool, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.Exists(record)
+}
+
+func (r *recorderDB) Count(record Record, keyPrefix []byte) (int, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.Count(record, keyPrefix)
+}
+
+func (r *recorderDB) Aggregate(record Record, keyPrefix []byte, path string) (*Aggregate, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.Aggregate(record, keyPrefix, path)
+}
+
+func (r *recorderDB) AggregateBy(
+	record Record,
+	keyPrefix []byte,
+	path string,
+	groupPath string,
+) (map[string]*Aggregate, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.AggregateBy(record, keyPrefix, path, groupPath)
+}
+
+func (r *recorderTxn) Exists(record Record) (bool, error) {
+	// Get does not read the value so this only touches keys
+	_, err := r.getItem(record)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *recorderTxn) Count(record Record, keyPrefix []byte) (int, error) {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return 0, err
+	}
+	itOps := badger.DefaultIteratorOptions
+	itOps.PrefetchValues = false
+	itOps.Prefix = joinKey(rt.prefix, keyPrefix)
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	return count, nil
+}
+
+func (r *recorderTxn) Aggregate(record Record, keyPrefix []byte, path string) (*Aggregate, error) {
+	result := &Aggregate{}
+	err := r.rangeDocs(record, keyPrefix, func(doc interface{}) {
+		value, ok := FieldValue(doc, path)
+		if !ok {
+			return
+		}
+		if number, ok := value.(float64); ok {
+			result.add(number)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *recorderTxn) AggregateBy(
+	record Record,
+	keyPrefix []byte,
+	path string,
+	groupPath string,
+) (map[string]*Aggregate, error) {
+	result := make(map[string]*Aggregate)
+	err := r.rangeDocs(record, keyPrefix, func(doc interface{}) {
+		value, ok := FieldValue(doc, path)
+		if !ok {
+			return
+		}
+		number, ok := value.(float64)
+		if !ok {
+			return
+		}
+		group := groupName(doc, groupPath)
+		aggregate, ok := result[group]
+		if !ok {
+			aggregate = &Aggregate{}
+			result[group] = aggregate
+		}
+		aggregate.add(number)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// rangeDocs calls fn with the JSON value of each record of the type of record with a key starting
+// with keyPrefix decoded into an interface{}.  Only one value is decoded at a time
+func (r *recorderTxn) rangeDocs(record Record, keyPrefix []byte, fn func(doc interface{})) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = joinKey(rt.prefix, keyPrefix)
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var doc interface{}
+		err = it.Item().Value(func(val []byte) error {
+			return unmarshalValue(val, &doc)
+		})
+		if err != nil {
+			return err
+		}
+		fn(doc)
+	}
+	return nil
+}
+
+// groupName returns the name of the group doc belongs to, the JSON type of the value at groupPath
+// then a colon then the value if it is a string otherwise its JSON encoding, so values of
+// different types that encode the same are in different groups.  Records missing the value are
+// in the "" group
+func groupName(doc interface{}, groupPath string) string {
+	value, ok := FieldValue(doc, groupPath)
+	if !ok {
+		return ""
+	}
+	var kind string
+	switch v := value.(type) {
+	case string:
+		return "string:" + v
+	case bool:
+		kind = "boolean"
+	case float64:
+		kind = "number"
+	case []interface{}:
+		kind = "array"
+	case map[string]interface{}:
+		kind = "object"
+	default:
+		kind = "null"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return kind + ":" + string(data)
+}
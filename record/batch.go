@@ -0,0 +1,223 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// ErrStoreNotEmpty indicates BulkLoad was called on a store that already has data
+var ErrStoreNotEmpty = errors.New("BulkLoad requires an empty store")
+
+// ErrUnsorted indicates BulkLoad was provided a record that did not sort after the previous one
+var ErrUnsorted = errors.New("BulkLoad records not in strictly increasing key order")
+
+// bulkLoadListSize is the number of records sent to the StreamWriter at a time
+const bulkLoadListSize = 1000
+
+// BatchError is returned by WriteBatch when some of the records could not be written, all other
+// records were written unless Err is set
+type BatchError struct {
+	// Errors maps the index of each record that failed to the reason it failed
+	Errors map[int]error
+
+	// Err is the error that stopped the batch, when it is set records that are not in Errors may
+	// also not have been written
+	Err error
+}
+
+func (r *BatchError) Error() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%v batch records failed to write then: %v", len(r.Errors), r.Err)
+	}
+	return fmt.Sprintf("%v batch records failed to write", len(r.Errors))
+}
+
+// Unwrap returns Err
+func (r *BatchError) Unwrap() error {
+	return r.Err
+}
+
+// withErr returns err along with the errors of the records that have already failed
+func (r *BatchError) withErr(err error) error {
+	if len(r.Errors) == 0 {
+		return err
+	}
+	r.Err = err
+	return r
+}
+
+func (r *recorderDB) WriteBatch(records []Record) error {
+	batchErr := &BatchError{Errors: make(map[int]error)}
+	maxSize := r.DB.MaxBatchSize()
+	wb := r.DB.NewWriteBatch()
+	defer wb.Cancel()
+	for i, record := range records {
+		rt, err := r.recordType(record)
+		if err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		if rt.needsTxn() {
+			batchErr.Errors[i] = fmt.Errorf("%w name: %v", ErrNeedsTransaction, rt.name)
+			continue
+		}
+		entry, err := r.prepareBatchEntry(rt, record)
+		if err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		// an entry too big for a transaction on its own would stop the whole batch so it is
+		// reported here, WriteBatch splits everything else into transactions as they fill
+		if int64(len(entry.Key)+len(entry.Value)) >= maxSize {
+			batchErr.Errors[i] = badger.ErrTxnTooBig
+			continue
+		}
+		err = wb.SetEntry(entry)
+		if err != nil {
+			return batchErr.withErr(err)
+		}
+	}
+	err := wb.Flush()
+	if err != nil {
+		return batchErr.withErr(err)
+	}
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+func (r *recorderDB) BulkLoad(next func() (Record, error)) error {
+	empty := true
+	err := r.DB.View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.PrefetchValues = false
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			// the registry is written by New so does not count
+			if !isRegistryKey(it.Item().Key()) {
+				empty = false
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return ErrStoreNotEmpty
+	}
+	// Prepare drops all data so the registry and secrets are saved and written again after the
+	// load
+	var registry []*badger.Entry
+	err = r.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !isRegistryKey(it.Item().Key()) {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			registry = append(registry, badger.NewEntry(it.Item().KeyCopy(nil), value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sw := r.DB.NewStreamWriter()
+	err = sw.Prepare()
+	if err != nil {
+		return err
+	}
+	loadErr := r.bulkLoad(sw, next)
+	// Flush must always be called to release the store for other writes
+	err = sw.Flush()
+	if err == nil {
+		err = r.DB.Update(func(txn *badger.Txn) error {
+			for _, v := range registry {
+				err := txn.SetEntry(v)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	return err
+}
+
+func (r *recorderDB) bulkLoad(sw *badger.StreamWriter, next func() (Record, error)) error {
+	list := &pb.KVList{}
+	var lastKey []byte
+	loadErr := func() error {
+		for {
+			record, err := next()
+			if err != nil {
+				return err
+			}
+			if record == nil {
+				return nil
+			}
+			rt, err := r.recordType(record)
+			if err != nil {
+				return err
+			}
+			if rt.needsTxn() {
+				return fmt.Errorf("%w name: %v", ErrNeedsTransaction, rt.name)
+			}
+			entry, err := r.prepareBatchEntry(rt, record)
+			if err != nil {
+				return err
+			}
+			if lastKey != nil && bytes.Compare(entry.Key, lastKey) <= 0 {
+				return fmt.Errorf("%w key: %x", ErrUnsorted, entry.Key)
+			}
+			lastKey = entry.Key
+			kv := &pb.KV{Key: entry.Key, Value: entry.Value, Version: 1}
+			ttl := record.TTL()
+			if ttl > 0 {
+				kv.ExpiresAt = uint64(time.Now().Add(ttl).Unix())
+			}
+			list.Kv = append(list.Kv, kv)
+			if len(list.Kv) >= bulkLoadListSize {
+				err = sw.Write(list)
+				if err != nil {
+					return err
+				}
+				list = &pb.KVList{}
+			}
+		}
+	}()
+	// records accepted before an error are still written
+	err := sw.Write(list)
+	if loadErr != nil {
+		return loadErr
+	}
+	return err
+}
+
+// prepareBatchEntry creates the entry for a write that does not use a transaction
+func (r *recorderDB) prepareBatchEntry(rt *recordType, record Record) (*badger.Entry, error) {
+	var entry *badger.Entry
+	err := r.handle(OpWrite, record, func(op Op, record Record) error {
+		var err error
+		entry, _, err = prepareEntry(rt, record)
+		return err
+	})
+	return entry, err
+}
@@ -0,0 +1,476 @@
+package record
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrInvalidBlob indicates a blob with missing chunks or data that does not match its checksum
+var ErrInvalidBlob = errors.New("invalid blob")
+
+// ErrBlobClosed indicates a write to a blob writer that has been closed
+var ErrBlobClosed = errors.New("blob writer closed")
+
+// blobChunkSize is the most bytes of a blob stored in one key
+const blobChunkSize = 256 << 10
+
+// blobManifestPrefix starts the key of each blob manifest, which is followed by the blob id.
+// blobChunkPrefix starts the key of each chunk, which is followed by the 16 byte upload id then
+// the big endian 4 byte chunk number.  Record type prefixes always start with a lowercase letter
+// so can not collide with them
+var (
+	blobManifestPrefix = []byte("_blobs\x00")
+	blobChunkPrefix    = []byte("_blobc\x00")
+)
+
+// blobUploadLength is the length of upload ids, the big endian time in nanoseconds the upload
+// started then 8 random bytes
+const blobUploadLength = 16
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Size      int64
+	Chunks    int
+	ChunkSize int
+
+	// Checksum is the hex SHA-256 of the blob
+	Checksum string
+
+	CreatedAt time.Time
+}
+
+// BlobReferrer may be implemented by a Record to keep the blobs it references from being
+// collected by CollectBlobs
+type BlobReferrer interface {
+	BlobIDs() []string
+}
+
+// BlobStore stores payloads too large to be record values as chunks read and written as streams
+type BlobStore interface {
+	// PutBlob returns a writer that stores a blob with id when it is closed, replacing any blob
+	// with the same id.  Nothing is stored if it is not closed, writers should be closed well
+	// within the olderThan used with CollectBlobs
+	PutBlob(id string) (io.WriteCloser, error)
+
+	// OpenBlob returns a reader of the blob with id as it was when opened, it must be closed.
+	// ErrNotFound is returned if there is no such blob and ErrInvalidBlob by a read that reaches
+	// the end of a blob read from the start without seeking if its checksum does not match
+	OpenBlob(id string) (io.ReadSeekCloser, error)
+
+	// BlobInfo returns the manifest of the blob with id or ErrNotFound
+	BlobInfo(id string) (BlobInfo, error)
+
+	// DeleteBlob deletes the blob with id or returns ErrNotFound
+	DeleteBlob(id string) error
+
+	// CollectBlobs deletes blobs created more than olderThan ago that are not referenced by a
+	// record of a type that implements BlobReferrer, along with the chunks of writers started
+	// more than olderThan ago that were never closed, and returns how many of both it deleted.
+	// olderThan protects blobs that were put before the records referencing them are written
+	CollectBlobs(olderThan time.Duration) (int, error)
+}
+
+// blobManifest is the stored form of a BlobInfo
+type blobManifest struct {
+	BlobInfo
+
+	// Upload is the upload id of the chunks
+	Upload []byte
+}
+
+func (r *recorderDB) PutBlob(id string) (io.WriteCloser, error) {
+	upload := make([]byte, blobUploadLength)
+	binary.BigEndian.PutUint64(upload, uint64(time.Now().UnixNano()))
+	_, err := rand.Read(upload[8:])
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{db: r, id: id, upload: upload, hash: sha256.New()}, nil
+}
+
+func (r *recorderDB) OpenBlob(id string) (io.ReadSeekCloser, error) {
+	txn := r.DB.NewTransaction(false)
+	manifest, err := readBlobManifest(txn, id)
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	return &blobReader{txn: txn, id: id, manifest: manifest, chunk: -1, hash: sha256.New()}, nil
+}
+
+func (r *recorderDB) BlobInfo(id string) (BlobInfo, error) {
+	var manifest blobManifest
+	err := r.DB.View(func(txn *badger.Txn) error {
+		var err error
+		manifest, err = readBlobManifest(txn, id)
+		return err
+	})
+	return manifest.BlobInfo, err
+}
+
+func (r *recorderDB) DeleteBlob(id string) error {
+	var manifest blobManifest
+	err := r.DB.Update(func(txn *badger.Txn) error {
+		var err error
+		manifest, err = readBlobManifest(txn, id)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(joinKey(blobManifestPrefix, []byte(id)))
+	})
+	if err != nil {
+		return err
+	}
+	return r.deleteBlobChunks(manifest.Upload, manifest.Chunks)
+}
+
+func (r *recorderDB) CollectBlobs(olderThan time.Duration) (int, error) {
+	referenced := make(map[string]bool)
+	for _, rt := range r.types {
+		if _, ok := rt.record.(BlobReferrer); !ok {
+			continue
+		}
+		err := r.RangeWith(rt.newRecord(), nil, func(record Record) bool {
+			for _, v := range record.(BlobReferrer).BlobIDs() {
+				referenced[v] = true
+			}
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	unreferenced := make(map[string]blobManifest)
+	live := make(map[string]bool)
+	err := r.DB.View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.Prefix = blobManifestPrefix
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var manifest blobManifest
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &manifest)
+			})
+			if err != nil {
+				return err
+			}
+			id := string(it.Item().Key()[len(blobManifestPrefix):])
+			if !referenced[id] && manifest.CreatedAt.Before(cutoff) {
+				unreferenced[id] = manifest
+				continue
+			}
+			live[string(manifest.Upload)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for id, manifest := range unreferenced {
+		deleted, err := r.deleteUnreferencedBlob(id, manifest)
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+
+	abandoned := make(map[string]int)
+	err = r.DB.View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.PrefetchValues = false
+		itOps.Prefix = blobChunkPrefix
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()[len(blobChunkPrefix):]
+			upload := string(key[:blobUploadLength])
+			started := time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+			if live[upload] || !started.Before(cutoff) {
+				continue
+			}
+			chunk := int(binary.BigEndian.Uint32(key[blobUploadLength:])) + 1
+			if chunk > abandoned[upload] {
+				abandoned[upload] = chunk
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	for upload, chunks := range abandoned {
+		err = r.deleteBlobChunks([]byte(upload), chunks)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// deleteUnreferencedBlob deletes the blob with id if it is still the one described by scanned,
+// false is returned if it was deleted or replaced since it was scanned
+func (r *recorderDB) deleteUnreferencedBlob(id string, scanned blobManifest) (bool, error) {
+	deleted := false
+	err := r.DB.Update(func(txn *badger.Txn) error {
+		manifest, err := readBlobManifest(txn, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(manifest.Upload, scanned.Upload) ||
+			!manifest.CreatedAt.Equal(scanned.CreatedAt) {
+			return nil
+		}
+		deleted = true
+		return txn.Delete(joinKey(blobManifestPrefix, []byte(id)))
+	})
+	if err != nil || !deleted {
+		return false, err
+	}
+	return true, r.deleteBlobChunks(scanned.Upload, scanned.Chunks)
+}
+
+// deleteBlobChunks deletes chunks 0 to chunks - 1 of upload
+func (r *recorderDB) deleteBlobChunks(upload []byte, chunks int) error {
+	batch := r.DB.NewWriteBatch()
+	defer batch.Cancel()
+	for i := 0; i < chunks; i++ {
+		err := batch.Delete(blobChunkKey(upload, i))
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+func readBlobManifest(txn *badger.Txn, id string) (blobManifest, error) {
+	var manifest blobManifest
+	item, err := txn.Get(joinKey(blobManifestPrefix, []byte(id)))
+	if err == badger.ErrKeyNotFound {
+		return manifest, fmt.Errorf("%w blob: %v", ErrNotFound, id)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &manifest)
+	})
+	return manifest, err
+}
+
+func blobChunkKey(upload []byte, chunk int) []byte {
+	key := make([]byte, 0, len(blobChunkPrefix)+blobUploadLength+4)
+	key = append(key, blobChunkPrefix...)
+	key = append(key, upload...)
+	var number [4]byte
+	binary.BigEndian.PutUint32(number[:], uint32(chunk))
+	return append(key, number[:]...)
+}
+
+// blobWriter writes each chunk in its own transaction as it fills then the manifest on Close
+type blobWriter struct {
+	db     *recorderDB
+	id     string
+	upload []byte
+	buf    []byte
+	chunks int
+	size   int64
+	hash   hash.Hash
+	closed bool
+	err    error
+}
+
+func (r *blobWriter) Write(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrBlobClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	n := len(p)
+	r.hash.Write(p)
+	r.size += int64(n)
+	for len(p) > 0 {
+		take := blobChunkSize - len(r.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		r.buf = append(r.buf, p[:take]...)
+		p = p[take:]
+		if len(r.buf) == blobChunkSize {
+			r.err = r.flush()
+			if r.err != nil {
+				return n - len(p), r.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (r *blobWriter) flush() error {
+	err := r.db.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(blobChunkKey(r.upload, r.chunks), r.buf)
+	})
+	if err != nil {
+		return err
+	}
+	r.chunks++
+	r.buf = nil
+	return nil
+}
+
+func (r *blobWriter) Close() error {
+	if r.closed {
+		return ErrBlobClosed
+	}
+	r.closed = true
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) > 0 {
+		err := r.flush()
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(&blobManifest{
+		BlobInfo: BlobInfo{
+			Size:      r.size,
+			Chunks:    r.chunks,
+			ChunkSize: blobChunkSize,
+			Checksum:  hex.EncodeToString(r.hash.Sum(nil)),
+			CreatedAt: time.Now().UTC(),
+		},
+		Upload: r.upload,
+	})
+	if err != nil {
+		return err
+	}
+	var old blobManifest
+	replaced := false
+	err = r.db.DB.Update(func(txn *badger.Txn) error {
+		var err error
+		old, err = readBlobManifest(txn, r.id)
+		replaced = err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return txn.Set(joinKey(blobManifestPrefix, []byte(r.id)), data)
+	})
+	if err != nil || !replaced {
+		return err
+	}
+	// readers opened before the replace still see the old chunks through their transaction
+	return r.db.deleteBlobChunks(old.Upload, old.Chunks)
+}
+
+// blobReader reads chunks through one transaction so it sees the blob as it was when opened
+type blobReader struct {
+	txn      *badger.Txn
+	id       string
+	manifest blobManifest
+	offset   int64
+
+	// chunk is the number of the chunk in data, -1 before one is read
+	chunk int
+	data  []byte
+
+	// hash has the first hashed bytes of the blob, Checksum is checked when hashed reaches Size
+	hash    hash.Hash
+	hashed  int64
+	checked bool
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.txn == nil {
+		return 0, ErrBlobClosed
+	}
+	if r.offset >= r.manifest.Size {
+		return 0, r.checkSum()
+	}
+	chunk := int(r.offset / int64(r.manifest.ChunkSize))
+	if chunk != r.chunk {
+		item, err := r.txn.Get(blobChunkKey(r.manifest.Upload, chunk))
+		if err == badger.ErrKeyNotFound {
+			return 0, fmt.Errorf("%w blob: %v chunk: %v missing", ErrInvalidBlob, r.id, chunk)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.data, err = item.ValueCopy(r.data[:0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = chunk
+	}
+	start := int(r.offset - int64(chunk)*int64(r.manifest.ChunkSize))
+	if start >= len(r.data) {
+		return 0, fmt.Errorf("%w blob: %v chunk: %v short", ErrInvalidBlob, r.id, chunk)
+	}
+	n := copy(p, r.data[start:])
+	if r.offset == r.hashed {
+		r.hash.Write(p[:n])
+		r.hashed += int64(n)
+	}
+	r.offset += int64(n)
+	return n, nil
+}
+
+// checkSum returns io.EOF or ErrInvalidBlob if the whole blob was hashed and does not match
+func (r *blobReader) checkSum() error {
+	if r.hashed != r.manifest.Size || r.checked {
+		return io.EOF
+	}
+	r.checked = true
+	sum := hex.EncodeToString(r.hash.Sum(nil))
+	if sum != r.manifest.Checksum {
+		return fmt.Errorf("%w blob: %v checksum mismatch", ErrInvalidBlob, r.id)
+	}
+	return io.EOF
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return r.offset, fmt.Errorf("blob seek: invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("blob seek: negative position %v", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.txn == nil {
+		return ErrBlobClosed
+	}
+	r.txn.Discard()
+	r.txn = nil
+	return nil
+}
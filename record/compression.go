@@ -0,0 +1,136 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrInvalidCompression indicates a stored value with an unknown compression header or data that
+// could not be decompressed
+var ErrInvalidCompression = errors.New("invalid compressed value")
+
+// defaultCompressionMinSize is used when Compression.MinSize is not more than 0
+const defaultCompressionMinSize = 128
+
+// CompressionAlgorithm identifies how a value is compressed.  Compressed values start with a
+// header byte holding the algorithm, values stored without compression are JSON so never start
+// with one of these bytes
+type CompressionAlgorithm byte
+
+const (
+	// CompressSnappy is fast with a modest ratio
+	CompressSnappy CompressionAlgorithm = 0x01
+
+	// CompressZstd is slower with a better ratio
+	CompressZstd CompressionAlgorithm = 0x02
+)
+
+func (r CompressionAlgorithm) String() string {
+	switch r {
+	case CompressSnappy:
+		return "snappy"
+	case CompressZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%v)", byte(r))
+}
+
+// Compression controls how the values of a record type are compressed
+type Compression struct {
+	Algorithm CompressionAlgorithm
+
+	// MinSize is the smallest JSON encoded value that is compressed, smaller values are stored
+	// as is.  128 if not more than 0
+	MinSize int
+}
+
+// Compressor may be implemented by a Record to have the values of its type compressed.
+// Compression is called once by New on the records provided to it.  Values written before a type
+// was compressed, or with a different algorithm, are still read correctly
+type Compressor interface {
+	Compression() Compression
+}
+
+// zstd encoders and decoders are safe for concurrent use of EncodeAll and DecodeAll, they are
+// created on first use as they allocate buffers
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// encodeValue returns the value stored for the JSON encoded data of a record of this type
+func (r *recordType) encodeValue(data []byte) ([]byte, error) {
+	if r.compression == nil || len(data) < r.compression.MinSize {
+		return data, nil
+	}
+	switch r.compression.Algorithm {
+	case CompressSnappy:
+		value := make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+		value[0] = byte(CompressSnappy)
+		return value[:1+len(snappy.Encode(value[1:], data))], nil
+	case CompressZstd:
+		err := initZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, []byte{byte(CompressZstd)}), nil
+	}
+	return nil, fmt.Errorf("%w algorithm: %v", ErrInvalidCompression, r.compression.Algorithm)
+}
+
+// unmarshalValue decodes a stored record value into v
+func unmarshalValue(val []byte, v interface{}) error {
+	data, err := decodeValue(val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// isCompressed reports if a stored record value starts with a compression header
+func isCompressed(val []byte) bool {
+	return len(val) > 0 &&
+		(val[0] == byte(CompressSnappy) || val[0] == byte(CompressZstd))
+}
+
+// decodeValue returns the JSON encoded data of a stored record value, val itself if it is not
+// compressed
+func decodeValue(val []byte) ([]byte, error) {
+	if !isCompressed(val) {
+		return val, nil
+	}
+	if CompressionAlgorithm(val[0]) == CompressSnappy {
+		data, err := snappy.Decode(nil, val[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w algorithm: snappy error: %v", ErrInvalidCompression, err)
+		}
+		return data, nil
+	}
+	err := initZstd()
+	if err != nil {
+		return nil, err
+	}
+	data, err := zstdDecoder.DecodeAll(val[1:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w algorithm: zstd error: %v", ErrInvalidCompression, err)
+	}
+	return data, nil
+}
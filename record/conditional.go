@@ -0,0 +1,160 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrAlreadyExists indicates WriteIfAbsent found a record with the same key
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrVersionMismatch indicates WriteIfVersion found a version other than the one expected
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ConditionalRecorder adds writes and deletes that only happen when a condition about the
+// existing record is met
+type ConditionalRecorder interface {
+	// WriteIfAbsent works like Write but returns ErrAlreadyExists if a record with the same key
+	// exists
+	WriteIfAbsent(record Record) error
+
+	// DeleteIfExists works like Delete but returns ErrNotFound if no record has the key
+	DeleteIfExists(record Record) error
+
+	// ReadVersion works like Read and also returns the version of the record read.  The version
+	// changes every time the record is written
+	ReadVersion(record Record) (uint64, error)
+
+	// WriteIfVersion works like Write but returns ErrVersionMismatch unless the current version
+	// of the record is version.  A version of 0 requires that the record does not exist
+	WriteIfVersion(record Record, version uint64) error
+}
+
+func (r *recorderDB) WriteIfAbsent(record Record) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.WriteIfAbsent(record)
+	})
+}
+
+func (r *recorderDB) DeleteIfExists(record Record) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.DeleteIfExists(record)
+	})
+}
+
+func (r *recorderDB) ReadVersion(record Record) (uint64, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.ReadVersion(record)
+}
+
+func (r *recorderDB) WriteIfVersion(record Record, version uint64) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.WriteIfVersion(record, version)
+	})
+}
+
+func (r *recorderDB) Modify(record Record, fn func(record Record) error) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		err := txn.Read(record)
+		if err != nil {
+			return err
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+		return txn.Write(record)
+	})
+}
+
+func (r *recorderTxn) WriteIfAbsent(record Record) error {
+	_, err := r.getItem(record)
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	return r.Write(record)
+}
+
+func (r *recorderTxn) DeleteIfExists(record Record) error {
+	_, err := r.getItem(record)
+	if err != nil {
+		return err
+	}
+	return r.Delete(record)
+}
+
+func (r *recorderTxn) ReadVersion(record Record) (uint64, error) {
+	item, err := r.readItem(record)
+	if err != nil {
+		return 0, err
+	}
+	return item.Version(), nil
+}
+
+func (r *recorderTxn) WriteIfVersion(record Record, version uint64) error {
+	var current uint64
+	item, err := r.getItem(record)
+	if err == nil {
+		current = item.Version()
+	} else if err != ErrNotFound {
+		return err
+	}
+	if current != version {
+		return fmt.Errorf("%w expected: %v found: %v", ErrVersionMismatch, version, current)
+	}
+	return r.Write(record)
+}
+
+// readItem reads record and returns the badger item it was read from
+func (r *recorderTxn) readItem(record Record) (*badger.Item, error) {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return nil, err
+	}
+	var item *badger.Item
+	err = r.db.handle(OpRead, record, func(op Op, record Record) error {
+		var err error
+		item, err = r.getItem(record)
+		if err != nil {
+			return err
+		}
+		err = item.Value(func(val []byte) error {
+			return rt.decodeRecord(val, item.Key()[len(rt.prefix):], record)
+		})
+		if err != nil {
+			return err
+		}
+		return afterRead(op, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// getItem gets the badger item stored for record, ErrNotFound is returned if there is none
+func (r *recorderTxn) getItem(record Record) (*badger.Item, error) {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return nil, err
+	}
+	keyValue, err := record.Key()
+	if err != nil {
+		return nil, err
+	}
+	item, err := r.Get(joinKey(rt.prefix, keyValue))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return item, nil
+}
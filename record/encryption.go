@@ -0,0 +1,375 @@
+package record
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrNoKeyProvider indicates a record type with encrypted fields was used before SetKeyProvider
+var ErrNoKeyProvider = errors.New("record type has encrypted fields but no key provider is set")
+
+// ErrInvalidEncryptedField indicates a field tagged to be encrypted that is not an exported
+// string or []byte
+var ErrInvalidEncryptedField = errors.New("encrypted field must be an exported string or []byte")
+
+// ErrInvalidCiphertext indicates an encrypted field that could not be decrypted
+var ErrInvalidCiphertext = errors.New("invalid encrypted field")
+
+// encryptTagName and encryptTagValue make the struct tag that marks a field to be encrypted
+const (
+	encryptTagName  = "record"
+	encryptTagValue = "encrypt"
+)
+
+// ciphertextVersion is the first byte of every encrypted field value.  It is followed by the
+// length of the key id, the key id, the nonce then the sealed data
+const ciphertextVersion = 1
+
+// KeyProvider provides the AES keys, 16, 24 or 32 bytes long, used to encrypt record fields.
+// Keys are chosen per record so they can depend on the record type or on a tenant field of the
+// record
+type KeyProvider interface {
+	// CurrentKey returns the key, and its id, that the encrypted fields of record are encrypted
+	// with when it is written.  Ids must not be longer than 255 bytes
+	CurrentKey(record Record) (id string, key []byte, err error)
+
+	// Key returns the key with id, it must return keys that are no longer current for as long as
+	// values encrypted with them are kept
+	Key(id string) ([]byte, error)
+}
+
+// FieldEncryptor encrypts the fields of records tagged `record:"encrypt"` with AES-GCM.  Only
+// string and []byte fields of the struct returned by Record() can be encrypted, empty values are
+// stored as is.  Encrypted values are what is stored so indexes, exports and history never see
+// the plain text, which also means encrypted fields can not usefully be indexed or aggregated
+type FieldEncryptor interface {
+	// SetKeyProvider sets the provider of the keys used to encrypt fields.  It must be called
+	// before record types with encrypted fields are used
+	SetKeyProvider(provider KeyProvider)
+
+	// ReEncrypt writes again each record of the provided type with a field encrypted with a key
+	// that is no longer current so all are encrypted with the current keys.  Hooks are not called
+	// and the records keep their TTL.  It works in chunks of transactions and returns the number
+	// written.  Values kept in history and the trash keep the keys they were encrypted with
+	ReEncrypt(record Record) (int, error)
+}
+
+// encryptedField is a field of a record type that is encrypted
+type encryptedField struct {
+	index int
+	name  string
+	bytes bool
+}
+
+// reEncryptChunkSize is the number of records ReEncrypt reads in each transaction
+const reEncryptChunkSize = 1000
+
+func (r *recorderDB) SetKeyProvider(provider KeyProvider) {
+	for _, rt := range r.types {
+		rt.keys = provider
+	}
+}
+
+func (r *recorderDB) ReEncrypt(record Record) (int, error) {
+	rt, err := r.recordType(record)
+	if err != nil {
+		return 0, err
+	}
+	if len(rt.encrypted) == 0 {
+		return 0, nil
+	}
+	if rt.keys == nil {
+		return 0, fmt.Errorf("%w name: %v", ErrNoKeyProvider, rt.name)
+	}
+	total := 0
+	var next []byte
+	for more := true; more; {
+		count := 0
+		var chunkMore bool
+		var chunkNext []byte
+		// the chunk is only moved past once its transaction commits
+		err = r.Update(context.Background(), func(txn RecorderTxn) error {
+			count = 0
+			var err error
+			chunkMore, chunkNext, err = txn.(*recorderTxn).reEncrypt(rt, record, next, &count)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		more, next = chunkMore, chunkNext
+		total += count
+	}
+	return total, nil
+}
+
+// reEncrypt writes again the records with stale keys in a chunk of records starting at from.
+// It returns if there are more records and the key value to start the next chunk at
+func (r *recorderTxn) reEncrypt(
+	rt *recordType,
+	record Record,
+	from []byte,
+	count *int,
+) (bool, []byte, error) {
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = rt.prefix
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	value := reflect.ValueOf(record.Record()).Elem()
+	read := 0
+	for it.Seek(joinKey(rt.prefix, from)); it.Valid(); it.Next() {
+		item := it.Item()
+		keyValue := item.KeyCopy(nil)[len(rt.prefix):]
+		if read >= reEncryptChunkSize {
+			return true, keyValue, nil
+		}
+		read++
+		// clear values left by the last record so they are not written to this one
+		value.Set(reflect.Zero(value.Type()))
+		var keyIDs []string
+		err := item.Value(func(val []byte) error {
+			err := unmarshalValue(val, record.Record())
+			if err != nil {
+				return err
+			}
+			keyIDs, err = rt.decryptFields(record, keyValue)
+			return err
+		})
+		if err != nil {
+			return false, nil, err
+		}
+		err = record.SetKey(keyValue)
+		if err != nil {
+			return false, nil, err
+		}
+		current, _, err := rt.keys.CurrentKey(record)
+		if err != nil {
+			return false, nil, err
+		}
+		stale := false
+		for _, v := range keyIDs {
+			stale = stale || v != current
+		}
+		if !stale {
+			continue
+		}
+		entry, data, err := rt.newEntry(record)
+		if err != nil {
+			return false, nil, err
+		}
+		entry.ExpiresAt = item.ExpiresAt()
+		err = r.setEntry(rt, entry, data)
+		if err != nil {
+			return false, nil, err
+		}
+		*count++
+	}
+	return false, nil, nil
+}
+
+// findEncryptedFields returns the fields of the struct returned by record.Record() tagged to be
+// encrypted
+func findEncryptedFields(record Record) ([]encryptedField, error) {
+	t := reflect.TypeOf(record.Record())
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, nil
+	}
+	t = t.Elem()
+	var fields []encryptedField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get(encryptTagName) != encryptTagValue {
+			continue
+		}
+		field := encryptedField{index: i, name: f.Name}
+		switch {
+		case f.PkgPath != "":
+		case f.Type.Kind() == reflect.String:
+			fields = append(fields, field)
+			continue
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Uint8:
+			field.bytes = true
+			fields = append(fields, field)
+			continue
+		}
+		return nil, fmt.Errorf(
+			"%w name: %v field: %v",
+			ErrInvalidEncryptedField,
+			record.Name(),
+			f.Name,
+		)
+	}
+	return fields, nil
+}
+
+// marshal returns the JSON encoding of record, which has key keyValue, with its encrypted fields
+// encrypted.  A copy of the struct is encrypted so record is not changed
+func (r *recordType) marshal(record Record, keyValue []byte) ([]byte, error) {
+	if len(r.encrypted) == 0 {
+		return json.Marshal(record.Record())
+	}
+	if r.keys == nil {
+		return nil, fmt.Errorf("%w name: %v", ErrNoKeyProvider, r.name)
+	}
+	keyID, key, err := r.keys.CurrentKey(record)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("%w name: %v key id too long", ErrInvalidCiphertext, r.name)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.ValueOf(record.Record()).Elem()
+	copied := reflect.New(value.Type())
+	copied.Elem().Set(value)
+	for _, field := range r.encrypted {
+		f := copied.Elem().Field(field.index)
+		plain := fieldBytes(f, field)
+		if len(plain) == 0 {
+			continue
+		}
+		header := 2 + len(keyID) + aead.NonceSize()
+		sealed := make([]byte, header, header+len(plain)+aead.Overhead())
+		sealed[0] = ciphertextVersion
+		sealed[1] = byte(len(keyID))
+		copy(sealed[2:], keyID)
+		nonce := sealed[2+len(keyID):]
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		sealed = aead.Seal(sealed, nonce, plain, r.additionalData(field, keyValue))
+		if field.bytes {
+			f.SetBytes(sealed)
+		} else {
+			f.SetString(base64.StdEncoding.EncodeToString(sealed))
+		}
+	}
+	return json.Marshal(copied.Interface())
+}
+
+// decryptFields decrypts the encrypted fields of record, which has key keyValue, in place and
+// returns the ids of the keys they were encrypted with
+func (r *recordType) decryptFields(record Record, keyValue []byte) ([]string, error) {
+	if len(r.encrypted) == 0 {
+		return nil, nil
+	}
+	if r.keys == nil {
+		return nil, fmt.Errorf("%w name: %v", ErrNoKeyProvider, r.name)
+	}
+	value := reflect.ValueOf(record.Record()).Elem()
+	var keyIDs []string
+	for _, field := range r.encrypted {
+		f := value.Field(field.index)
+		sealed := fieldBytes(f, field)
+		if len(sealed) == 0 {
+			continue
+		}
+		if !field.bytes {
+			var err error
+			sealed, err = base64.StdEncoding.DecodeString(string(sealed))
+			if err != nil {
+				return nil, r.ciphertextError(field, err)
+			}
+		}
+		if len(sealed) < 2 || sealed[0] != ciphertextVersion || len(sealed) < 2+int(sealed[1]) {
+			return nil, r.ciphertextError(field, errors.New("bad header"))
+		}
+		keyID := string(sealed[2 : 2+sealed[1]])
+		sealed = sealed[2+len(keyID):]
+		key, err := r.keys.Key(keyID)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return nil, r.ciphertextError(field, errors.New("too short"))
+		}
+		nonce := sealed[:aead.NonceSize()]
+		plain, err := aead.Open(
+			nil,
+			nonce,
+			sealed[aead.NonceSize():],
+			r.additionalData(field, keyValue),
+		)
+		if err != nil {
+			return nil, r.ciphertextError(field, err)
+		}
+		if field.bytes {
+			f.SetBytes(plain)
+		} else {
+			f.SetString(string(plain))
+		}
+		keyIDs = append(keyIDs, keyID)
+	}
+	return keyIDs, nil
+}
+
+// decryptValue returns the JSON value data, of the record with key keyValue, with its encrypted
+// fields decrypted.  data is returned when the type has no encrypted fields
+func (r *recordType) decryptValue(data []byte, keyValue []byte) ([]byte, error) {
+	if data == nil || len(r.encrypted) == 0 {
+		return data, nil
+	}
+	record := r.newRecord()
+	err := json.Unmarshal(data, record.Record())
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.decryptFields(record, keyValue)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record.Record())
+}
+
+// additionalData ties each encrypted value to its record type, field and record key so it can
+// not be moved to another field or record.  Field names can not hold a 0 byte so it ends the name
+func (r *recordType) additionalData(field encryptedField, keyValue []byte) []byte {
+	data := make([]byte, 0, len(r.name)+1+len(field.name)+1+len(keyValue))
+	data = append(data, r.name...)
+	data = append(data, '.')
+	data = append(data, field.name...)
+	data = append(data, 0)
+	return append(data, keyValue...)
+}
+
+func (r *recordType) ciphertextError(field encryptedField, err error) error {
+	return fmt.Errorf(
+		"%w name: %v field: %v error: %v",
+		ErrInvalidCiphertext,
+		r.name,
+		field.name,
+		err,
+	)
+}
+
+func fieldBytes(f reflect.Value, field encryptedField) []byte {
+	if field.bytes {
+		return f.Bytes()
+	}
+	return []byte(f.String())
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,268 @@
+package record
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const expiryKeyMark = 'x'
+
+// RecordMeta is what is known about a stored record other than its value
+type RecordMeta struct {
+	// ExpiresAt is when the record expires, the zero time if it does not
+	ExpiresAt time.Time
+
+	// Version changes every time the record is written
+	Version uint64
+}
+
+// ExpiryRecorder adds reading and changing when records expire
+type ExpiryRecorder interface {
+	// ReadMeta returns the RecordMeta of the record with the key of the provided record without
+	// reading its value.  ErrNotFound is returned if there is no such record
+	ReadMeta(record Record) (RecordMeta, error)
+
+	// Touch changes the record with the key of the provided record to expire ttl from now
+	// without changing its value, a ttl of 0 removes its expiry.  record.Record() is not used.
+	// badger can not change the expiry of a key without setting it again so the stored value is
+	// written again, which gives the record a new version, conflicts with transactions that read
+	// it and is seen by change hooks and history.  ErrNotFound is returned if there is no such
+	// record
+	Touch(record Record, ttl time.Duration) error
+
+	// WriteWithExpiry works like Write but the record expires at expiresAt instead of after
+	// record.TTL(), the zero time means it does not expire
+	WriteWithExpiry(record Record, expiresAt time.Time) error
+}
+
+// ExpiryTracker may be implemented by a Record for its type to be seen by Sweep when records
+// expire.  A copy of the value of each record with an expiry is kept until it is swept.  Record
+// types that track expiry must always be written in a transaction
+type ExpiryTracker interface {
+	TrackExpiry() bool
+}
+
+// ExpiryEvent describes an expired record found by Sweep
+type ExpiryEvent struct {
+	// Record is a new record holding the value as it was when it expired
+	Record Record
+
+	Key       []byte
+	ExpiresAt time.Time
+}
+
+func (r *recorderDB) ReadMeta(record Record) (RecordMeta, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.ReadMeta(record)
+}
+
+func (r *recorderDB) Touch(record Record, ttl time.Duration) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.Touch(record, ttl)
+	})
+}
+
+func (r *recorderDB) WriteWithExpiry(record Record, expiresAt time.Time) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.WriteWithExpiry(record, expiresAt)
+	})
+}
+
+func (r *recorderTxn) ReadMeta(record Record) (RecordMeta, error) {
+	item, err := r.getItem(record)
+	if err != nil {
+		return RecordMeta{}, err
+	}
+	return RecordMeta{ExpiresAt: expiresAtTime(item.ExpiresAt()), Version: item.Version()}, nil
+}
+
+func (r *recorderTxn) Touch(record Record, ttl time.Duration) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	item, err := r.getItem(record)
+	if err != nil {
+		return err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	data, err := decodeValue(value)
+	if err != nil {
+		return err
+	}
+	entry := badger.NewEntry(item.KeyCopy(nil), value)
+	if ttl > 0 {
+		entry.WithTTL(ttl)
+	}
+	return r.setEntry(rt, entry, data)
+}
+
+func (r *recorderTxn) WriteWithExpiry(record Record, expiresAt time.Time) error {
+	return r.write(record, &expiresAt)
+}
+
+// expiryPrefix returns the prefix of the expiry keys of the record type, each is followed by the
+// big endian expiry time and the record key
+func (r *recordType) expiryPrefix() []byte {
+	return append(r.prefix[:3:3], expiryKeyMark)
+}
+
+func (r *recordType) expiryKey(expiresAt uint64, keyValue []byte) []byte {
+	key := make([]byte, 0, 4+8+len(keyValue))
+	key = append(key, r.expiryPrefix()...)
+	key = key[:4+8]
+	binary.BigEndian.PutUint64(key[4:], expiresAt)
+	return append(key, keyValue...)
+}
+
+// updateExpiry moves the expiry entry of the record stored at key from that of the current value
+// to one for data expiring at expiresAt, data is nil when the record is being deleted
+func (r *recorderTxn) updateExpiry(
+	rt *recordType,
+	key []byte,
+	old *badger.Item,
+	data []byte,
+	expiresAt uint64,
+) error {
+	keyValue := key[len(rt.prefix):]
+	if old != nil && old.ExpiresAt() > 0 {
+		err := r.Txn.Delete(rt.expiryKey(old.ExpiresAt(), keyValue))
+		if err != nil {
+			return err
+		}
+	}
+	if data == nil || expiresAt == 0 {
+		return nil
+	}
+	return r.Set(rt.expiryKey(expiresAt, keyValue), data)
+}
+
+// sweepBatchSize is the number of expired records handled together by Sweep
+const sweepBatchSize = 1000
+
+// expired is an expiry entry found by Sweep
+type expired struct {
+	key       []byte
+	value     []byte
+	expiresAt uint64
+}
+
+func (r *recorderDB) Sweep(cb func(event ExpiryEvent)) (int, error) {
+	count := 0
+	for _, rt := range r.types {
+		if !rt.trackExpiry {
+			continue
+		}
+		for {
+			n, err := r.sweepType(rt, cb)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			if n < sweepBatchSize {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+// sweepType calls cb with up to sweepBatchSize expired records of type rt then deletes their
+// expiry entries, the number found is returned
+func (r *recorderDB) sweepType(rt *recordType, cb func(event ExpiryEvent)) (int, error) {
+	prefix := rt.expiryPrefix()
+	var found []expired
+	err := r.DB.View(func(txn *badger.Txn) error {
+		now := uint64(time.Now().Unix())
+		itOps := badger.DefaultIteratorOptions
+		itOps.Prefix = prefix
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && len(found) < sweepBatchSize; it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			expiresAt := binary.BigEndian.Uint64(key[len(prefix):])
+			// badger treats a record as expired when its time is not after now
+			if expiresAt > now {
+				return nil
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			found = append(found, expired{key: key, value: value, expiresAt: expiresAt})
+		}
+		return nil
+	})
+	if err != nil || len(found) == 0 {
+		return 0, err
+	}
+	for _, v := range found {
+		keyValue := v.key[len(prefix)+8:]
+		record := rt.newRecord()
+		err = rt.decodeRecord(v.value, keyValue, record)
+		if err != nil {
+			return 0, err
+		}
+		err = record.SetKey(keyValue)
+		if err != nil {
+			return 0, err
+		}
+		err = r.handle(OpRead, record, afterRead)
+		if err != nil {
+			return 0, err
+		}
+		cb(ExpiryEvent{Record: record, Key: keyValue, ExpiresAt: expiresAtTime(v.expiresAt)})
+	}
+	err = r.DB.Update(func(txn *badger.Txn) error {
+		for _, v := range found {
+			err := txn.Delete(v.key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(found), err
+}
+
+func (r *recorderDB) StartSweeper(interval time.Duration, cb func(event ExpiryEvent)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, err := r.Sweep(cb)
+				if err != nil {
+					fmt.Println("record sweeper error:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// expiresAtTime converts a badger expiry to a time, 0 is the zero time
+func expiresAtTime(expiresAt uint64) time.Time {
+	if expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(expiresAt), 0)
+}
@@ -0,0 +1,265 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrInvalidImport indicates a line of an import that could not be used
+var ErrInvalidImport = errors.New("invalid import line")
+
+// ImportMode controls what Import does with a record that already exists
+type ImportMode int
+
+const (
+	// ImportUpsert overwrites existing records
+	ImportUpsert ImportMode = iota
+
+	// ImportSkip leaves existing records unchanged
+	ImportSkip
+
+	// ImportFail stops the import with ErrAlreadyExists.  Batches committed before the existing
+	// record was found remain
+	ImportFail
+)
+
+// defaultImportBatchSize is used when ImportOptions.BatchSize is not more than 0
+const defaultImportBatchSize = 1000
+
+// ImportOptions controls how Import writes records
+type ImportOptions struct {
+	Mode ImportMode
+
+	// BatchSize is the number of records written in each transaction, 1000 if not more than 0.
+	// Batches that are too big for one transaction are split
+	BatchSize int
+
+	// SkipHooks writes the values as they were exported without decoding them into records, so
+	// middleware and the BeforeWrite and Validate hooks are not called and encrypted fields keep
+	// the keys they were encrypted with.  Change hooks are still called
+	SkipHooks bool
+}
+
+// ImportResult reports what Import did
+type ImportResult struct {
+	Written int
+	Skipped int
+}
+
+// ExportLine is one line of the JSON Lines written by Export and read by Import
+type ExportLine struct {
+	// Type is the record type name
+	Type string `json:"type"`
+
+	// Key is the record key, base64 encoded by encoding/json
+	Key []byte `json:"key"`
+
+	// TTLRemaining is the number of seconds until the record expires, 0 if it does not expire
+	TTLRemaining int64 `json:"ttlRemaining,omitempty"`
+
+	Value json.RawMessage `json:"value"`
+}
+
+func (r *recorderDB) Export(w io.Writer, types ...string) error {
+	if len(types) == 0 {
+		for name := range r.types {
+			types = append(types, name)
+		}
+		sort.Strings(types)
+	}
+	for _, name := range types {
+		if _, ok := r.types[name]; !ok {
+			return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	return r.DB.View(func(txn *badger.Txn) error {
+		now := uint64(time.Now().Unix())
+		for _, name := range types {
+			rt := r.types[name]
+			itOps := badger.DefaultIteratorOptions
+			itOps.Prefix = rt.prefix
+			it := txn.NewIterator(itOps)
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				line := ExportLine{Type: name, Key: item.Key()[len(rt.prefix):]}
+				if expiresAt := item.ExpiresAt(); expiresAt > 0 {
+					line.TTLRemaining = 1
+					if expiresAt > now {
+						line.TTLRemaining = int64(expiresAt - now)
+					}
+				}
+				err := item.Value(func(val []byte) error {
+					data, err := decodeValue(val)
+					if err != nil {
+						return err
+					}
+					line.Value = data
+					return encoder.Encode(&line)
+				})
+				if err != nil {
+					it.Close()
+					return err
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+}
+
+func (r *recorderDB) Import(reader io.Reader, opts *ImportOptions) (ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+	var result ImportResult
+	decoder := json.NewDecoder(reader)
+	batch := make([]*ExportLine, 0, batchSize)
+	for lineNumber := 1; ; lineNumber++ {
+		line := &ExportLine{}
+		err := decoder.Decode(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("%w line: %v error: %v", ErrInvalidImport, lineNumber, err)
+		}
+		if _, ok := r.types[line.Type]; !ok {
+			return result, fmt.Errorf(
+				"%w line: %v error: %v name: %v",
+				ErrInvalidImport,
+				lineNumber,
+				ErrRecordNotDefined,
+				line.Type,
+			)
+		}
+		batch = append(batch, line)
+		if len(batch) >= batchSize {
+			err = r.importBatch(batch, opts, &result)
+			if err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return result, r.importBatch(batch, opts, &result)
+}
+
+// importBatch writes batch in one transaction, splitting it in half if it is too big
+func (r *recorderDB) importBatch(
+	batch []*ExportLine,
+	opts *ImportOptions,
+	result *ImportResult,
+) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var batchResult ImportResult
+	err := r.Update(context.Background(), func(txn RecorderTxn) error {
+		batchResult = ImportResult{}
+		return txn.(*recorderTxn).importLines(batch, opts, &batchResult)
+	})
+	if err == badger.ErrTxnTooBig && len(batch) > 1 {
+		err = r.importBatch(batch[:len(batch)/2], opts, result)
+		if err != nil {
+			return err
+		}
+		return r.importBatch(batch[len(batch)/2:], opts, result)
+	}
+	if err != nil {
+		return err
+	}
+	result.Written += batchResult.Written
+	result.Skipped += batchResult.Skipped
+	return nil
+}
+
+// importLines writes lines, each is decoded into a new record and written through the write hooks
+// unless opts.SkipHooks is set
+func (r *recorderTxn) importLines(
+	lines []*ExportLine,
+	opts *ImportOptions,
+	result *ImportResult,
+) error {
+	now := time.Now()
+	for _, line := range lines {
+		rt := r.db.types[line.Type]
+		key := joinKey(rt.prefix, line.Key)
+		if opts.Mode != ImportUpsert {
+			_, err := r.Get(key)
+			if err == nil {
+				if opts.Mode == ImportFail {
+					return fmt.Errorf("%w name: %v key: %x", ErrAlreadyExists, rt.name, line.Key)
+				}
+				result.Skipped++
+				continue
+			}
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+		var expiresAt uint64
+		if line.TTLRemaining > 0 {
+			expiresAt = uint64(now.Add(time.Duration(line.TTLRemaining) * time.Second).Unix())
+		}
+		var err error
+		if opts.SkipHooks {
+			err = r.importValue(rt, key, line.Value, expiresAt)
+		} else {
+			err = r.importRecord(rt, line, expiresAt)
+		}
+		if err != nil {
+			return err
+		}
+		result.Written++
+	}
+	return nil
+}
+
+// importValue writes value, JSON as it was exported, at key
+func (r *recorderTxn) importValue(
+	rt *recordType,
+	key []byte,
+	value json.RawMessage,
+	expiresAt uint64,
+) error {
+	encoded, err := rt.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	entry := badger.NewEntry(key, encoded)
+	entry.ExpiresAt = expiresAt
+	return r.setEntry(rt, entry, value)
+}
+
+// importRecord decodes line into a new record and writes it the way Write does
+func (r *recorderTxn) importRecord(rt *recordType, line *ExportLine, expiresAt uint64) error {
+	record := rt.newRecord()
+	err := rt.decodeRecord(line.Value, line.Key, record)
+	if err != nil {
+		return err
+	}
+	err = record.SetKey(line.Key)
+	if err != nil {
+		return err
+	}
+	return r.db.handle(OpWrite, record, func(op Op, record Record) error {
+		entry, data, err := prepareEntry(rt, record)
+		if err != nil {
+			return err
+		}
+		entry.ExpiresAt = expiresAt
+		return r.setEntry(rt, entry, data)
+	})
+}
@@ -0,0 +1,484 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const geoKeyMark = 'g'
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371008.8
+
+// maxCoverCells is the most cells a query scans, the finest level that covers the query area
+// with no more than this many cells is used
+const maxCoverCells = 16
+
+// GeoPoint is a location in degrees
+type GeoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// GeoBox is the area between two corners.  If Min.Lng is more than Max.Lng the box crosses the
+// 180 degree meridian
+type GeoBox struct {
+	Min GeoPoint
+	Max GeoPoint
+}
+
+// GeoIndex describes the geospatial index of a record type
+type GeoIndex struct {
+	// LatPath and LngPath are the dot separated paths of the numbers in the records JSON that
+	// are the latitude and longitude in degrees, see FieldValue.  Records without valid numbers
+	// at both are not in the index
+	LatPath string
+	LngPath string
+}
+
+// GeoIndexer may be implemented by a Record to have a geospatial index maintained for its type.
+// GeoIndex is called once by New on the records provided to it.  Record types with a geospatial
+// index must always be written in a transaction
+type GeoIndexer interface {
+	GeoIndex() GeoIndex
+}
+
+// GeoSearcher adds searching the geospatial index of record types that implement GeoIndexer
+type GeoSearcher interface {
+	// RangeNear calls cb with each record of the provided type within radius meters of center
+	// nearest first, until cb returns false.  The provided record is used as a work area
+	RangeNear(
+		record Record,
+		center GeoPoint,
+		radius float64,
+		cb func(record Record, distance float64) bool,
+	) error
+
+	// RangeWithin calls cb with each record of the provided type inside box until cb returns
+	// false.  The provided record is used as a work area
+	RangeWithin(record Record, box GeoBox, cb func(record Record) bool) error
+}
+
+// Distance returns the great circle distance in meters between a and b
+func Distance(a, b GeoPoint) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Contains reports if p is inside the box
+func (r GeoBox) Contains(p GeoPoint) bool {
+	if p.Lat < r.Min.Lat || p.Lat > r.Max.Lat {
+		return false
+	}
+	if r.Min.Lng <= r.Max.Lng {
+		return p.Lng >= r.Min.Lng && p.Lng <= r.Max.Lng
+	}
+	return p.Lng >= r.Min.Lng || p.Lng <= r.Max.Lng
+}
+
+func (r *recorderDB) RangeNear(
+	record Record,
+	center GeoPoint,
+	radius float64,
+	cb func(record Record, distance float64) bool,
+) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.RangeNear(record, center, radius, cb)
+}
+
+func (r *recorderDB) RangeWithin(record Record, box GeoBox, cb func(record Record) bool) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.RangeWithin(record, box, cb)
+}
+
+func (r *recorderTxn) RangeNear(
+	record Record,
+	center GeoPoint,
+	radius float64,
+	cb func(record Record, distance float64) bool,
+) error {
+	rt, err := r.geoType(record)
+	if err != nil {
+		return err
+	}
+	type hit struct {
+		key      []byte
+		distance float64
+	}
+	var hits []hit
+	err = r.scanGeo(rt, nearBoxes(center, radius), func(p GeoPoint, keyValue []byte) {
+		distance := Distance(center, p)
+		if distance <= radius {
+			hits = append(hits, hit{key: keyValue, distance: distance})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].distance != hits[j].distance {
+			return hits[i].distance < hits[j].distance
+		}
+		return bytes.Compare(hits[i].key, hits[j].key) < 0
+	})
+	for _, v := range hits {
+		more, err := r.readGeoHit(rt, record, v.key)
+		if err != nil {
+			return err
+		}
+		if more && !cb(record, v.distance) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *recorderTxn) RangeWithin(record Record, box GeoBox, cb func(record Record) bool) error {
+	rt, err := r.geoType(record)
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	err = r.scanGeo(rt, splitBox(box), func(p GeoPoint, keyValue []byte) {
+		if box.Contains(p) {
+			keys = append(keys, keyValue)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, keyValue := range keys {
+		more, err := r.readGeoHit(rt, record, keyValue)
+		if err != nil {
+			return err
+		}
+		if more && !cb(record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *recorderTxn) geoType(record Record) (*recordType, error) {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return nil, err
+	}
+	if rt.geo == nil {
+		return nil, fmt.Errorf("%w name: %v index: geo", ErrIndexNotDefined, rt.name)
+	}
+	return rt, nil
+}
+
+// readGeoHit reads the record at keyValue into record, false is returned if it does not exist
+func (r *recorderTxn) readGeoHit(rt *recordType, record Record, keyValue []byte) (bool, error) {
+	item, err := r.Get(joinKey(rt.prefix, keyValue))
+	if err == badger.ErrKeyNotFound {
+		// left behind by a record that is gone
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = item.Value(func(val []byte) error {
+		return rt.decodeRecord(val, keyValue, record)
+	})
+	if err != nil {
+		return false, err
+	}
+	err = record.SetKey(keyValue)
+	if err != nil {
+		return false, err
+	}
+	return true, r.db.handle(OpRead, record, afterRead)
+}
+
+// scanGeo calls fn with the point and record key of each geo index entry in the cells covering
+// boxes, entries outside boxes may be included
+func (r *recorderTxn) scanGeo(
+	rt *recordType,
+	boxes []GeoBox,
+	fn func(p GeoPoint, keyValue []byte),
+) error {
+	prefix := rt.geoPrefix()
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = prefix
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	for _, cells := range coverBoxes(boxes) {
+		start := make([]byte, len(prefix)+8)
+		copy(start, prefix)
+		binary.BigEndian.PutUint64(start[len(prefix):], cells.start)
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			code := binary.BigEndian.Uint64(key[len(prefix):])
+			if code < cells.start || !cells.toEnd && code >= cells.end {
+				break
+			}
+			var p GeoPoint
+			err := item.Value(func(val []byte) error {
+				p = decodeGeoValue(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fn(p, append([]byte{}, key[len(prefix)+8:]...))
+		}
+	}
+	return nil
+}
+
+// geoPrefix returns the prefix of all keys in the geo index of the record type.  Each key is the
+// prefix, the 8 byte cell code of the point then the record key and its value is the point
+func (r *recordType) geoPrefix() []byte {
+	return append(r.prefix[:3:3], geoKeyMark)
+}
+
+// geoPoint finds the point in doc, false is returned if it does not have a valid one
+func (r *recordType) geoPoint(doc interface{}) (GeoPoint, bool) {
+	if doc == nil {
+		return GeoPoint{}, false
+	}
+	lat, ok := FieldValue(doc, r.geo.LatPath)
+	if !ok {
+		return GeoPoint{}, false
+	}
+	lng, ok := FieldValue(doc, r.geo.LngPath)
+	if !ok {
+		return GeoPoint{}, false
+	}
+	p := GeoPoint{}
+	p.Lat, ok = lat.(float64)
+	if !ok || p.Lat < -90 || p.Lat > 90 {
+		return GeoPoint{}, false
+	}
+	p.Lng, ok = lng.(float64)
+	if !ok || p.Lng < -180 || p.Lng > 180 {
+		return GeoPoint{}, false
+	}
+	return p, true
+}
+
+// updateGeo changes the geo index entry of the record stored at key from that of the current
+// value to that of data, data is nil when the record is being deleted
+func (r *recorderTxn) updateGeo(
+	rt *recordType,
+	key []byte,
+	old *badger.Item,
+	data []byte,
+	expiresAt uint64,
+) error {
+	keyValue := key[len(rt.prefix):]
+	var oldDoc, newDoc interface{}
+	var err error
+	if old != nil {
+		err = old.Value(func(val []byte) error {
+			return unmarshalValue(val, &oldDoc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		err = json.Unmarshal(data, &newDoc)
+		if err != nil {
+			return err
+		}
+	}
+	oldPoint, oldOk := rt.geoPoint(oldDoc)
+	newPoint, newOk := rt.geoPoint(newDoc)
+	if oldOk && (!newOk || geoCode(oldPoint) != geoCode(newPoint)) {
+		err = r.Txn.Delete(rt.geoKey(oldPoint, keyValue))
+		if err != nil {
+			return err
+		}
+	}
+	if !newOk {
+		return nil
+	}
+	// always set so the entry gets the same expiration as the record
+	entry := badger.NewEntry(rt.geoKey(newPoint, keyValue), encodeGeoValue(newPoint))
+	entry.ExpiresAt = expiresAt
+	return r.SetEntry(entry)
+}
+
+func (r *recordType) geoKey(p GeoPoint, keyValue []byte) []byte {
+	prefix := r.geoPrefix()
+	key := make([]byte, len(prefix)+8, len(prefix)+8+len(keyValue))
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], geoCode(p))
+	return append(key, keyValue...)
+}
+
+func encodeGeoValue(p GeoPoint) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, math.Float64bits(p.Lat))
+	binary.BigEndian.PutUint64(data[8:], math.Float64bits(p.Lng))
+	return data
+}
+
+func decodeGeoValue(data []byte) GeoPoint {
+	if len(data) < 16 {
+		return GeoPoint{Lat: math.NaN(), Lng: math.NaN()}
+	}
+	return GeoPoint{
+		Lat: math.Float64frombits(binary.BigEndian.Uint64(data)),
+		Lng: math.Float64frombits(binary.BigEndian.Uint64(data[8:])),
+	}
+}
+
+// geoCells returns the 32 bit cell numbers of p along each axis
+func geoCells(p GeoPoint) (uint32, uint32) {
+	return scaleToCell(p.Lat, -90, 180), scaleToCell(p.Lng, -180, 360)
+}
+
+func scaleToCell(v, min, size float64) uint32 {
+	cell := math.Floor((v - min) / size * (1 << 32))
+	if cell < 0 {
+		return 0
+	}
+	if cell >= 1<<32 {
+		return 1<<32 - 1
+	}
+	return uint32(cell)
+}
+
+// geoCode interleaves the cell numbers of p, longitude bits first like a geohash, so points that
+// are close usually have codes that share a long prefix
+func geoCode(p GeoPoint) uint64 {
+	lat, lng := geoCells(p)
+	return interleave(lng, lat)
+}
+
+func interleave(high, low uint32) uint64 {
+	var code uint64
+	for i := 31; i >= 0; i-- {
+		code = code<<2 | uint64(high>>uint(i)&1)<<1 | uint64(low>>uint(i)&1)
+	}
+	return code
+}
+
+// cellRange is the codes of all points in a set of adjacent cells, end is exclusive unless toEnd
+type cellRange struct {
+	start uint64
+	end   uint64
+	toEnd bool
+}
+
+// coverBoxes returns the ranges of codes of the cells covering boxes, sorted and merged
+func coverBoxes(boxes []GeoBox) []cellRange {
+	var ranges []cellRange
+	for _, box := range boxes {
+		ranges = append(ranges, coverBox(box)...)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:0]
+	for _, v := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && (merged[last].toEnd || merged[last].end >= v.start) {
+			if v.toEnd || !merged[last].toEnd && v.end > merged[last].end {
+				merged[last].end = v.end
+				merged[last].toEnd = v.toEnd
+			}
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
+
+// coverBox returns the ranges of codes of the cells of the finest level that covers box with no
+// more than maxCoverCells cells, box must not cross the 180 degree meridian
+func coverBox(box GeoBox) []cellRange {
+	minLat, minLng := geoCells(box.Min)
+	maxLat, maxLng := geoCells(box.Max)
+	level := uint(32)
+	for ; level > 0; level-- {
+		shift := 32 - level
+		latCells := uint64(maxLat>>shift) - uint64(minLat>>shift) + 1
+		lngCells := uint64(maxLng>>shift) - uint64(minLng>>shift) + 1
+		if latCells <= maxCoverCells && lngCells <= maxCoverCells &&
+			latCells*lngCells <= maxCoverCells {
+			break
+		}
+	}
+	shift := 32 - level
+	var ranges []cellRange
+	for lat := minLat >> shift; lat <= maxLat>>shift; lat++ {
+		for lng := minLng >> shift; lng <= maxLng>>shift; lng++ {
+			cell := interleave(lng<<shift, lat<<shift)
+			size := uint64(1) << (2 * shift)
+			v := cellRange{start: cell, end: cell + size}
+			v.toEnd = v.end == 0 || level == 0
+			ranges = append(ranges, v)
+			if lng == math.MaxUint32>>shift {
+				break
+			}
+		}
+		if lat == math.MaxUint32>>shift {
+			break
+		}
+	}
+	return ranges
+}
+
+// splitBox splits a box crossing the 180 degree meridian in two
+func splitBox(box GeoBox) []GeoBox {
+	if box.Min.Lng <= box.Max.Lng {
+		return []GeoBox{box}
+	}
+	return []GeoBox{
+		{Min: box.Min, Max: GeoPoint{Lat: box.Max.Lat, Lng: 180}},
+		{Min: GeoPoint{Lat: box.Min.Lat, Lng: -180}, Max: box.Max},
+	}
+}
+
+// nearBoxes returns boxes covering all points within radius meters of center
+func nearBoxes(center GeoPoint, radius float64) []GeoBox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	minLat := center.Lat - dLat
+	maxLat := center.Lat + dLat
+	if minLat <= -90 || maxLat >= 90 {
+		// a pole is inside the circle so every longitude is
+		return []GeoBox{{
+			Min: GeoPoint{Lat: math.Max(minLat, -90), Lng: -180},
+			Max: GeoPoint{Lat: math.Min(maxLat, 90), Lng: 180},
+		}}
+	}
+	// the widest longitude span is at the latitude furthest from the equator
+	maxAbsLat := math.Max(math.Abs(minLat), math.Abs(maxLat))
+	dLng := dLat / math.Cos(maxAbsLat*math.Pi/180)
+	if dLng >= 180 {
+		return []GeoBox{{
+			Min: GeoPoint{Lat: minLat, Lng: -180},
+			Max: GeoPoint{Lat: maxLat, Lng: 180},
+		}}
+	}
+	minLng := center.Lng - dLng
+	if minLng < -180 {
+		minLng += 360
+	}
+	maxLng := center.Lng + dLng
+	if maxLng > 180 {
+		maxLng -= 360
+	}
+	return splitBox(GeoBox{
+		Min: GeoPoint{Lat: minLat, Lng: minLng},
+		Max: GeoPoint{Lat: maxLat, Lng: maxLng},
+	})
+}
@@ -0,0 +1,261 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrHistoryNotKept indicates History or ReadAsOf was called with a record type that does not
+// keep history
+var ErrHistoryNotKept = errors.New("record type does not keep history")
+
+const historyKeyMark = 'h'
+
+// HistoryRetention controls how much history is kept for a record type
+type HistoryRetention struct {
+	// MaxVersions is the most values kept for each record including the current one, 0 means no
+	// limit
+	MaxVersions int
+
+	// MaxAge is how long each value is kept after a newer value replaces it, 0 means forever.
+	// The newest value, the current one or a delete, is always kept.  Values older than MaxAge
+	// are skipped when history is read and removed when the record is next written
+	MaxAge time.Duration
+}
+
+// HistoryKeeper may be implemented by a Record to keep the values records of its type have had.
+// KeepHistory is called once by New on the records provided to it.  Record types that keep
+// history must always be written in a transaction
+type HistoryKeeper interface {
+	KeepHistory() HistoryRetention
+}
+
+// HistoryEntry describes one value a record has had
+type HistoryEntry struct {
+	// Version is the version the record had with this value, see ReadVersion
+	Version uint64
+
+	// Time is when the value was written
+	Time time.Time
+
+	// Deleted is true if the record was deleted at Time
+	Deleted bool
+}
+
+// AsOf identifies a point in the history of a record, by Version if it is not 0 otherwise by
+// Time
+type AsOf struct {
+	Version uint64
+	Time    time.Time
+}
+
+// HistoryRecorder adds reading the history of records of types that implement HistoryKeeper
+type HistoryRecorder interface {
+	// History calls cb with each value the record with the key of the provided record has had,
+	// newest first and including the current value, until cb returns false.  The provided record
+	// is used as a work area and is not changed for entries that are deletes
+	History(record Record, cb func(record Record, entry HistoryEntry) bool) error
+
+	// ReadAsOf reads the value the record with the key of the provided record had at the point
+	// identified by asOf.  ErrNotFound is returned if the record did not exist then or that much
+	// history was not kept
+	ReadAsOf(record Record, asOf AsOf) (HistoryEntry, error)
+}
+
+func (r *recorderDB) History(record Record, cb func(record Record, entry HistoryEntry) bool) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.History(record, cb)
+}
+
+func (r *recorderDB) ReadAsOf(record Record, asOf AsOf) (HistoryEntry, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.ReadAsOf(record, asOf)
+}
+
+func (r *recorderTxn) History(record Record, cb func(record Record, entry HistoryEntry) bool) error {
+	return r.rangeHistory(record, func(entry HistoryEntry, item *badger.Item) (bool, error) {
+		if !entry.Deleted {
+			err := r.decodeHistory(record, item)
+			if err != nil {
+				return false, err
+			}
+		}
+		return cb(record, entry), nil
+	})
+}
+
+func (r *recorderTxn) ReadAsOf(record Record, asOf AsOf) (HistoryEntry, error) {
+	var found HistoryEntry
+	err := ErrNotFound
+	rangeErr := r.rangeHistory(record, func(entry HistoryEntry, item *badger.Item) (bool, error) {
+		if asOf.Version != 0 && entry.Version > asOf.Version ||
+			asOf.Version == 0 && entry.Time.After(asOf.Time) {
+			return true, nil
+		}
+		if !entry.Deleted {
+			found = entry
+			err = r.decodeHistory(record, item)
+		}
+		return false, nil
+	})
+	if rangeErr != nil {
+		return HistoryEntry{}, rangeErr
+	}
+	return found, err
+}
+
+// rangeHistory calls fn with the history entries of record newest first until fn returns false
+func (r *recorderTxn) rangeHistory(
+	record Record,
+	fn func(entry HistoryEntry, item *badger.Item) (bool, error),
+) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	if rt.history == nil {
+		return fmt.Errorf("%w name: %v", ErrHistoryNotKept, rt.name)
+	}
+	keyValue, err := record.Key()
+	if err != nil {
+		return err
+	}
+	prefix := rt.historyPrefix(keyValue)
+	itOps := badger.DefaultIteratorOptions
+	itOps.Reverse = true
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	now := time.Now()
+	var supersededAt time.Time
+	for it.Seek(prefixEnd(prefix)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if len(key) != len(prefix)+8 {
+			// reverse seek includes prefixEnd itself
+			continue
+		}
+		entry := HistoryEntry{
+			Version: item.Version(),
+			Time:    historyTime(key),
+			Deleted: item.ValueSize() == 0,
+		}
+		if rt.history.expired(supersededAt, now) {
+			// older entries were replaced even earlier
+			return nil
+		}
+		supersededAt = entry.Time
+		more, err := fn(entry, item)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorderTxn) decodeHistory(record Record, item *badger.Item) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	keyValue, err := record.Key()
+	if err != nil {
+		return err
+	}
+	err = item.Value(func(val []byte) error {
+		return rt.decodeRecord(val, keyValue, record)
+	})
+	if err != nil {
+		return err
+	}
+	return r.db.handle(OpRead, record, afterRead)
+}
+
+// historyPrefix returns the prefix of the history keys of the record at keyValue, it includes
+// the length of keyValue so it is not the prefix of the keys of other records.  Each key is
+// followed by the big endian time in nanoseconds the value was written
+func (r *recordType) historyPrefix(keyValue []byte) []byte {
+	prefix := make([]byte, 0, 4+binary.MaxVarintLen64+len(keyValue))
+	prefix = append(prefix, r.prefix[:3]...)
+	prefix = append(prefix, historyKeyMark)
+	var length [binary.MaxVarintLen64]byte
+	prefix = append(prefix, length[:binary.PutUvarint(length[:], uint64(len(keyValue)))]...)
+	return append(prefix, keyValue...)
+}
+
+// historyTime returns the time in a history key
+func historyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[len(key)-8:])))
+}
+
+// expired returns if a value replaced at supersededAt, the zero time if it has not been, is older
+// than MaxAge at now
+func (r *HistoryRetention) expired(supersededAt time.Time, now time.Time) bool {
+	return r.MaxAge > 0 && !supersededAt.IsZero() && now.Sub(supersededAt) > r.MaxAge
+}
+
+// updateHistory adds data as the newest value of the record at key, nil data records a delete.
+// Nothing is added if the newest value is the same, then values beyond MaxVersions and values
+// replaced more than MaxAge ago are removed.  Entries are written without a TTL since how long
+// one is kept only starts when a newer value replaces it
+func (r *recorderTxn) updateHistory(rt *recordType, key []byte, data []byte) error {
+	prefix := rt.historyPrefix(key[len(rt.prefix):])
+	var oldKeys [][]byte
+	// deleting a record without history adds nothing
+	same := data == nil
+	itOps := badger.DefaultIteratorOptions
+	itOps.Reverse = true
+	it := r.NewIterator(itOps)
+	for it.Seek(prefixEnd(prefix)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != len(prefix)+8 {
+			continue
+		}
+		if len(oldKeys) == 0 {
+			err := item.Value(func(val []byte) error {
+				same = bytes.Equal(val, data)
+				return nil
+			})
+			if err != nil {
+				it.Close()
+				return err
+			}
+		}
+		oldKeys = append(oldKeys, item.KeyCopy(nil))
+	}
+	it.Close()
+	keep := len(oldKeys)
+	if !same {
+		historyKey := make([]byte, len(prefix)+8)
+		copy(historyKey, prefix)
+		binary.BigEndian.PutUint64(historyKey[len(prefix):], uint64(time.Now().UnixNano()))
+		err := r.Set(historyKey, data)
+		if err != nil {
+			return err
+		}
+		if rt.history.MaxVersions > 0 {
+			keep = rt.history.MaxVersions - 1
+		}
+	} else if rt.history.MaxVersions > 0 {
+		keep = rt.history.MaxVersions
+	}
+	now := time.Now()
+	for i := 1; i < keep && i < len(oldKeys); i++ {
+		if rt.history.expired(historyTime(oldKeys[i-1]), now) {
+			keep = i
+		}
+	}
+	for i := keep; i < len(oldKeys); i++ {
+		err := r.Txn.Delete(oldKeys[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
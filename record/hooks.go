@@ -0,0 +1,182 @@
+package record
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Validator may be implemented by a Record to check it before it is written, an error returned
+// by Validate stops the write and is returned by it
+type Validator interface {
+	Validate() error
+}
+
+// BeforeWriter may be implemented by a Record to change it before it is written, for example to
+// fill in default values.  BeforeWrite is called before Validate
+type BeforeWriter interface {
+	BeforeWrite() error
+}
+
+// AfterReader may be implemented by a Record to change it after its value is read, for example
+// to fill in derived fields.  It is not called when only keys are read
+type AfterReader interface {
+	AfterRead() error
+}
+
+// BeforeDeleter may be implemented by a Record to check or clean up before it is deleted, only
+// the key of the record is set when BeforeDelete is called.  An error stops the delete
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// Op identifies the operation a Middleware is wrapping
+type Op int
+
+const (
+	// OpWrite is any write of a single record including those of WriteBuffered, WriteBatch and
+	// BulkLoad
+	OpWrite Op = iota
+
+	// OpRead is reading a record by Read or any of the range methods.  For ranges the value has
+	// already been read when the middleware is called and next only runs AfterRead
+	OpRead
+
+	// OpDelete is deleting a single record
+	OpDelete
+)
+
+// Handler performs an operation on a record
+type Handler func(op Op, record Record) error
+
+// Middleware wraps the Handler of every record operation.  It may change the record or return an
+// error before calling next and inspect the result after
+type Middleware func(next Handler) Handler
+
+func (r *recorderDB) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Change describes a write or delete of a record in a transaction
+type Change struct {
+	// Op is OpWrite or OpDelete
+	Op Op
+
+	// Type is the record type name
+	Type string
+
+	Key []byte
+
+	// Old and New are the JSON values before and after the change with any encrypted fields still
+	// encrypted.  Old is nil when the record did not exist and New is nil for deletes
+	Old []byte
+	New []byte
+
+	// OldPlain and NewPlain are Old and New with the encrypted fields decrypted, so changes can be
+	// compared by their plain text.  They are Old and New when the type has no encrypted fields.
+	// A value that can not be decrypted stops the change
+	OldPlain []byte
+	NewPlain []byte
+}
+
+// ChangeHook is called in the transaction of a change before it is made, an error stops the
+// change.  The old value is read in the transaction so while hooks are registered a write
+// conflicts with other transactions that change the same record, as writes of types with indexes
+// already do.  Changes the hook makes through txn are passed to the hooks too so a hook must ignore
+// the record types it writes
+type ChangeHook func(txn RecorderTxn, change Change) error
+
+func (r *recorderDB) OnChange(hook ChangeHook) {
+	r.changeHooks = append(r.changeHooks, hook)
+}
+
+// notifyChange calls the change hooks with the change of the record at key from old, nil if it
+// does not exist, to data, nil data is a delete.  Deleting a record that does not exist is not a
+// change
+func (r *recorderTxn) notifyChange(
+	op Op,
+	rt *recordType,
+	key []byte,
+	old *badger.Item,
+	data []byte,
+) error {
+	if len(r.db.changeHooks) == 0 {
+		return nil
+	}
+	change := Change{
+		Op:   op,
+		Type: rt.name,
+		Key:  append([]byte(nil), key[len(rt.prefix):]...),
+		New:  data,
+	}
+	if old != nil {
+		err := old.Value(func(val []byte) error {
+			oldData, err := decodeValue(val)
+			change.Old = append([]byte(nil), oldData...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if change.Old == nil && change.New == nil {
+		return nil
+	}
+	var err error
+	change.OldPlain, err = rt.decryptValue(change.Old, change.Key)
+	if err != nil {
+		return err
+	}
+	change.NewPlain, err = rt.decryptValue(change.New, change.Key)
+	if err != nil {
+		return err
+	}
+	for _, hook := range r.db.changeHooks {
+		err = hook(r, change)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle runs inner wrapped by all middleware, the first middleware provided to Use is outermost
+func (r *recorderDB) handle(op Op, record Record, inner Handler) error {
+	handler := inner
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	return handler(op, record)
+}
+
+// prepareEntry runs the write hooks of record then creates its entry, it is called by every
+// write path inside handle
+func prepareEntry(rt *recordType, record Record) (*badger.Entry, []byte, error) {
+	if beforeWriter, ok := record.(BeforeWriter); ok {
+		err := beforeWriter.BeforeWrite()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if validator, ok := record.(Validator); ok {
+		err := validator.Validate()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return rt.newEntry(record)
+}
+
+// afterRead is the Handler that runs the AfterRead hook of a record that has been read
+func afterRead(op Op, record Record) error {
+	if afterReader, ok := record.(AfterReader); ok {
+		return afterReader.AfterRead()
+	}
+	return nil
+}
+
+// beforeDelete runs the BeforeDelete hook of record
+func beforeDelete(record Record) error {
+	if beforeDeleter, ok := record.(BeforeDeleter); ok {
+		return beforeDeleter.BeforeDelete()
+	}
+	return nil
+}
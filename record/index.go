@@ -0,0 +1,401 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrNotIndexable indicates a value that can not be part of an index, only booleans, numbers and
+// strings can be indexed
+var ErrNotIndexable = errors.New("value can not be indexed")
+
+// ErrIndexNotDefined indicates RangeIndex was called with an index name the record type does not
+// have
+var ErrIndexNotDefined = errors.New("index not defined for record type")
+
+// ErrUniqueViolation is matched by errors.Is for a *UniqueViolationError
+var ErrUniqueViolation = errors.New("unique constraint violated")
+
+// Index describes a secondary index of a record type
+type Index struct {
+	// Name identifies the index, it must be unique for the record type and not contain a 0 byte
+	Name string
+
+	// Path is the dot separated path of the field in the records JSON that is indexed, see
+	// FieldValue.  Records where the field is missing or not indexable are not in the index
+	Path string
+
+	// Extract, if not nil, is used instead of Path to find the indexed value in the records JSON
+	// decoded into an interface{}.  Returning false leaves the record out of the index
+	Extract func(doc interface{}) (interface{}, bool)
+
+	// Unique causes writes of a record with the same indexed value as another record to fail
+	// with a *UniqueViolationError
+	Unique bool
+}
+
+// UniqueViolationError is returned when a write would give two records the same value in a
+// unique index
+type UniqueViolationError struct {
+	// Index is the name of the unique index
+	Index string
+
+	// Field is the Path of the unique index
+	Field string
+
+	// Key is the key of the record that already has the value
+	Key []byte
+}
+
+func (r *UniqueViolationError) Error() string {
+	return fmt.Sprintf("%v index: %v field: %v key: %x", ErrUniqueViolation, r.Index, r.Field, r.Key)
+}
+
+func (r *UniqueViolationError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+// Indexer may be implemented by a Record to have secondary indexes maintained for its type.
+// Indexes is called once by New on the records provided to it.  Record types with indexes must
+// always be written in a transaction
+type Indexer interface {
+	Indexes() []Index
+}
+
+const indexKeyMark = 'i'
+
+// IndexTagFalse, IndexTagTrue, IndexTagNumber and IndexTagString are the first byte of values
+// encoded by EncodeIndexValue, booleans have two tags and the other types have one each
+const (
+	IndexTagFalse  = 0x02
+	IndexTagTrue   = 0x03
+	IndexTagNumber = 0x04
+	IndexTagString = 0x05
+)
+
+// FieldValue finds the value at path in doc, a value decoded from JSON into an interface{}.  Path
+// is a dot separated list of object keys and array indexes, "" is doc itself.  false is returned
+// if there is no value at path
+func FieldValue(doc interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return doc, true
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			doc, ok = v[part]
+			if !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// EncodeIndexValue encodes value the way it is stored in an index.  The encoding sorts false,
+// true, numbers then strings with numbers and strings in their natural order.  value may be any
+// Go value that encodes to a JSON boolean, number or string
+func EncodeIndexValue(value interface{}) ([]byte, error) {
+	switch value.(type) {
+	case bool, float64, string:
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return []byte{IndexTagTrue}, nil
+		}
+		return []byte{IndexTagFalse}, nil
+	case float64:
+		bits := math.Float64bits(v)
+		if bits&(1<<63) == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		data := make([]byte, 9)
+		data[0] = IndexTagNumber
+		binary.BigEndian.PutUint64(data[1:], bits)
+		return data, nil
+	case string:
+		return append(EncodeIndexPrefix(v), 0, 1), nil
+	}
+	return nil, ErrNotIndexable
+}
+
+// EncodeIndexPrefix encodes a string so it matches the start of all encoded index values that
+// are strings starting with prefix
+func EncodeIndexPrefix(prefix string) []byte {
+	data := make([]byte, 0, len(prefix)+3)
+	data = append(data, IndexTagString)
+	for i := 0; i < len(prefix); i++ {
+		// 0 bytes are escaped so 0, 1 can mark the end of the string and keep the order
+		if prefix[i] == 0 {
+			data = append(data, 0, 0xff)
+			continue
+		}
+		data = append(data, prefix[i])
+	}
+	return data
+}
+
+// indexPrefix returns the prefix of all keys in the named index
+func (r *recordType) indexPrefix(name string) []byte {
+	prefix := make([]byte, 0, 3+1+len(name)+1)
+	prefix = append(prefix, r.prefix[:3]...)
+	prefix = append(prefix, indexKeyMark)
+	prefix = append(prefix, name...)
+	return append(prefix, 0)
+}
+
+// indexKey returns the key of the entry for doc in index, nil if doc is not in the index.  Keys
+// of unique indexes do not include the record key so there can only be one per value
+func (r *recordType) indexKey(index Index, doc interface{}, keyValue []byte) []byte {
+	if doc == nil {
+		return nil
+	}
+	var value interface{}
+	var ok bool
+	if index.Extract != nil {
+		value, ok = index.Extract(doc)
+	} else {
+		value, ok = FieldValue(doc, index.Path)
+	}
+	if !ok {
+		return nil
+	}
+	encoded, err := EncodeIndexValue(value)
+	if err != nil {
+		return nil
+	}
+	key := joinKey(r.indexPrefix(index.Name), encoded)
+	if index.Unique {
+		return key
+	}
+	return append(key, keyValue...)
+}
+
+// checkUnique returns a *UniqueViolationError if the unique index entry at key belongs to a
+// record of type rt other than the one at keyValue.  An entry whose record no longer exists, left
+// behind by a record that expired, is free to be overwritten
+func (r *recorderTxn) checkUnique(
+	rt *recordType,
+	index Index,
+	key []byte,
+	keyValue []byte,
+) error {
+	item, err := r.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(owner, keyValue) {
+		return nil
+	}
+	_, err = r.Get(joinKey(rt.prefix, owner))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &UniqueViolationError{Index: index.Name, Field: index.Path, Key: owner}
+}
+
+// updateIndexes changes the index entries of the record stored at key from those of the current
+// value to those of data, data is nil when the record is being deleted
+func (r *recorderTxn) updateIndexes(
+	rt *recordType,
+	key []byte,
+	old *badger.Item,
+	data []byte,
+	expiresAt uint64,
+) error {
+	keyValue := key[len(rt.prefix):]
+	var oldDoc, newDoc interface{}
+	var err error
+	if old != nil {
+		err = old.Value(func(val []byte) error {
+			return unmarshalValue(val, &oldDoc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		err = json.Unmarshal(data, &newDoc)
+		if err != nil {
+			return err
+		}
+	}
+	for _, index := range rt.indexes {
+		oldKey := rt.indexKey(index, oldDoc, keyValue)
+		newKey := rt.indexKey(index, newDoc, keyValue)
+		if oldKey != nil && !bytes.Equal(oldKey, newKey) {
+			err = r.Txn.Delete(oldKey)
+			if err != nil {
+				return err
+			}
+		}
+		if newKey != nil && index.Unique {
+			err = r.checkUnique(rt, index, newKey, keyValue)
+			if err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			// always set so the entry gets the same expiration as the record
+			entry := badger.NewEntry(newKey, append([]byte{}, keyValue...))
+			entry.ExpiresAt = expiresAt
+			err = r.SetEntry(entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *recorderTxn) RangeIndex(
+	record Record,
+	index string,
+	opts *RangeOptions,
+	cb func(record Record) bool,
+) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, v := range rt.indexes {
+		if v.Name == index {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w name: %v index: %v", ErrIndexNotDefined, rt.name, index)
+	}
+	if opts == nil {
+		opts = &RangeOptions{}
+	}
+	bounds := indexBounds(rt.indexPrefix(index), opts)
+	itOps := badger.DefaultIteratorOptions
+	itOps.Reverse = opts.Reverse
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	skip := opts.Skip
+	count := 0
+	var keyValue []byte
+	for it.Seek(bounds.seek()); it.Valid(); it.Next() {
+		indexItem := it.Item()
+		c := bounds.check(indexItem.Key())
+		if c < 0 {
+			continue
+		}
+		if c > 0 {
+			return nil
+		}
+		keyValue, err = indexItem.ValueCopy(keyValue[:0])
+		if err != nil {
+			return err
+		}
+		item, err := r.Get(joinKey(rt.prefix, keyValue))
+		if err == badger.ErrKeyNotFound {
+			// left behind by a record that is gone
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !opts.KeysOnly {
+			err = item.Value(func(val []byte) error {
+				return rt.decodeRecord(val, keyValue, record)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err = record.SetKey(keyValue)
+		if err != nil {
+			return err
+		}
+		if !opts.KeysOnly {
+			err = r.db.handle(OpRead, record, afterRead)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.Filter != nil && !opts.Filter(record) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if !cb(record) {
+			return nil
+		}
+		count++
+		if opts.Limit > 0 && count >= opts.Limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// indexBounds creates rangeBounds for an index where the keys in opts are encoded index values.
+// Each index key is an encoded value followed by a record key so bounds that include a value
+// must include every key starting with it and bounds that exclude a value must exclude them all
+func indexBounds(prefix []byte, opts *RangeOptions) *rangeBounds {
+	var start, end *rangeBound
+	if opts.Start != nil {
+		key := joinKey(prefix, opts.Start)
+		if opts.StartExclusive != opts.Reverse {
+			key = prefixEnd(key)
+		}
+		start = &rangeBound{key: key, inclusive: !opts.Reverse}
+	}
+	if opts.End != nil {
+		key := joinKey(prefix, opts.End)
+		if opts.EndInclusive != opts.Reverse {
+			key = prefixEnd(key)
+		}
+		end = &rangeBound{key: key, inclusive: opts.Reverse}
+	}
+	if opts.Reverse {
+		start, end = end, start
+	}
+	return newRangeBoundsFrom(joinKey(prefix, opts.Prefix), start, end, opts.Reverse)
+}
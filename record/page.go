@@ -0,0 +1,164 @@
+package record
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrInvalidCursor indicates a cursor passed to Page was not created by Page for the same record
+// type, direction and prefix, or has been altered
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrPageLimit indicates Page was called without a positive RangeOptions.Limit
+var ErrPageLimit = errors.New("Page requires RangeOptions.Limit greater than 0")
+
+const cursorVersion = 2
+const cursorFlagReverse = 1
+
+// cursorMACLength is the number of bytes of the HMAC kept in a cursor
+const cursorMACLength = 16
+
+// secretPrefix is the reserved prefix of the keys of secrets kept by a RecorderDB, record type
+// prefixes always start with a lowercase letter so can not collide with it
+var secretPrefix = []byte("_secrets\x00")
+
+// cursorSecretKey holds the secret cursors are signed with
+var cursorSecretKey = append(secretPrefix[:len(secretPrefix):len(secretPrefix)], "cursor"...)
+
+// pageRecords does the work of Page for both recorderDB and recorderTxn, secret signs cursors
+func pageRecords(
+	recorder Recorder,
+	secret []byte,
+	record Record,
+	opts *RangeOptions,
+	cursor string,
+	cb func(record Record) bool,
+) (string, error) {
+	if opts == nil || opts.Limit <= 0 {
+		return "", ErrPageLimit
+	}
+	name := record.Name()
+	pageOpts := *opts
+	if cursor != "" {
+		lastKey, err := decodeCursor(secret, name, opts.Reverse, opts.Prefix, cursor)
+		if err != nil {
+			return "", err
+		}
+		pageOpts.Start = lastKey
+		pageOpts.StartExclusive = true
+		pageOpts.Skip = 0
+	}
+	// one extra record is read to find out if there is another page
+	pageOpts.Limit = opts.Limit + 1
+	count := 0
+	more := false
+	var lastKey []byte
+	var keyErr error
+	err := recorder.RangeWith(record, &pageOpts, func(record Record) bool {
+		if count == opts.Limit {
+			more = true
+			return false
+		}
+		count++
+		lastKey, keyErr = record.Key()
+		if keyErr != nil {
+			return false
+		}
+		if !cb(record) {
+			more = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if keyErr != nil {
+		return "", keyErr
+	}
+	if !more {
+		return "", nil
+	}
+	return encodeCursor(secret, name, opts.Reverse, opts.Prefix, lastKey), nil
+}
+
+// encodeCursor creates a cursor of the form version, flags, record name, key, HMAC encoded with
+// url safe base64.  The HMAC also covers prefix so the cursor can only continue the same range
+func encodeCursor(secret []byte, name string, reverse bool, prefix []byte, key []byte) string {
+	data := make([]byte, 0, 2+len(name)+len(key)+cursorMACLength)
+	data = append(data, cursorVersion, 0)
+	if reverse {
+		data[1] |= cursorFlagReverse
+	}
+	data = append(data, name...)
+	data = append(data, key...)
+	return base64.RawURLEncoding.EncodeToString(append(data, cursorMAC(secret, data, prefix)...))
+}
+
+func decodeCursor(
+	secret []byte,
+	name string,
+	reverse bool,
+	prefix []byte,
+	cursor string,
+) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if len(data) < 2+len(name)+cursorMACLength || data[0] != cursorVersion {
+		return nil, ErrInvalidCursor
+	}
+	mac := data[len(data)-cursorMACLength:]
+	data = data[:len(data)-cursorMACLength]
+	if !hmac.Equal(mac, cursorMAC(secret, data, prefix)) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCursor)
+	}
+	if (data[1]&cursorFlagReverse != 0) != reverse {
+		return nil, fmt.Errorf("%w: direction does not match", ErrInvalidCursor)
+	}
+	if string(data[2:2+len(name)]) != name {
+		return nil, fmt.Errorf("%w name: %v", ErrInvalidCursor, string(data[2:2+len(name)]))
+	}
+	return data[2+len(name):], nil
+}
+
+// cursorMAC returns the truncated HMAC-SHA256 of data followed by the length of prefix and prefix
+func cursorMAC(secret []byte, data []byte, prefix []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	var length [binary.MaxVarintLen64]byte
+	mac.Write(length[:binary.PutUvarint(length[:], uint64(len(prefix)))])
+	mac.Write(prefix)
+	return mac.Sum(nil)[:cursorMACLength]
+}
+
+// loadCursorSecret returns the secret cursors are signed with, creating it the first time.  It is
+// kept in the store so cursors stay valid across restarts
+func loadCursorSecret(db *badger.DB) ([]byte, error) {
+	var secret []byte
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(cursorSecretKey)
+		if err == nil {
+			secret, err = item.ValueCopy(nil)
+			return err
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		return txn.Set(cursorSecretKey, secret)
+	})
+	return secret, err
+}
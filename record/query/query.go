@@ -0,0 +1,561 @@
+// Package query finds records by the values of fields in their JSON encoding
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blbgo/record/record"
+)
+
+// Op is a comparison operator used by Where
+type Op int
+
+// Comparison operators, values are compared the way they sort in an index, see
+// record.EncodeIndexValue.  Lt, Lte, Gt and Gte only match values of the same JSON type
+const (
+	Eq Op = iota
+	Ne
+	Lt
+	Lte
+	Gt
+	Gte
+	// Prefix matches strings starting with the provided string
+	Prefix
+)
+
+var opNames = []string{"=", "!=", "<", "<=", ">", ">=", "prefix"}
+
+func (r Op) String() string {
+	if r < 0 || int(r) >= len(opNames) {
+		return fmt.Sprintf("Op(%d)", int(r))
+	}
+	return opNames[r]
+}
+
+// Cond is a condition a record must meet to be returned by a Query
+type Cond interface {
+	fmt.Stringer
+
+	// Match reports if doc, a record decoded from JSON into an interface{}, meets the condition
+	Match(doc interface{}) bool
+}
+
+// Where creates a Cond comparing the field at path, see record.FieldValue, to value with op.  A
+// missing field only matches Ne
+func Where(path string, op Op, value interface{}) Cond {
+	c := &fieldCond{path: path, op: op, value: value}
+	if op == Prefix {
+		s, ok := value.(string)
+		if !ok {
+			c.err = fmt.Errorf("query: prefix value must be a string, path: %v", path)
+			return c
+		}
+		c.encoded = record.EncodeIndexPrefix(s)
+		return c
+	}
+	c.encoded, c.err = record.EncodeIndexValue(value)
+	return c
+}
+
+// And creates a Cond that matches when all conds match
+func And(conds ...Cond) Cond {
+	return andCond(conds)
+}
+
+// Or creates a Cond that matches when any of conds match
+func Or(conds ...Cond) Cond {
+	return orCond(conds)
+}
+
+type fieldCond struct {
+	path    string
+	op      Op
+	value   interface{}
+	encoded []byte
+	err     error
+}
+
+func (r *fieldCond) Match(doc interface{}) bool {
+	if r.err != nil {
+		return false
+	}
+	value, ok := record.FieldValue(doc, r.path)
+	if !ok {
+		return r.op == Ne
+	}
+	encoded, err := record.EncodeIndexValue(value)
+	if err != nil {
+		return r.op == Ne
+	}
+	switch r.op {
+	case Eq:
+		return bytes.Equal(encoded, r.encoded)
+	case Ne:
+		return !bytes.Equal(encoded, r.encoded)
+	case Prefix:
+		return bytes.HasPrefix(encoded, r.encoded)
+	}
+	if !sameType(encoded, r.encoded) {
+		return false
+	}
+	c := bytes.Compare(encoded, r.encoded)
+	switch r.op {
+	case Lt:
+		return c < 0
+	case Lte:
+		return c <= 0
+	case Gt:
+		return c > 0
+	case Gte:
+		return c >= 0
+	}
+	return false
+}
+
+func (r *fieldCond) String() string {
+	if r.value == nil {
+		return fmt.Sprintf("%v %v null", r.path, r.op)
+	}
+	data, _ := json.Marshal(r.value)
+	return fmt.Sprintf("%v %v %s", r.path, r.op, data)
+}
+
+type andCond []Cond
+
+func (r andCond) Match(doc interface{}) bool {
+	for _, v := range r {
+		if !v.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r andCond) String() string {
+	return joinConds(r, " AND ")
+}
+
+type orCond []Cond
+
+func (r orCond) Match(doc interface{}) bool {
+	for _, v := range r {
+		if v.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r orCond) String() string {
+	return joinConds(r, " OR ")
+}
+
+func joinConds(conds []Cond, sep string) string {
+	parts := make([]string, 0, len(conds))
+	for _, v := range conds {
+		parts = append(parts, v.String())
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// sameType reports if two encoded index values are the same JSON type, booleans use two tags
+func sameType(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	return typeOf(a[0]) == typeOf(b[0])
+}
+
+// typeOf returns the tag that stands for the type of an encoded value, both boolean tags give
+// record.IndexTagFalse
+func typeOf(tag byte) byte {
+	if tag == record.IndexTagTrue {
+		return record.IndexTagFalse
+	}
+	return tag
+}
+
+// Query finds records of one type that meet a set of conditions.  Create one with New
+type Query struct {
+	record    record.Record
+	conds     andCond
+	keyPrefix []byte
+	orderBy   string
+	desc      bool
+	ordered   bool
+	limit     int
+}
+
+// New creates a Query for records of the same type as rec, rec is used as the work area passed
+// to the call back of Run
+func New(rec record.Record) *Query {
+	return &Query{record: rec}
+}
+
+// Where adds a condition comparing the field at path to value, all conditions must match
+func (r *Query) Where(path string, op Op, value interface{}) *Query {
+	r.conds = append(r.conds, Where(path, op, value))
+	return r
+}
+
+// And adds conds as conditions that must all match
+func (r *Query) And(conds ...Cond) *Query {
+	r.conds = append(r.conds, conds...)
+	return r
+}
+
+// Or adds a condition that matches when any of conds match
+func (r *Query) Or(conds ...Cond) *Query {
+	r.conds = append(r.conds, Or(conds...))
+	return r
+}
+
+// KeyPrefix limits the query to records with keys starting with prefix
+func (r *Query) KeyPrefix(prefix []byte) *Query {
+	r.keyPrefix = prefix
+	return r
+}
+
+// OrderBy sorts the results by the field at path, records missing the field sort lowest.  Without
+// OrderBy results are in key order or the order of the index used
+func (r *Query) OrderBy(path string, desc bool) *Query {
+	r.orderBy = path
+	r.desc = desc
+	r.ordered = true
+	return r
+}
+
+// Limit sets the most records Run will provide, 0 means no limit
+func (r *Query) Limit(limit int) *Query {
+	r.limit = limit
+	return r
+}
+
+// Plan describes how a Query will be run, it is returned by Explain
+type Plan struct {
+	// Strategy is "index" when an index is used, "prefix" when only records with KeyPrefix are
+	// read, or "scan" when every record of the type is read
+	Strategy string
+
+	// Index is the name of the index used
+	Index string
+
+	// Bounds describes the part of the index or keys that is read
+	Bounds string
+
+	// Filter is the condition checked against each record read
+	Filter string
+
+	// SortInMemory is true when all matching records are collected and sorted before any are
+	// provided
+	SortInMemory bool
+
+	Limit int
+
+	opts *record.RangeOptions
+}
+
+func (r *Plan) String() string {
+	var b strings.Builder
+	b.WriteString(r.Strategy)
+	if r.Index != "" {
+		b.WriteString(" index: " + r.Index)
+	}
+	if r.Bounds != "" {
+		b.WriteString(" bounds: " + r.Bounds)
+	}
+	if r.Filter != "" {
+		b.WriteString(" filter: " + r.Filter)
+	}
+	if r.SortInMemory {
+		b.WriteString(" sort: memory")
+	}
+	if r.Limit > 0 {
+		fmt.Fprintf(&b, " limit: %v", r.Limit)
+	}
+	return b.String()
+}
+
+// Explain returns the Plan Run will use
+func (r *Query) Explain() *Plan {
+	plan := &Plan{
+		Strategy: "scan",
+		Limit:    r.limit,
+		opts:     &record.RangeOptions{Prefix: r.keyPrefix, Reverse: r.desc},
+	}
+	var filters []string
+	if len(r.conds) > 0 {
+		filters = append(filters, r.conds.String())
+	}
+	var indexes []record.Index
+	if indexer, ok := r.record.(record.Indexer); ok {
+		for _, v := range indexer.Indexes() {
+			// conditions can not be matched to computed values
+			if v.Extract == nil {
+				indexes = append(indexes, v)
+			}
+		}
+	}
+
+	// an index with an Eq condition is best, then the key prefix, then an index with range
+	// conditions, then an index that provides the requested order
+	index, opts, bounds, eq := r.chooseIndex(indexes)
+	switch {
+	case index != nil && (eq || len(r.keyPrefix) == 0):
+		plan.Strategy = "index"
+		plan.Index = index.Name
+		plan.Bounds = bounds
+		plan.opts = opts
+		if len(r.keyPrefix) > 0 {
+			filters = append(filters, fmt.Sprintf("key prefix %x", r.keyPrefix))
+		}
+	case len(r.keyPrefix) > 0:
+		plan.Strategy = "prefix"
+		plan.Bounds = fmt.Sprintf("key prefix %x", r.keyPrefix)
+	case r.ordered:
+		for i := range indexes {
+			if indexes[i].Path == r.orderBy {
+				plan.Strategy = "index"
+				plan.Index = indexes[i].Name
+				plan.opts = &record.RangeOptions{Reverse: r.desc}
+				break
+			}
+		}
+	}
+	plan.Filter = strings.Join(filters, " AND ")
+
+	if r.ordered {
+		indexOrdered := false
+		for i := range indexes {
+			if plan.Strategy == "index" &&
+				indexes[i].Name == plan.Index &&
+				indexes[i].Path == r.orderBy {
+				indexOrdered = true
+			}
+		}
+		plan.SortInMemory = !indexOrdered
+	}
+	if !plan.SortInMemory {
+		plan.opts.Limit = r.limit
+	}
+	return plan
+}
+
+// chooseIndex finds the best index for the top level conditions.  An index matching an Eq
+// condition is best, which is reported by the last return value, then one matching range
+// conditions
+func (r *Query) chooseIndex(
+	indexes []record.Index,
+) (*record.Index, *record.RangeOptions, string, bool) {
+	var rangeIndex *record.Index
+	for i := range indexes {
+		for _, v := range r.conds {
+			c, ok := v.(*fieldCond)
+			if !ok || c.err != nil || c.path != indexes[i].Path {
+				continue
+			}
+			if c.op == Eq {
+				opts := &record.RangeOptions{Prefix: c.encoded, Reverse: r.desc}
+				return &indexes[i], opts, c.String(), true
+			}
+			if c.op != Ne && rangeIndex == nil {
+				rangeIndex = &indexes[i]
+			}
+		}
+	}
+	if rangeIndex == nil {
+		return nil, nil, "", false
+	}
+	opts := &record.RangeOptions{Reverse: r.desc}
+	var lower, upper *fieldCond
+	var bounds []string
+	for _, v := range r.conds {
+		c, ok := v.(*fieldCond)
+		if !ok || c.err != nil || c.path != rangeIndex.Path {
+			continue
+		}
+		switch c.op {
+		case Prefix:
+			if opts.Prefix == nil {
+				opts.Prefix = c.encoded
+				bounds = append(bounds, c.String())
+			}
+		case Gt, Gte:
+			if lower == nil {
+				lower = c
+				bounds = append(bounds, c.String())
+			}
+		case Lt, Lte:
+			if upper == nil {
+				upper = c
+				bounds = append(bounds, c.String())
+			}
+		}
+	}
+	if opts.Prefix == nil {
+		// keep ranges of numbers and strings within their type the way conditions compare, the
+		// two boolean tags can not be covered by one prefix
+		bound := lower
+		if bound == nil {
+			bound = upper
+		}
+		if typeOf(bound.encoded[0]) != typeOf(record.IndexTagFalse) {
+			opts.Prefix = bound.encoded[:1]
+		}
+	}
+	if lower != nil {
+		if r.desc {
+			opts.End = lower.encoded
+			opts.EndInclusive = lower.op == Gte
+		} else {
+			opts.Start = lower.encoded
+			opts.StartExclusive = lower.op == Gt
+		}
+	}
+	if upper != nil {
+		if r.desc {
+			opts.Start = upper.encoded
+			opts.StartExclusive = upper.op == Lt
+		} else {
+			opts.End = upper.encoded
+			opts.EndInclusive = upper.op == Lte
+		}
+	}
+	return rangeIndex, opts, strings.Join(bounds, " AND "), false
+}
+
+// Run finds the records matching the query calling cb with each one until cb returns false.
+// recorder may be a RecorderDB or RecorderTxn
+func (r *Query) Run(recorder record.Recorder, cb func(rec record.Record) bool) error {
+	for _, v := range r.conds {
+		if c, ok := v.(*fieldCond); ok && c.err != nil {
+			return c.err
+		}
+	}
+	plan := r.Explain()
+	opts := plan.opts
+	var matchErr error
+	checkKey := plan.Strategy == "index" && len(r.keyPrefix) > 0
+	opts.Filter = func(rec record.Record) bool {
+		if checkKey {
+			key, err := rec.Key()
+			if err != nil {
+				matchErr = err
+				return false
+			}
+			if !bytes.HasPrefix(key, r.keyPrefix) {
+				return false
+			}
+		}
+		if len(r.conds) == 0 {
+			return true
+		}
+		doc, err := decode(rec)
+		if err != nil {
+			matchErr = err
+			return false
+		}
+		return r.conds.Match(doc)
+	}
+
+	var rangeCb func(rec record.Record) bool
+	var matches []*match
+	if plan.SortInMemory {
+		rangeCb = func(rec record.Record) bool {
+			m, err := newMatch(rec, r.orderBy)
+			if err != nil {
+				matchErr = err
+				return false
+			}
+			matches = append(matches, m)
+			return true
+		}
+	} else {
+		rangeCb = cb
+	}
+
+	var err error
+	if plan.Strategy == "index" {
+		err = recorder.RangeIndex(r.record, plan.Index, opts, rangeCb)
+	} else {
+		err = recorder.RangeWith(r.record, opts, rangeCb)
+	}
+	if err != nil {
+		return err
+	}
+	if matchErr != nil {
+		return matchErr
+	}
+	if !plan.SortInMemory {
+		return nil
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		c := bytes.Compare(matches[i].sortValue, matches[j].sortValue)
+		if r.desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	for i, m := range matches {
+		if r.limit > 0 && i >= r.limit {
+			return nil
+		}
+		err = json.Unmarshal(m.data, r.record.Record())
+		if err != nil {
+			return err
+		}
+		err = r.record.SetKey(m.key)
+		if err != nil {
+			return err
+		}
+		if !cb(r.record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// match is a record saved to be sorted in memory
+type match struct {
+	key       []byte
+	data      []byte
+	sortValue []byte
+}
+
+func newMatch(rec record.Record, orderBy string) (*match, error) {
+	key, err := rec.Key()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(rec.Record())
+	if err != nil {
+		return nil, err
+	}
+	m := &match{key: append([]byte{}, key...), data: data}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := record.FieldValue(doc, orderBy); ok {
+		// values that can not be encoded sort first like missing values
+		m.sortValue, _ = record.EncodeIndexValue(value)
+	}
+	return m, nil
+}
+
+// decode returns rec as it would be decoded from JSON into an interface{}
+func decode(rec record.Record) (interface{}, error) {
+	data, err := json.Marshal(rec.Record())
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
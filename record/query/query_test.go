@@ -0,0 +1,142 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blbgo/testing/assert"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+func (r *personRecord) Indexes() []record.Index {
+	return []record.Index{
+		{Name: "email", Path: "Email"},
+		{Name: "age", Path: "Age"},
+	}
+}
+
+type personRecord struct {
+	id string
+
+	FullName string
+	Age      int
+	Email    string
+	Address  struct {
+		City string
+	}
+}
+
+func (r *personRecord) Name() string {
+	return "per"
+}
+
+func (r *personRecord) Key() ([]byte, error) {
+	return []byte(r.id), nil
+}
+
+func (r *personRecord) SetKey(data []byte) error {
+	r.id = string(data)
+	return nil
+}
+
+func (r *personRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *personRecord) Record() interface{} {
+	return r
+}
+
+func createDB(a *assert.Assert) record.RecorderDB {
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := record.New(st, []record.Record{&personRecord{}})
+	a.NoError(err)
+
+	cities := []string{"Paris", "Rome", "Oslo"}
+	for i := 0; i < 30; i++ {
+		p := &personRecord{}
+		p.id = fmt.Sprintf("p%02d", i)
+		p.FullName = fmt.Sprintf("name %v", i)
+		p.Age = 20 + i
+		p.Email = fmt.Sprintf("user%v@example.com", i)
+		p.Address.City = cities[i%3]
+		a.NoError(db.Write(p))
+	}
+	return db
+}
+
+func names(a *assert.Assert, db record.RecorderDB, q *Query) string {
+	var result []string
+	err := q.Run(db, func(rec record.Record) bool {
+		result = append(result, rec.(*personRecord).id)
+		return true
+	})
+	a.NoError(err)
+	return strings.Join(result, ",")
+}
+
+func TestQuery(t *testing.T) {
+	a := assert.New(t)
+	db := createDB(a)
+
+	// secondary index with Eq
+	q := New(&personRecord{}).Where("Email", Eq, "user7@example.com")
+	a.Equal("index", q.Explain().Strategy)
+	a.Equal("email", q.Explain().Index)
+	a.Equal("p07", names(a, db, q))
+
+	// range on an index with a residual filter and index order
+	q = New(&personRecord{}).
+		Where("Age", Gte, 30).
+		Where("Age", Lt, 40).
+		Where("Address.City", Eq, "Rome").
+		OrderBy("Age", true)
+	plan := q.Explain()
+	a.Equal("age", plan.Index)
+	a.False(plan.SortInMemory)
+	a.Equal("p19,p16,p13,p10", names(a, db, q))
+
+	// key prefix
+	q = New(&personRecord{}).KeyPrefix([]byte("p2")).Where("Address.City", Eq, "Oslo")
+	a.Equal("prefix", q.Explain().Strategy)
+	a.Equal("p20,p23,p26,p29", names(a, db, q))
+
+	// scan with or, in memory sort and limit
+	q = New(&personRecord{}).
+		Or(Where("FullName", Eq, "name 3"), Where("FullName", Prefix, "name 2")).
+		OrderBy("FullName", true).
+		Limit(3)
+	plan = q.Explain()
+	a.Equal("scan", plan.Strategy)
+	a.True(plan.SortInMemory)
+	a.True(strings.Contains(plan.String(), "name 3"), plan.String())
+	a.Equal("p03,p29,p28", names(a, db, q))
+
+	// index maintained through changes and deletes
+	p := &personRecord{}
+	p.id = "p07"
+	a.NoError(db.Read(p))
+	p.Email = "changed@example.com"
+	a.NoError(db.Write(p))
+	a.Equal("", names(a, db, New(&personRecord{}).Where("Email", Eq, "user7@example.com")))
+	a.Equal("p07", names(a, db, New(&personRecord{}).Where("Email", Eq, "changed@example.com")))
+	a.NoError(db.Delete(p))
+	a.Equal("", names(a, db, New(&personRecord{}).Where("Email", Eq, "changed@example.com")))
+	a.Equal(record.ErrNeedsTransaction, unwrap(db.WriteBuffered(p)))
+}
+
+func unwrap(err error) error {
+	for {
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return err
+		}
+		err = u.Unwrap()
+	}
+}
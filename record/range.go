@@ -0,0 +1,211 @@
+package record
+
+import (
+	"bytes"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// RangeOptions controls which records Recorder.RangeWith provides to its call back function.  All
+// keys are record keys as returned by Record.Key(), without the record type prefix
+type RangeOptions struct {
+	// Prefix limits the range to keys starting with these bytes.  It may be as long as a full key
+	Prefix []byte
+
+	// Start is the key the range starts at, the highest key when Reverse is true.  If nil the
+	// range starts at the first (or last when Reverse) key matching Prefix
+	Start []byte
+
+	// StartExclusive causes a key equal to Start to be skipped
+	StartExclusive bool
+
+	// End is the key the range stops at, the lowest key when Reverse is true.  If nil the range
+	// continues to the last (or first when Reverse) key matching Prefix
+	End []byte
+
+	// EndInclusive causes a key equal to End to be included
+	EndInclusive bool
+
+	Reverse bool
+
+	// Skip is the number of matching records to pass over before the call back is called
+	Skip int
+
+	// Limit is the maximum number of times the call back will be called, 0 means no limit
+	Limit int
+
+	// KeysOnly causes only record.SetKey to be called, values are not read and record.Record()
+	// is left unchanged
+	KeysOnly bool
+
+	// Filter, if not nil, is called with each record before the call back.  Records it returns
+	// false for are not passed to the call back and do not count toward Skip or Limit
+	Filter func(record Record) bool
+}
+
+type rangeBound struct {
+	key       []byte
+	inclusive bool
+}
+
+// rangeBounds is the lowest and highest full key of a range
+type rangeBounds struct {
+	lower   rangeBound
+	upper   rangeBound
+	reverse bool
+}
+
+// newRangeBounds creates rangeBounds from the keys in opts, prefix is prepended to all of them
+func newRangeBounds(prefix []byte, opts *RangeOptions) *rangeBounds {
+	var start, end *rangeBound
+	if opts.Start != nil {
+		start = &rangeBound{key: joinKey(prefix, opts.Start), inclusive: !opts.StartExclusive}
+	}
+	if opts.End != nil {
+		end = &rangeBound{key: joinKey(prefix, opts.End), inclusive: opts.EndInclusive}
+	}
+	if opts.Reverse {
+		start, end = end, start
+	}
+	return newRangeBoundsFrom(joinKey(prefix, opts.Prefix), start, end, opts.Reverse)
+}
+
+// newRangeBoundsFrom creates rangeBounds covering all keys starting with fullPrefix narrowed by
+// lower and upper if they are not nil
+func newRangeBoundsFrom(fullPrefix []byte, lower, upper *rangeBound, reverse bool) *rangeBounds {
+	r := &rangeBounds{
+		lower:   rangeBound{key: fullPrefix, inclusive: true},
+		upper:   rangeBound{key: prefixEnd(fullPrefix)},
+		reverse: reverse,
+	}
+	if lower != nil && bytes.Compare(lower.key, r.lower.key) >= 0 {
+		r.lower = *lower
+	}
+	if upper != nil && bytes.Compare(upper.key, r.upper.key) <= 0 {
+		r.upper = *upper
+	}
+	return r
+}
+
+// seek returns the key an iterator should seek to
+func (r *rangeBounds) seek() []byte {
+	if r.reverse {
+		return r.upper.key
+	}
+	return r.lower.key
+}
+
+// check returns 0 if key is in the range, -1 if key has not reached the range yet and 1 if key is
+// past the end of the range
+func (r *rangeBounds) check(key []byte) int {
+	c := bytes.Compare(key, r.lower.key)
+	before := c < 0 || c == 0 && !r.lower.inclusive
+	c = bytes.Compare(key, r.upper.key)
+	after := c > 0 || c == 0 && !r.upper.inclusive
+	if r.reverse {
+		before, after = after, before
+	}
+	if before {
+		return -1
+	}
+	if after {
+		return 1
+	}
+	return 0
+}
+
+// rangeRecords does the work of RangeWith, prefix is the record type prefix.  decode sets
+// record.Record() from a stored value of the record at keyValue
+func (r *recorderTxn) rangeRecords(
+	prefix []byte,
+	record Record,
+	opts *RangeOptions,
+	decode func(val []byte, keyValue []byte, record Record) error,
+	cb func(record Record) bool,
+) error {
+	if opts == nil {
+		opts = &RangeOptions{}
+	}
+	bounds := newRangeBounds(prefix, opts)
+	itOps := badger.DefaultIteratorOptions
+	itOps.Reverse = opts.Reverse
+	itOps.PrefetchValues = !opts.KeysOnly
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	skip := opts.Skip
+	count := 0
+	for it.Seek(bounds.seek()); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		c := bounds.check(key)
+		if c < 0 {
+			continue
+		}
+		if c > 0 {
+			return nil
+		}
+		if !opts.KeysOnly {
+			err := item.Value(func(val []byte) error {
+				return decode(val, key[len(prefix):], record)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := record.SetKey(key[len(prefix):])
+		if err != nil {
+			return err
+		}
+		if !opts.KeysOnly {
+			err = r.db.handle(OpRead, record, afterRead)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.Filter != nil && !opts.Filter(record) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if !cb(record) {
+			return nil
+		}
+		count++
+		if opts.Limit > 0 && count >= opts.Limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// decodeRecord sets record.Record() from a stored value of the record of this type at keyValue
+func (r *recordType) decodeRecord(val []byte, keyValue []byte, record Record) error {
+	err := unmarshalValue(val, record.Record())
+	if err != nil {
+		return err
+	}
+	_, err = r.decryptFields(record, keyValue)
+	return err
+}
+
+// joinKey returns a new slice of prefix followed by key so prefix is never modified by append
+func joinKey(prefix []byte, key []byte) []byte {
+	fullKey := make([]byte, 0, len(prefix)+len(key))
+	fullKey = append(fullKey, prefix...)
+	return append(fullKey, key...)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, prefix is
+// expected to contain at least one byte that is not 0xff which all record type prefixes do
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return end
+}
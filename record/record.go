@@ -2,13 +2,16 @@
 package record
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 
+	"github.com/blbgo/general"
 	"github.com/blbgo/record/store"
 )
 
@@ -25,28 +28,153 @@ type Recorder interface {
 	Read(record Record) error
 
 	// Delete removes the record from the database with a key index matching the provided
-	// records key.  record.Record() will not be used or updated.
+	// records key.  record.Record() will not be used or updated.  Children of the record are
+	// deleted or restrict the delete as declared by Relater.  When a RecorderDB deletes more
+	// children than fit in one transaction they are deleted in chunks of transactions
 	Delete(record Record) error
 
 	// Range reads records starting at the key in the provided record until the call back function
-	// returns false or the last record of the provided type is read
+	// returns false or the last record of the provided type is read.  Only records with the same
+	// first prefixBytes of key as the provided record are read
 	Range(record Record, prefixBytes int, reverse bool, cb func(record Record) bool) error
+
+	// RangeWith reads records as specified by opts until the call back function returns false or
+	// the range is exhausted.  The provided record is used as a work area and is what is passed to
+	// the call back.  A nil opts reads all records of the provided type
+	RangeWith(record Record, opts *RangeOptions, cb func(record Record) bool) error
+
+	// RangeIndex works like RangeWith but reads records in the order of the named index.  The
+	// keys in opts are encoded index values as returned by EncodeIndexValue or EncodeIndexPrefix
+	RangeIndex(record Record, index string, opts *RangeOptions, cb func(record Record) bool) error
+
+	// Exists reports if a record with the key of the provided record exists without reading its
+	// value
+	Exists(record Record) (bool, error)
+
+	// Count returns the number of records of the provided type with keys starting with keyPrefix,
+	// only keys are read
+	Count(record Record, keyPrefix []byte) (int, error)
+
+	// Aggregate computes the count, sum, min and max of the numbers at path, see FieldValue, in
+	// records of the provided type with keys starting with keyPrefix.  Records without a number
+	// at path are ignored.  Records are read one at a time without using the provided record
+	Aggregate(record Record, keyPrefix []byte, path string) (*Aggregate, error)
+
+	// AggregateBy works like Aggregate but computes a separate Aggregate for each value at
+	// groupPath.  Groups are named by the JSON type of the value, a colon, then the string value
+	// or the JSON of other values, for example "string:Ann", "number:3" or "null:null".  Records
+	// without a value at groupPath are in the "" group
+	AggregateBy(
+		record Record,
+		keyPrefix []byte,
+		path string,
+		groupPath string,
+	) (map[string]*Aggregate, error)
+
+	// Page works like RangeWith but reads at most opts.Limit records starting after the record
+	// identified by cursor.  An empty cursor reads the first page.  The returned cursor is passed
+	// to the next call to read the next page, it is empty when there are no more records.
+	// Cursors are signed with a secret kept in the store and are only accepted for the same
+	// record type, direction and opts.Prefix
+	Page(
+		record Record,
+		opts *RangeOptions,
+		cursor string,
+		cb func(record Record) bool,
+	) (string, error)
 }
 
 // RecorderDB is an interface to a base database
 type RecorderDB interface {
 	Recorder
+	ConditionalRecorder
+	ExpiryRecorder
+	HistoryRecorder
+	TrashRecorder
+	TextSearcher
+	GeoSearcher
+	TypeAdmin
+	BlobStore
+	FieldEncryptor
+
+	// Modify reads record, calls fn to change it, then writes it all in one transaction.  If
+	// another write to the record causes a conflict the whole process is retried.  Any error
+	// returned by fn is returned without writing
+	Modify(record Record, fn func(record Record) error) error
 
 	// WriteBuffered works like Write except the record is queued to be written by a background
 	// worked thread.  This should allow several writes to be done under the same transaction for
 	// better efficiency.  Should only be used for non-critical writes like log messages.
 	WriteBuffered(record Record) error
 
+	// WriteBatch writes many records using a badger.WriteBatch which commits in as few
+	// transactions as possible, starting a new transaction whenever one becomes too big.  Records
+	// that can not be written are reported by a *BatchError, all other records are written
+	WriteBatch(records []Record) error
+
+	// BulkLoad fills an empty store with the records returned by next until it returns a nil
+	// Record.  Records must be returned in strictly increasing order of type name then key.  This
+	// is much faster than other ways of writting but ErrStoreNotEmpty is returned if the store
+	// has any data.  If an error is returned the records loaded before the error remain
+	BulkLoad(next func() (Record, error)) error
+
+	// Export writes every record of the named types, all types provided to New if none are
+	// named, to w as JSON Lines of ExportLine
+	Export(w io.Writer, types ...string) error
+
+	// Import writes the records in JSON Lines of ExportLine read from r, as written by Export.
+	// Records are written in batches of transactions so if an error is returned the batches
+	// before it remain.  Each line is decoded into a new record and written through middleware
+	// and the BeforeWrite and Validate hooks unless opts.SkipHooks is set.  A nil opts upserts in
+	// batches of 1000
+	Import(r io.Reader, opts *ImportOptions) (ImportResult, error)
+
 	DeletePrefix(record Record, keyPrefix []byte) error
 
+	// Sweep calls cb with each expired record of the types that implement ExpiryTracker and
+	// forgets them.  Records are forgotten after cb returns so if the process stops part way
+	// some may be provided again by the next Sweep.  The number of records found is returned
+	Sweep(cb func(event ExpiryEvent)) (int, error)
+
+	// StartSweeper calls Sweep every interval in a background goroutine until the returned
+	// function is called.  Errors are printed
+	StartSweeper(interval time.Duration, cb func(event ExpiryEvent)) func()
+
+	// Purge permanently deletes records of the provided type that were soft deleted more than
+	// olderThan ago.  It works in chunks of transactions and returns the number deleted
+	Purge(record Record, olderThan time.Duration) (int, error)
+
+	// FindOrphans calls cb with each child record, as declared by Relater, whose parent does not
+	// exist until cb returns false
+	FindOrphans(cb func(orphan Orphan) bool) error
+
 	GetSequence(record Record, key []byte) (store.Sequence, error)
 
 	NewTransaction(update bool) RecorderTxn
+
+	// Update runs fn in a new update transaction and commits it.  If the commit fails because of
+	// a conflict with another transaction fn is called again with a new transaction as allowed
+	// by the RetryPolicy.  If fn returns an error the transaction is discarded and the error
+	// returned.  fn should have no side effects other than changes made through the transaction,
+	// use RecorderTxn.OnCommit for anything that must wait for the commit
+	Update(ctx context.Context, fn func(txn RecorderTxn) error) error
+
+	// View runs fn in a new read only transaction which is always discarded
+	View(ctx context.Context, fn func(txn RecorderTxn) error) error
+
+	// Use adds middleware that wraps every write, read and delete of a single record by this
+	// RecorderDB and its transactions.  It should be called before the RecorderDB is used
+	Use(middleware ...Middleware)
+
+	// OnChange adds hook to be called in the transaction of every write and delete of a record,
+	// including cascade deletes and imports.  Writes made without a transaction by
+	// WriteBuffered, WriteBatch and BulkLoad are not seen.  It should be called before the
+	// RecorderDB is used
+	OnChange(hook ChangeHook)
+
+	// SetRetryPolicy changes how Update, Modify and the conditional writes retry conflicts.  It
+	// should be called before the RecorderDB is used
+	SetRetryPolicy(policy RetryPolicy)
 }
 
 // Record represents an individual record as well as the record type
@@ -83,6 +211,12 @@ var ErrRecordNameLenNot3 = errors.New(
 	"record.Config.Records() returned record with name not length 3 in bytes",
 )
 
+// ErrRecordNameNotLower a record with a name that is not all lowercase letters defined by
+// Config.Records()
+var ErrRecordNameNotLower = errors.New(
+	"record.Config.Records() returned record with name not all lowercase letters",
+)
+
 // ErrNotFound indicates the requested item was not found
 var ErrNotFound = errors.New("not found")
 
@@ -90,10 +224,41 @@ var ErrNotFound = errors.New("not found")
 // config
 var ErrRecordNotDefined = errors.New("Record type used that was not included in config")
 
+// ErrNeedsTransaction indicates a record type that maintains indexes was used with a method that
+// writes without a transaction like WriteBuffered, WriteBatch or BulkLoad
+var ErrNeedsTransaction = errors.New("record type can only be written in a transaction")
+
 type recorderDB struct {
 	*badger.DB
 	store.Store
-	recPrefixes map[string][]byte
+	types       map[string]*recordType
+	retryPolicy RetryPolicy
+	middleware  []Middleware
+	dropTokens  dropTokens
+	changeHooks []ChangeHook
+
+	// cursorSecret signs the cursors returned by Page
+	cursorSecret []byte
+}
+
+// recordType holds what is known about each record type provided to New
+type recordType struct {
+	name        string
+	prefix      []byte
+	indexes     []Index
+	relations   []Relation
+	trackExpiry bool
+	history     *HistoryRetention
+	text        *TextIndex
+	geo         *GeoIndex
+	compression *Compression
+	encrypted   []encryptedField
+
+	// keys is set by SetKeyProvider
+	keys KeyProvider
+
+	// record is the record provided to New, newRecord creates new records of its type
+	record Record
 }
 
 // New creates a RecorderDB
@@ -104,10 +269,10 @@ func New(store store.Store, records []Record) (RecorderDB, error) {
 	if len(records) == 0 {
 		return nil, ErrNoConfigRecords
 	}
-	recPrefixes := make(map[string][]byte, len(records))
+	types := make(map[string]*recordType, len(records))
 	for _, v := range records {
 		name := v.Name()
-		_, ok := recPrefixes[name]
+		_, ok := types[name]
 		if ok {
 			return nil, fmt.Errorf("%w name: %v", ErrDupRecordNames, name)
 		}
@@ -115,110 +280,121 @@ func New(store store.Store, records []Record) (RecorderDB, error) {
 		if len(nameBytes) != 3 {
 			return nil, fmt.Errorf("%w name: %v", ErrRecordNameLenNot3, name)
 		}
-		recPrefixes[name] = append(nameBytes, 0 /*string(0)[0]*/)
+		for _, b := range nameBytes {
+			if b < 'a' || b > 'z' {
+				return nil, fmt.Errorf("%w name: %v", ErrRecordNameNotLower, name)
+			}
+		}
+		prefix := append(nameBytes, 0 /*string(0)[0]*/)
+		rt := &recordType{
+			name:   name,
+			record: v,
+			// limit capacity so appending to a prefix never writes into the shared array
+			prefix: prefix[:4:4],
+		}
+		if indexer, ok := v.(Indexer); ok {
+			rt.indexes = indexer.Indexes()
+		}
+		if tracker, ok := v.(ExpiryTracker); ok {
+			rt.trackExpiry = tracker.TrackExpiry()
+		}
+		if textIndexer, ok := v.(TextIndexer); ok {
+			textIndex := textIndexer.TextIndex()
+			rt.text = &textIndex
+		}
+		if geoIndexer, ok := v.(GeoIndexer); ok {
+			geoIndex := geoIndexer.GeoIndex()
+			rt.geo = &geoIndex
+		}
+		if keeper, ok := v.(HistoryKeeper); ok {
+			retention := keeper.KeepHistory()
+			rt.history = &retention
+		}
+		if compressor, ok := v.(Compressor); ok {
+			compression := compressor.Compression()
+			if compression.Algorithm != CompressSnappy && compression.Algorithm != CompressZstd {
+				return nil, fmt.Errorf(
+					"%w name: %v algorithm: %v",
+					ErrInvalidCompression,
+					name,
+					compression.Algorithm,
+				)
+			}
+			if compression.MinSize <= 0 {
+				compression.MinSize = defaultCompressionMinSize
+			}
+			rt.compression = &compression
+		}
+		encrypted, err := findEncryptedFields(v)
+		if err != nil {
+			return nil, err
+		}
+		rt.encrypted = encrypted
+		types[name] = rt
+	}
+	err := setRelations(types, records)
+	if err != nil {
+		return nil, err
 	}
 
 	newItem := &recorderDB{
 		DB:          store.BadgerDB(),
 		Store:       store,
-		recPrefixes: recPrefixes,
+		types:       types,
+		retryPolicy: DefaultRetryPolicy,
+	}
+	err = newItem.register(records)
+	if err != nil {
+		return nil, err
+	}
+	newItem.cursorSecret, err = loadCursorSecret(newItem.DB)
+	if err != nil {
+		return nil, err
 	}
 
 	return newItem, nil
 }
 
 func (r *recorderDB) Write(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
-	if err != nil {
-		return err
-	}
-	data, err := json.Marshal(record.Record())
-	if err != nil {
-		return err
-	}
-	entry := badger.NewEntry(append(prefix, keyValue...), data)
-	ttl := record.TTL()
-	if ttl > 0 {
-		entry.WithTTL(ttl)
-	}
-	txn := r.DB.NewTransaction(true)
-	err = txn.SetEntry(entry)
-	if err != nil {
-		txn.Discard()
-		return err
-	}
-	return txn.Commit()
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.Write(record)
+	})
 }
 
 func (r *recorderDB) WriteBuffered(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
+	rt, err := r.recordType(record)
 	if err != nil {
 		return err
 	}
-	data, err := json.Marshal(record.Record())
+	if rt.needsTxn() {
+		return fmt.Errorf("%w name: %v", ErrNeedsTransaction, rt.name)
+	}
+	entry, err := r.prepareBatchEntry(rt, record)
 	if err != nil {
 		return err
 	}
-	entry := badger.NewEntry(append(prefix, keyValue...), data)
-	ttl := record.TTL()
-	if ttl > 0 {
-		entry.WithTTL(ttl)
-	}
 	r.Store.WriteBuffered(entry)
 	return nil
 }
 
 func (r *recorderDB) Read(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
-	if err != nil {
-		return err
-	}
-	txn := r.DB.NewTransaction(false)
+	txn := r.newTxn(false)
 	defer txn.Discard()
-	item, err := txn.Get(append(prefix, keyValue...))
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return ErrNotFound
-		}
-		return err
-	}
-	return item.Value(func(val []byte) error {
-		return json.Unmarshal(val, record.Record())
-	})
+	return txn.Read(record)
 }
 
 func (r *recorderDB) Delete(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
+	rt, err := r.recordType(record)
 	if err != nil {
 		return err
 	}
-	txn := r.DB.NewTransaction(true)
-	err = txn.Delete(append(prefix, keyValue...))
-	if err != nil {
-		txn.Discard()
-		return err
+	err = r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.Delete(record)
+	})
+	if err == badger.ErrTxnTooBig && len(rt.relations) > 0 {
+		return r.deleteChunked(rt, record)
 	}
-	return txn.Commit()
+	return err
 }
 
 func (r *recorderDB) Range(
@@ -227,67 +403,119 @@ func (r *recorderDB) Range(
 	reverse bool,
 	cb func(record Record) bool,
 ) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.Range(record, prefixBytes, reverse, cb)
+}
+
+func (r *recorderDB) RangeWith(
+	record Record,
+	opts *RangeOptions,
+	cb func(record Record) bool,
+) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.RangeWith(record, opts, cb)
+}
+
+func (r *recorderDB) Page(
+	record Record,
+	opts *RangeOptions,
+	cursor string,
+	cb func(record Record) bool,
+) (string, error) {
+	return pageRecords(r, r.cursorSecret, record, opts, cursor, cb)
+}
+
+func (r *recorderDB) RangeIndex(
+	record Record,
+	index string,
+	opts *RangeOptions,
+	cb func(record Record) bool,
+) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.RangeIndex(record, index, opts, cb)
+}
+
+// DeletePrefix drops all records of the provided type with keys starting with keyPrefix.  When
+// keyPrefix is empty the indexes, text index, geo index, expiry entries, history and trash of the
+// type are dropped as well.  When keyPrefix is not empty and the type has indexes, tracks expiry,
+// keeps history or has a text or geo index the records are deleted in chunks of transactions so
+// those stay consistent, change hooks are called for each
+func (r *recorderDB) DeletePrefix(record Record, keyPrefix []byte) error {
+	rt, err := r.recordType(record)
 	if err != nil {
 		return err
 	}
-	if prefixBytes >= len(keyValue) {
-		return errors.New("prefixBytes as long or longer than key bytes")
+	if len(keyPrefix) > 0 && rt.needsTxn() {
+		return r.deletePrefixChunked(rt, joinKey(rt.prefix, keyPrefix))
 	}
-	key := append(prefix, keyValue...)
-	if prefixBytes > 0 {
-		prefix = append(prefix, keyValue[:prefixBytes]...)
+	prefixes := [][]byte{joinKey(rt.prefix, keyPrefix)}
+	if len(keyPrefix) == 0 {
+		for _, v := range rt.indexes {
+			prefixes = append(prefixes, rt.indexPrefix(v.Name))
+		}
+		if rt.trackExpiry {
+			prefixes = append(prefixes, rt.expiryPrefix())
+		}
+		if rt.history != nil {
+			prefixes = append(prefixes, append(rt.prefix[:3:3], historyKeyMark))
+		}
+		if rt.text != nil {
+			prefixes = append(prefixes, rt.textPrefix())
+		}
+		if rt.geo != nil {
+			prefixes = append(prefixes, rt.geoPrefix())
+		}
+		prefixes = append(prefixes, rt.trashPrefix())
 	}
-	txn := r.DB.NewTransaction(false)
-	defer txn.Discard()
-	itOps := badger.DefaultIteratorOptions
-	itOps.Reverse = reverse
-	it := txn.NewIterator(itOps)
-	defer it.Close()
-	for it.Seek(key); it.ValidForPrefix(prefix); it.Next() {
-		item := it.Item()
-		err = item.Value(func(val []byte) error {
-			return json.Unmarshal(val, record.Record())
+	return r.DB.DropPrefix(prefixes...)
+}
+
+// deletePrefixChunked deletes the records of type rt with keys starting with prefix through
+// deleteKey, deleteChunkSize records in each transaction
+func (r *recorderDB) deletePrefixChunked(rt *recordType, prefix []byte) error {
+	for more := true; more; {
+		err := r.Update(context.Background(), func(txn RecorderTxn) error {
+			itOps := badger.DefaultIteratorOptions
+			itOps.Prefix = prefix
+			itOps.PrefetchValues = false
+			it := txn.(*recorderTxn).NewIterator(itOps)
+			var keys [][]byte
+			for it.Rewind(); it.Valid() && len(keys) < deleteChunkSize; it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			it.Close()
+			more = len(keys) >= deleteChunkSize
+			for _, key := range keys {
+				err := txn.(*recorderTxn).deleteKey(rt, key)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		})
 		if err != nil {
 			return err
 		}
-		err = record.SetKey(item.Key()[4:])
-		if err != nil {
-			return err
-		}
-		if !cb(record) {
-			return nil
-		}
 	}
 	return nil
 }
 
-func (r *recorderDB) DeletePrefix(record Record, keyPrefix []byte) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	return r.DB.DropPrefix(append(prefix, keyPrefix...))
-}
+// sequenceKeyMark follows the type name in the keys of the sequences of a record type
+const sequenceKeyMark = 's'
 
 func (r *recorderDB) GetSequence(record Record, key []byte) (store.Sequence, error) {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return nil, fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+	rt, err := r.recordType(record)
+	if err != nil {
+		return nil, err
 	}
 	seqPrefix := make([]byte, 4)
-	if copy(seqPrefix, prefix) != 4 {
+	if copy(seqPrefix, rt.prefix) != 4 {
 		return nil, errors.New("Failed to copy exactly 4 bytes of prefix for GetSequence")
 	}
-	seqPrefix[3] = 's'
+	seqPrefix[3] = sequenceKeyMark
 	sequence, err := r.Store.GetSequence(append(seqPrefix, key...))
 	if err != nil {
 		return nil, err
@@ -295,9 +523,79 @@ func (r *recorderDB) GetSequence(record Record, key []byte) (store.Sequence, err
 	return sequence, nil
 }
 
+// Close implements general.DelayCloser by closing the Store provided to New
+func (r *recorderDB) Close(doneChan chan<- error) {
+	if closer, ok := r.Store.(general.DelayCloser); ok {
+		closer.Close(doneChan)
+		return
+	}
+	go func() {
+		doneChan <- r.DB.Close()
+	}()
+}
+
 func (r *recorderDB) NewTransaction(update bool) RecorderTxn {
+	return r.newTxn(update)
+}
+
+func (r *recorderDB) newTxn(update bool) *recorderTxn {
 	return &recorderTxn{
-		Txn:         r.DB.NewTransaction(update),
-		recPrefixes: r.recPrefixes,
+		Txn: r.DB.NewTransaction(update),
+		db:  r,
+		ctx: context.Background(),
+	}
+}
+
+// recordType finds the recordType of record returning ErrRecordNotDefined if it was not provided
+// to New
+func (r *recorderDB) recordType(record Record) (*recordType, error) {
+	name := record.Name()
+	rt, ok := r.types[name]
+	if !ok {
+		return nil, fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+	}
+	return rt, nil
+}
+
+// needsTxn reports if records of this type must be written in a transaction because other keys
+// are maintained along with the record
+func (r *recordType) needsTxn() bool {
+	return len(r.indexes) > 0 || r.trackExpiry || r.history != nil || r.text != nil ||
+		r.geo != nil
+}
+
+// codec returns how values of the record type are encoded as recorded in the registry
+func (r *recordType) codec() string {
+	if r.compression != nil {
+		return "json+" + r.compression.Algorithm.String()
+	}
+	return "json"
+}
+
+// newRecord returns a new zero record of the type, records provided to New are pointers
+func (r *recordType) newRecord() Record {
+	return reflect.New(reflect.TypeOf(r.record).Elem()).Interface().(Record)
+}
+
+// newEntry creates the badger entry used to store record, the JSON encoded value with encrypted
+// fields is also returned before any compression
+func (r *recordType) newEntry(record Record) (*badger.Entry, []byte, error) {
+	keyValue, err := record.Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := r.marshal(record, keyValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := r.encodeValue(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := badger.NewEntry(joinKey(r.prefix, keyValue), value)
+	ttl := record.TTL()
+	if ttl > 0 {
+		entry.WithTTL(ttl)
 	}
+	return entry, data, nil
 }
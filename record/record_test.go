@@ -1,10 +1,21 @@
 package record
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/blbgo/general"
+	badger "github.com/dgraph-io/badger/v2"
 
 	"github.com/blbgo/record/store"
 	"github.com/blbgo/testing/assert"
@@ -88,3 +99,1408 @@ func TestSequence(t *testing.T) {
 	dc.Close(doneChan)
 	a.NoError(<-doneChan)
 }
+
+func TestRangeWith(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&testRecord{}})
+	a.NoError(err)
+
+	base := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		a.NoError(db.Write(&testRecord{KeyField: base.Add(time.Duration(i) * time.Second), Age: i}))
+	}
+
+	// bounded with exclusive start and inclusive end
+	var ages []int
+	tr := &testRecord{}
+	err = db.RangeWith(tr, &RangeOptions{
+		Start:          TimeToBytes(base.Add(2 * time.Second)),
+		StartExclusive: true,
+		End:            TimeToBytes(base.Add(5 * time.Second)),
+		EndInclusive:   true,
+	}, func(record Record) bool {
+		ages = append(ages, tr.Age)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[3 4 5]", fmt.Sprint(ages))
+
+	// reverse with skip, limit and filter
+	ages = nil
+	err = db.RangeWith(tr, &RangeOptions{
+		Reverse: true,
+		Skip:    1,
+		Limit:   2,
+		Filter:  func(record Record) bool { return record.(*testRecord).Age%2 == 0 },
+	}, func(record Record) bool {
+		ages = append(ages, tr.Age)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[6 4]", fmt.Sprint(ages))
+
+	// full key prefix and keys only
+	tr.Age = -1
+	count := 0
+	err = db.RangeWith(tr, &RangeOptions{
+		Prefix:   TimeToBytes(base.Add(7 * time.Second)),
+		KeysOnly: true,
+	}, func(record Record) bool {
+		a.Equal(base.Add(7*time.Second), tr.KeyField)
+		a.Equal(-1, tr.Age)
+		count++
+		return true
+	})
+	a.NoError(err)
+	a.Equal(1, count)
+
+	// same options in a transaction
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	count = 0
+	err = txn.RangeWith(tr, &RangeOptions{Limit: 4}, func(record Record) bool {
+		count++
+		return true
+	})
+	a.NoError(err)
+	a.Equal(4, count)
+}
+
+func TestPage(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	base := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		a.NoError(db.Write(&testRecord{KeyField: base.Add(time.Duration(i) * time.Second), Age: i}))
+	}
+
+	tr := &testRecord{}
+	opts := &RangeOptions{Limit: 2}
+	var ages []int
+	cursor := ""
+	pages := 0
+	for {
+		cursor, err = db.Page(tr, opts, cursor, func(record Record) bool {
+			ages = append(ages, tr.Age)
+			return true
+		})
+		a.NoError(err)
+		pages++
+		if cursor == "" {
+			break
+		}
+		if pages == 1 {
+			// a write after the first page does not disturb the following pages
+			a.NoError(db.Write(&testRecord{KeyField: base.Add(-time.Second), Age: -1}))
+		}
+	}
+	a.Equal(3, pages)
+	a.Equal("[0 1 2 3 4]", fmt.Sprint(ages))
+
+	cursor, err = db.Page(tr, opts, "", func(record Record) bool { return true })
+	a.NoError(err)
+	a.NotEqual("", cursor)
+
+	_, err = db.Page(&otherRecord{}, opts, cursor, func(record Record) bool { return true })
+	a.True(errors.Is(err, ErrInvalidCursor))
+
+	_, err = db.Page(tr, &RangeOptions{Limit: 2, Reverse: true}, cursor, func(record Record) bool {
+		return true
+	})
+	a.True(errors.Is(err, ErrInvalidCursor))
+
+	_, err = db.Page(tr, opts, cursor[:len(cursor)-2]+"AA", func(record Record) bool { return true })
+	a.True(errors.Is(err, ErrInvalidCursor))
+
+	// a cursor can not be used with a different prefix
+	prefixOpts := &RangeOptions{Limit: 2, Prefix: TimeToBytes(base)[:4]}
+	_, err = db.Page(tr, prefixOpts, cursor, func(record Record) bool { return true })
+	a.True(errors.Is(err, ErrInvalidCursor))
+
+	// the secret is kept in the store so cursors work after opening it again
+	db, err = New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+	_, err = db.Page(tr, opts, cursor, func(record Record) bool { return true })
+	a.NoError(err)
+}
+
+func TestWriteBatchAndBulkLoad(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	base := time.Unix(1000, 0)
+	next := 0
+	err = db.BulkLoad(func() (Record, error) {
+		if next == 3000 {
+			return nil, nil
+		}
+		next++
+		return &testRecord{KeyField: base.Add(time.Duration(next) * time.Second), Age: next}, nil
+	})
+	a.NoError(err)
+
+	count := 0
+	err = db.RangeWith(&testRecord{}, &RangeOptions{KeysOnly: true}, func(record Record) bool {
+		count++
+		return true
+	})
+	a.NoError(err)
+	a.Equal(3000, count)
+
+	tr := &testRecord{KeyField: base.Add(1500 * time.Second)}
+	a.NoError(db.Read(tr))
+	a.Equal(1500, tr.Age)
+
+	a.Equal(ErrStoreNotEmpty, db.BulkLoad(func() (Record, error) { return nil, nil }))
+
+	records := []Record{
+		&otherRecord{ID: "a", Value: "1"},
+		&badRecord{},
+		&otherRecord{ID: "b", Value: "2"},
+	}
+	err = db.WriteBatch(records)
+	batchErr, ok := err.(*BatchError)
+	a.True(ok)
+	a.Equal(1, len(batchErr.Errors))
+	a.True(errors.Is(batchErr.Errors[1], ErrRecordNotDefined))
+
+	or := &otherRecord{ID: "b"}
+	a.NoError(db.Read(or))
+	a.Equal("2", or.Value)
+
+	// an error that stops the batch keeps the errors of the records before it
+	err = batchErr.withErr(badger.ErrTxnTooBig)
+	a.True(errors.Is(err, badger.ErrTxnTooBig))
+	a.Equal(1, len(err.(*BatchError).Errors))
+	a.Equal(badger.ErrTxnTooBig, (&BatchError{}).withErr(badger.ErrTxnTooBig))
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&otherRecord{}})
+	a.NoError(err)
+
+	ids := []string{"a", "c", "b"}
+	err = db.BulkLoad(func() (Record, error) {
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return &otherRecord{ID: id}, nil
+	})
+	a.True(errors.Is(err, ErrUnsorted))
+
+	// store remains usable
+	a.NoError(db.Write(&otherRecord{ID: "d"}))
+	a.NoError(db.Read(&otherRecord{ID: "a"}))
+}
+
+func TestConditional(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&otherRecord{}})
+	a.NoError(err)
+
+	a.NoError(db.WriteIfAbsent(&otherRecord{ID: "a", Value: "first"}))
+	a.Equal(ErrAlreadyExists, db.WriteIfAbsent(&otherRecord{ID: "a", Value: "second"}))
+
+	or := &otherRecord{ID: "a"}
+	version, err := db.ReadVersion(or)
+	a.NoError(err)
+	a.Equal("first", or.Value)
+
+	or.Value = "third"
+	a.NoError(db.WriteIfVersion(or, version))
+	a.True(errors.Is(db.WriteIfVersion(or, version), ErrVersionMismatch))
+	a.True(errors.Is(db.WriteIfVersion(&otherRecord{ID: "b"}, 1), ErrVersionMismatch))
+	a.NoError(db.WriteIfVersion(&otherRecord{ID: "b"}, 0))
+
+	a.NoError(db.DeleteIfExists(&otherRecord{ID: "b"}))
+	a.Equal(ErrNotFound, db.DeleteIfExists(&otherRecord{ID: "b"}))
+
+	// concurrent Modify calls all succeed through conflict retries
+	a.NoError(db.Write(&otherRecord{ID: "count", Value: ""}))
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			done <- db.Modify(&otherRecord{ID: "count"}, func(record Record) error {
+				record.(*otherRecord).Value += "x"
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		a.NoError(<-done)
+	}
+	or = &otherRecord{ID: "count"}
+	a.NoError(db.Read(or))
+	a.Equal("xxxxx", or.Value)
+
+	a.Equal(ErrNotFound, db.Modify(&otherRecord{ID: "none"}, func(record Record) error {
+		return nil
+	}))
+}
+
+func TestUpdateAndView(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&otherRecord{}})
+	a.NoError(err)
+	db.SetRetryPolicy(RetryPolicy{MaxAttempts: 50, Backoff: time.Millisecond})
+
+	ctx := context.Background()
+	a.NoError(db.Write(&otherRecord{ID: "count"}))
+	var commits int32
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			done <- db.Update(ctx, func(txn RecorderTxn) error {
+				or := &otherRecord{ID: "count"}
+				err := txn.Read(or)
+				if err != nil {
+					return err
+				}
+				or.Value += "x"
+				txn.OnCommit(func() { atomic.AddInt32(&commits, 1) })
+				return txn.Write(or)
+			})
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		a.NoError(<-done)
+	}
+	a.Equal(int32(5), atomic.LoadInt32(&commits))
+
+	err = db.View(ctx, func(txn RecorderTxn) error {
+		or := &otherRecord{ID: "count"}
+		err := txn.Read(or)
+		a.Equal("xxxxx", or.Value)
+		return err
+	})
+	a.NoError(err)
+
+	// an error from fn discards the changes and skips OnCommit
+	called := false
+	testErr := errors.New("test")
+	err = db.Update(ctx, func(txn RecorderTxn) error {
+		txn.OnCommit(func() { called = true })
+		a.NoError(txn.Write(&otherRecord{ID: "discarded"}))
+		return testErr
+	})
+	a.Equal(testErr, err)
+	a.False(called)
+	a.Equal(ErrNotFound, db.Read(&otherRecord{ID: "discarded"}))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	a.Equal(context.Canceled, db.Update(canceled, func(txn RecorderTxn) error { return nil }))
+}
+
+func TestCountAndAggregate(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	base := time.Unix(1000, 0)
+	names := []string{"Ann", "Bob"}
+	for i := 1; i <= 10; i++ {
+		a.NoError(db.Write(&testRecord{
+			KeyField:  base.Add(time.Duration(i) * time.Second),
+			FirstName: names[i%2],
+			Age:       i,
+		}))
+	}
+	a.NoError(db.Write(&otherRecord{ID: "a"}))
+
+	exists, err := db.Exists(&testRecord{KeyField: base.Add(time.Second)})
+	a.NoError(err)
+	a.True(exists)
+	exists, err = db.Exists(&testRecord{KeyField: base})
+	a.NoError(err)
+	a.False(exists)
+
+	count, err := db.Count(&testRecord{}, nil)
+	a.NoError(err)
+	a.Equal(10, count)
+	count, err = db.Count(&otherRecord{}, []byte("b"))
+	a.NoError(err)
+	a.Equal(0, count)
+
+	agg, err := db.Aggregate(&testRecord{}, nil, "Age")
+	a.NoError(err)
+	a.Equal(10, agg.Count)
+	a.Equal(55.0, agg.Sum)
+	a.Equal(1.0, agg.Min)
+	a.Equal(10.0, agg.Max)
+	a.Equal(5.5, agg.Avg())
+
+	groups, err := db.AggregateBy(&testRecord{}, nil, "Age", "FirstName")
+	a.NoError(err)
+	a.Equal(2, len(groups))
+	a.Equal(30.0, groups["string:Ann"].Sum)
+	a.Equal(25.0, groups["string:Bob"].Sum)
+	a.Equal(9.0, groups["string:Bob"].Max)
+
+	groups, err = db.AggregateBy(&testRecord{}, nil, "Age", "Age")
+	a.NoError(err)
+	a.Equal(10, len(groups))
+	a.Equal(3.0, groups["number:3"].Sum)
+
+	// values of different types that encode the same are different groups
+	a.Equal("string:1", groupName(map[string]interface{}{"G": "1"}, "G"))
+	a.Equal("number:1", groupName(map[string]interface{}{"G": 1.0}, "G"))
+	a.Equal("string:true", groupName(map[string]interface{}{"G": "true"}, "G"))
+	a.Equal("boolean:true", groupName(map[string]interface{}{"G": true}, "G"))
+	a.Equal("", groupName(map[string]interface{}{}, "G"))
+}
+
+func TestTypeRegistry(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	db, err := New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+	for _, v := range []string{"a", "b", "c"} {
+		a.NoError(db.Write(&otherRecord{ID: v, Value: v}))
+	}
+
+	// open again without otherRecord, it stays in the registry
+	db, err = New(st, []Record{&testRecord{}})
+	a.NoError(err)
+	types, err := db.ListTypes()
+	a.NoError(err)
+	a.Equal(2, len(types))
+	a.Equal("oth", types[0].Name)
+	a.Equal("*record.otherRecord", types[0].GoType)
+	a.Equal("json", types[0].Codec)
+	a.False(types[0].Configured)
+	a.Equal("tre", types[1].Name)
+	a.True(types[1].Configured)
+
+	stats, err := db.TypeStats("oth")
+	a.NoError(err)
+	a.Equal(3, stats.Keys)
+	a.True(stats.Bytes > 0)
+
+	_, err = db.DropTypeToken("bad")
+	a.True(errors.Is(err, ErrTypeNotRegistered))
+	a.True(errors.Is(db.DropType("oth", "nope"), ErrInvalidDropToken))
+	token, err := db.DropTypeToken("oth")
+	a.NoError(err)
+	a.True(errors.Is(db.DropType("tre", token), ErrInvalidDropToken))
+	// a token can only be used once
+	a.True(errors.Is(db.DropType("oth", token), ErrInvalidDropToken))
+	// sequence keys are dropped with the type but not those of other types
+	a.NoError(db.(*recorderDB).DB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte("othsseq"), []byte{1})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("tresseq"), []byte{1})
+	}))
+	token, err = db.DropTypeToken("oth")
+	a.NoError(err)
+	a.NoError(db.DropType("oth", token))
+	a.NoError(db.(*recorderDB).DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("othsseq"))
+		a.Equal(badger.ErrKeyNotFound, err)
+		_, err = txn.Get([]byte("tresseq"))
+		return err
+	}))
+
+	stats, err = db.TypeStats("oth")
+	a.NoError(err)
+	a.Equal(0, stats.Keys)
+	types, err = db.ListTypes()
+	a.NoError(err)
+	a.Equal(1, len(types))
+	a.Equal("tre", types[0].Name)
+}
+
+func TestExportImport(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+	for _, v := range []string{"a", "b", "c"} {
+		a.NoError(db.Write(&otherRecord{ID: v, Value: v}))
+	}
+	a.NoError(db.Write(&testRecord{KeyField: time.Unix(1000, 0), FirstName: "Ann"}))
+
+	var buf bytes.Buffer
+	a.NoError(db.Export(&buf, "oth"))
+	a.Equal(3, strings.Count(buf.String(), "\n"))
+	exported := buf.String()
+
+	st2, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db2, err := New(st2, []Record{&testRecord{}, &otherRecord{}})
+	a.NoError(err)
+	a.NoError(db2.Write(&otherRecord{ID: "b", Value: "old"}))
+
+	result, err := db2.Import(strings.NewReader(exported), &ImportOptions{Mode: ImportFail})
+	a.True(errors.Is(err, ErrAlreadyExists))
+	a.Equal(0, result.Written)
+
+	result, err = db2.Import(
+		strings.NewReader(exported),
+		&ImportOptions{Mode: ImportSkip, BatchSize: 2},
+	)
+	a.NoError(err)
+	a.Equal(2, result.Written)
+	a.Equal(1, result.Skipped)
+	rec := &otherRecord{ID: "b"}
+	a.NoError(db2.Read(rec))
+	a.Equal("old", rec.Value)
+
+	result, err = db2.Import(strings.NewReader(exported), nil)
+	a.NoError(err)
+	a.Equal(3, result.Written)
+	a.NoError(db2.Read(rec))
+	a.Equal("b", rec.Value)
+
+	buf.Reset()
+	a.NoError(db.Export(&buf))
+	_, err = db2.Import(&buf, nil)
+	a.NoError(err)
+	tr := &testRecord{KeyField: time.Unix(1000, 0)}
+	a.NoError(db2.Read(tr))
+	a.Equal("Ann", tr.FirstName)
+
+	_, err = db2.Import(strings.NewReader(`{"type":"bad","key":"YQ==","value":{}}`), nil)
+	a.True(errors.Is(err, ErrInvalidImport))
+}
+
+func TestHooks(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&hookRecord{}})
+	a.NoError(err)
+
+	var ops []string
+	db.Use(func(next Handler) Handler {
+		return func(op Op, record Record) error {
+			ops = append(ops, fmt.Sprint(op, ":", record.(*hookRecord).ID))
+			return next(op, record)
+		}
+	})
+
+	a.NoError(db.Write(&hookRecord{ID: "a"}))
+	a.True(errors.Is(db.Write(&hookRecord{ID: "b", Value: "bad"}), errHookInvalid))
+	a.NoError(db.Write(&hookRecord{ID: "keep", Value: "x"}))
+
+	rec := &hookRecord{ID: "a"}
+	a.NoError(db.Read(rec))
+	a.Equal("default", rec.Value)
+	a.Equal("DEFAULT", rec.Derived)
+
+	var derived []string
+	err = db.RangeWith(&hookRecord{}, nil, func(record Record) bool {
+		derived = append(derived, record.(*hookRecord).Derived)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[DEFAULT X]", fmt.Sprint(derived))
+
+	a.True(errors.Is(db.Delete(&hookRecord{ID: "keep"}), errHookInvalid))
+	a.NoError(db.Delete(&hookRecord{ID: "a"}))
+	a.Equal(
+		"[0:a 0:b 0:keep 1:a 1:a 1:keep 2:keep 2:a]",
+		fmt.Sprint(ops),
+	)
+
+	// imported records go through the write hooks unless SkipHooks is set
+	lines := `{"type":"hok","key":"Yw==","value":{}}` + "\n" +
+		`{"type":"hok","key":"ZA==","value":{"Value":"bad"}}` + "\n"
+	_, err = db.Import(strings.NewReader(lines), nil)
+	a.True(errors.Is(err, errHookInvalid))
+	result, err := db.Import(strings.NewReader(lines), &ImportOptions{SkipHooks: true})
+	a.NoError(err)
+	a.Equal(2, result.Written)
+	rec = &hookRecord{ID: "d"}
+	a.NoError(db.Read(rec))
+	a.Equal("bad", rec.Value)
+	_, err = db.Import(strings.NewReader(lines[:strings.Index(lines, "\n")]), nil)
+	a.NoError(err)
+	rec = &hookRecord{ID: "c"}
+	a.NoError(db.Read(rec))
+	a.Equal("default", rec.Value)
+	a.Equal("[0:c 1:c]", fmt.Sprint(ops[len(ops)-2:]))
+}
+
+func TestRelations(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	_, err = New(st, []Record{&parentRecord{}, &childRecord{}})
+	a.True(errors.Is(err, ErrInvalidRelation))
+
+	db, err := New(st, []Record{&parentRecord{}, &childRecord{}, &otherRecord{}})
+	a.NoError(err)
+	for _, v := range []string{"p1", "p2", "p3"} {
+		a.NoError(db.Write(&parentRecord{ID: v}))
+	}
+	for _, v := range []string{"p1a", "p1b", "p2a", "p9a"} {
+		a.NoError(db.Write(&childRecord{ID: v}))
+	}
+	var children []Record
+	for i := 0; i < 2500; i++ {
+		children = append(children, &childRecord{ID: fmt.Sprintf("p3%04d", i)})
+	}
+	a.NoError(db.WriteBatch(children))
+	a.NoError(db.Write(&otherRecord{ID: "p2x"}))
+
+	a.NoError(db.Delete(&parentRecord{ID: "p1"}))
+	count, err := db.Count(&childRecord{}, []byte("p1"))
+	a.NoError(err)
+	a.Equal(0, count)
+
+	a.True(errors.Is(db.Delete(&parentRecord{ID: "p2"}), ErrRestricted))
+	exists, err := db.Exists(&childRecord{ID: "p2a"})
+	a.NoError(err)
+	a.True(exists)
+	err = db.(*recorderDB).deleteChunked(db.(*recorderDB).types["par"], &parentRecord{ID: "p2"})
+	a.True(errors.Is(err, ErrRestricted))
+
+	a.NoError(db.(*recorderDB).deleteChunked(db.(*recorderDB).types["par"], &parentRecord{ID: "p3"}))
+	count, err = db.Count(&childRecord{}, []byte("p3"))
+	a.NoError(err)
+	a.Equal(0, count)
+	exists, err = db.Exists(&parentRecord{ID: "p3"})
+	a.NoError(err)
+	a.False(exists)
+
+	var orphans []string
+	a.NoError(db.FindOrphans(func(orphan Orphan) bool {
+		orphans = append(orphans, orphan.Child+":"+string(orphan.Key))
+		return true
+	}))
+	a.Equal("[chi:p9a]", fmt.Sprint(orphans))
+
+	// children are matched by ParentKey not only by the key prefix of the parent
+	st2, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err = New(st2, []Record{&folderRecord{}, &childRecord{}, &otherRecord{}})
+	a.NoError(err)
+	a.NoError(db.Write(&folderRecord{ID: "ab"}))
+	a.NoError(db.Write(&folderRecord{ID: "abc"}))
+	a.NoError(db.Write(&childRecord{ID: "ab/x"}))
+	a.NoError(db.Write(&childRecord{ID: "abc/y"}))
+	a.NoError(db.Write(&otherRecord{ID: "abc/z"}))
+	a.NoError(db.Delete(&folderRecord{ID: "ab"}))
+	count, err = db.Count(&childRecord{}, nil)
+	a.NoError(err)
+	a.Equal(1, count)
+	exists, err = db.Exists(&childRecord{ID: "abc/y"})
+	a.NoError(err)
+	a.True(exists)
+	a.True(errors.Is(db.Delete(&folderRecord{ID: "abc"}), ErrRestricted))
+}
+
+func TestUnique(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&userRecord{}})
+	a.NoError(err)
+
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "a@x", Nick: "Ann"}))
+	err = db.Write(&userRecord{ID: "u2", Email: "a@x", Nick: "Bob"})
+	a.True(errors.Is(err, ErrUniqueViolation))
+	var violation *UniqueViolationError
+	a.True(errors.As(err, &violation))
+	a.Equal("email", violation.Index)
+	a.Equal("Email", violation.Field)
+	a.Equal("u1", string(violation.Key))
+
+	err = db.Write(&userRecord{ID: "u2", Email: "b@x", Nick: "ANN"})
+	a.True(errors.As(err, &violation))
+	a.Equal("nick", violation.Index)
+
+	// rewriting the same values is not a violation
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "a@x", Nick: "ann"}))
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "c@x", Nick: "Ann"}))
+	a.NoError(db.Write(&userRecord{ID: "u2", Email: "a@x", Nick: "Bob"}))
+	a.NoError(db.Delete(&userRecord{ID: "u2"}))
+	a.NoError(db.Write(&userRecord{ID: "u3", Email: "a@x", Nick: "bob"}))
+
+	encoded, err := EncodeIndexValue("a@x")
+	a.NoError(err)
+	var ids []string
+	err = db.RangeIndex(&userRecord{}, "email", nil, func(record Record) bool {
+		ids = append(ids, record.(*userRecord).ID)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[u3 u1]", fmt.Sprint(ids))
+	rec := &userRecord{}
+	err = db.RangeIndex(
+		rec,
+		"email",
+		&RangeOptions{Prefix: encoded},
+		func(record Record) bool { return false },
+	)
+	a.NoError(err)
+	a.Equal("u3", rec.ID)
+
+	// an entry left behind by a record that no longer exists does not block its value
+	rt := db.(*recorderDB).types["usr"]
+	encoded, err = EncodeIndexValue("d@x")
+	a.NoError(err)
+	a.NoError(db.(*recorderDB).DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(joinKey(rt.indexPrefix("email"), encoded), []byte("gone"))
+	}))
+	a.NoError(db.Write(&userRecord{ID: "u4", Email: "d@x", Nick: "Dan"}))
+	rec = &userRecord{}
+	err = db.RangeIndex(
+		rec,
+		"email",
+		&RangeOptions{Prefix: encoded},
+		func(record Record) bool { return false },
+	)
+	a.NoError(err)
+	a.Equal("u4", rec.ID)
+}
+
+func TestDeletePrefix(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&userRecord{}})
+	a.NoError(err)
+
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "a@x", Nick: "Ann"}))
+	a.NoError(db.Write(&userRecord{ID: "v1", Email: "b@x", Nick: "Bob"}))
+	a.NoError(db.DeletePrefix(&userRecord{}, []byte("u")))
+
+	// the index entries of the deleted record are gone so its values are free
+	a.NoError(db.Write(&userRecord{ID: "u2", Email: "a@x", Nick: "Ann"}))
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "c@x", Nick: "Cat"}))
+	var ids []string
+	err = db.RangeIndex(&userRecord{}, "email", nil, func(record Record) bool {
+		ids = append(ids, record.(*userRecord).ID)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[u2 v1 u1]", fmt.Sprint(ids))
+}
+
+func TestExpiry(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&sessionRecord{}})
+	a.NoError(err)
+
+	now := time.Now()
+	a.NoError(db.Write(&sessionRecord{ID: "s1", User: "ann"}))
+	meta, err := db.ReadMeta(&sessionRecord{ID: "s1"})
+	a.NoError(err)
+	a.True(meta.ExpiresAt.After(now.Add(59 * time.Minute)))
+	a.True(meta.Version > 0)
+
+	a.NoError(db.Touch(&sessionRecord{ID: "s1"}, 0))
+	meta, err = db.ReadMeta(&sessionRecord{ID: "s1"})
+	a.NoError(err)
+	a.True(meta.ExpiresAt.IsZero())
+	a.NoError(db.Touch(&sessionRecord{ID: "s1"}, 2*time.Hour))
+	meta, err = db.ReadMeta(&sessionRecord{ID: "s1"})
+	a.NoError(err)
+	a.True(meta.ExpiresAt.After(now.Add(119 * time.Minute)))
+	a.Equal(ErrNotFound, db.Touch(&sessionRecord{ID: "none"}, time.Hour))
+
+	deadline := now.Add(3 * time.Hour).Truncate(time.Second)
+	a.NoError(db.WriteWithExpiry(&sessionRecord{ID: "s2", User: "bob"}, deadline))
+	meta, err = db.ReadMeta(&sessionRecord{ID: "s2"})
+	a.NoError(err)
+	a.True(meta.ExpiresAt.Equal(deadline))
+
+	// already expired so only Sweep can see it
+	a.NoError(db.WriteWithExpiry(&sessionRecord{ID: "s3", User: "cat"}, now.Add(-time.Second)))
+	a.Equal(ErrNotFound, db.Read(&sessionRecord{ID: "s3"}))
+	a.NoError(db.Delete(&sessionRecord{ID: "s2"}))
+
+	var events []string
+	count, err := db.Sweep(func(event ExpiryEvent) {
+		events = append(events, string(event.Key)+":"+event.Record.(*sessionRecord).User)
+	})
+	a.NoError(err)
+	a.Equal(1, count)
+	a.Equal("[s3:cat]", fmt.Sprint(events))
+	count, err = db.Sweep(func(event ExpiryEvent) {})
+	a.NoError(err)
+	a.Equal(0, count)
+
+	var swept int32
+	stop := db.StartSweeper(10*time.Millisecond, func(event ExpiryEvent) {
+		atomic.AddInt32(&swept, 1)
+	})
+	a.NoError(db.WriteWithExpiry(&sessionRecord{ID: "s4"}, now.Add(-time.Second)))
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	a.Equal(int32(1), atomic.LoadInt32(&swept))
+}
+
+func TestHistory(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&docRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	a.True(errors.Is(db.History(&otherRecord{ID: "a"}, nil), ErrHistoryNotKept))
+	a.NoError(db.Delete(&docRecord{ID: "d"}))
+
+	var versions []uint64
+	var times []time.Time
+	for _, v := range []string{"one", "two", "three", "four"} {
+		a.NoError(db.Write(&docRecord{ID: "d", Text: v}))
+		version, err := db.ReadVersion(&docRecord{ID: "d"})
+		a.NoError(err)
+		versions = append(versions, version)
+		times = append(times, time.Now())
+	}
+	// the same value again is not new history
+	a.NoError(db.Write(&docRecord{ID: "d", Text: "four"}))
+	a.NoError(db.Write(&docRecord{ID: "dd", Text: "other"}))
+
+	history := func() string {
+		var texts []string
+		err := db.History(&docRecord{ID: "d"}, func(record Record, entry HistoryEntry) bool {
+			if entry.Deleted {
+				texts = append(texts, "deleted")
+			} else {
+				texts = append(texts, record.(*docRecord).Text)
+			}
+			return true
+		})
+		a.NoError(err)
+		return fmt.Sprint(texts)
+	}
+	a.Equal("[four three two]", history())
+
+	rec := &docRecord{ID: "d"}
+	entry, err := db.ReadAsOf(rec, AsOf{Version: versions[1]})
+	a.NoError(err)
+	a.Equal("two", rec.Text)
+	a.Equal(versions[1], entry.Version)
+	_, err = db.ReadAsOf(rec, AsOf{Time: times[2]})
+	a.NoError(err)
+	a.Equal("three", rec.Text)
+	_, err = db.ReadAsOf(rec, AsOf{Version: versions[0]})
+	a.Equal(ErrNotFound, err)
+
+	a.NoError(db.Delete(&docRecord{ID: "d"}))
+	a.Equal("[deleted four three]", history())
+	_, err = db.ReadAsOf(rec, AsOf{Time: time.Now()})
+	a.Equal(ErrNotFound, err)
+	_, err = db.ReadAsOf(rec, AsOf{Version: versions[3]})
+	a.NoError(err)
+	a.Equal("four", rec.Text)
+
+	// MaxAge only starts when a value is replaced so the newest value is always kept
+	db.(*recorderDB).types["doc"].history.MaxAge = 100 * time.Millisecond
+	a.NoError(db.Write(&docRecord{ID: "d", Text: "five"}))
+	time.Sleep(150 * time.Millisecond)
+	a.Equal("[five]", history())
+	a.NoError(db.Write(&docRecord{ID: "d", Text: "six"}))
+	a.Equal("[six five]", history())
+	_, err = db.ReadAsOf(rec, AsOf{Version: versions[3]})
+	a.Equal(ErrNotFound, err)
+}
+
+func TestSoftDelete(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&userRecord{}})
+	a.NoError(err)
+
+	a.NoError(db.Write(&userRecord{ID: "u1", Email: "a@x", Nick: "one"}))
+	a.NoError(db.Write(&userRecord{ID: "u2", Email: "b@x", Nick: "two"}))
+	a.Equal(ErrNotFound, db.SoftDelete(&userRecord{ID: "none"}))
+	a.NoError(db.SoftDelete(&userRecord{ID: "u1"}))
+
+	a.Equal(ErrNotFound, db.Read(&userRecord{ID: "u1"}))
+	count, err := db.Count(&userRecord{}, nil)
+	a.NoError(err)
+	a.Equal(1, count)
+	// the unique email is free while the record is in the trash
+	a.NoError(db.Write(&userRecord{ID: "u3", Email: "a@x", Nick: "three"}))
+
+	var deleted []string
+	err = db.RangeDeleted(&userRecord{}, nil, func(record Record, deletedAt time.Time) bool {
+		rec := record.(*userRecord)
+		a.False(deletedAt.IsZero())
+		deleted = append(deleted, rec.ID+":"+rec.Email)
+		return true
+	})
+	a.NoError(err)
+	a.Equal("[u1:a@x]", fmt.Sprint(deleted))
+
+	rec := &userRecord{ID: "u1"}
+	a.True(errors.Is(db.Undelete(rec), ErrUniqueViolation))
+	a.NoError(db.Delete(&userRecord{ID: "u3"}))
+	a.NoError(db.Undelete(rec))
+	a.Equal("a@x", rec.Email)
+	a.NoError(db.Read(&userRecord{ID: "u1"}))
+	a.Equal(ErrNotFound, db.Undelete(&userRecord{ID: "u1"}))
+
+	a.NoError(db.SoftDelete(&userRecord{ID: "u1"}))
+	a.NoError(db.SoftDelete(&userRecord{ID: "u2"}))
+	purged, err := db.Purge(&userRecord{}, time.Hour)
+	a.NoError(err)
+	a.Equal(0, purged)
+	purged, err = db.Purge(&userRecord{}, 0)
+	a.NoError(err)
+	a.Equal(2, purged)
+	a.Equal(ErrNotFound, db.Undelete(&userRecord{ID: "u2"}))
+}
+
+func TestSearch(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&articleRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	_, err = db.Search(&otherRecord{}, "x", 0)
+	a.True(errors.Is(err, ErrIndexNotDefined))
+
+	a.NoError(db.Write(&articleRecord{
+		ID:    "a1",
+		Title: "Running badger databases",
+		Body:  "Badger is a fast key value store. Databases need care.",
+		Tags:  []string{"storage"},
+	}))
+	a.NoError(db.Write(&articleRecord{
+		ID:    "a2",
+		Title: "Key value stores",
+		Body:  "A value store keeps values by key.",
+	}))
+	a.NoError(db.Write(&articleRecord{
+		ID:    "a3",
+		Title: "Gardening",
+		Body:  "Badgers dig in the garden at night.",
+		Tags:  []string{"animals", "garden"},
+	}))
+
+	keys := func(query string) string {
+		results, err := db.Search(&articleRecord{}, query, 0)
+		a.NoError(err)
+		var ids []string
+		for _, v := range results {
+			ids = append(ids, string(v.Key))
+		}
+		return fmt.Sprint(ids)
+	}
+	a.Equal("[a1 a3]", keys("badger"))
+	a.Equal("[a1]", keys("badger database"))
+	a.Equal("[a2 a1]", keys(`"value store"`))
+	a.Equal("[]", keys(`"store value"`))
+	a.Equal("[a3]", keys("gard* OR the"))
+	a.Equal("[a1 a3]", keys("the badger"))
+	// a clause without matches leaves none whatever its place
+	a.Equal("[]", keys("zzzz badger"))
+	a.Equal("[]", keys("badger zzzz"))
+	a.Equal("[]", keys(`"zz yy" badger`))
+	a.Equal("[a3]", keys("animal"))
+	// phrases do not span separate values
+	a.Equal("[]", keys(`"storage animals"`))
+
+	a.NoError(db.Write(&articleRecord{ID: "a3", Title: "Gardening", Body: "Moles dig."}))
+	a.Equal("[a1]", keys("badger"))
+	a.NoError(db.Delete(&articleRecord{ID: "a1"}))
+	a.Equal("[]", keys("badger"))
+
+	results, err := db.Search(&articleRecord{}, "value", 1)
+	a.NoError(err)
+	a.Equal(1, len(results))
+	a.True(results[0].Score > 0)
+}
+
+func TestGeo(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&placeRecord{}, &otherRecord{}})
+	a.NoError(err)
+
+	err = db.RangeWithin(&otherRecord{}, GeoBox{}, func(record Record) bool { return true })
+	a.True(errors.Is(err, ErrIndexNotDefined))
+
+	// a synthetic grid every half degree around the 180 degree meridian plus random points
+	rnd := rand.New(rand.NewSource(1))
+	var points []GeoPoint
+	for lat := -10.0; lat <= 10; lat += 0.5 {
+		for lng := 170.0; lng <= 190; lng += 0.5 {
+			if lng > 180 {
+				points = append(points, GeoPoint{Lat: lat, Lng: lng - 360})
+			} else {
+				points = append(points, GeoPoint{Lat: lat, Lng: lng})
+			}
+		}
+	}
+	for i := 0; i < 500; i++ {
+		points = append(points, GeoPoint{Lat: rnd.Float64()*180 - 90, Lng: rnd.Float64()*360 - 180})
+	}
+	a.NoError(db.Update(context.Background(), func(txn RecorderTxn) error {
+		for i, p := range points {
+			place := &placeRecord{ID: fmt.Sprintf("p%04d", i)}
+			place.Location.Lat = p.Lat
+			place.Location.Lng = p.Lng
+			err := txn.Write(place)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	near := func(center GeoPoint, radius float64) string {
+		var ids []string
+		last := 0.0
+		err := db.RangeNear(&placeRecord{}, center, radius, func(record Record, distance float64) bool {
+			a.True(distance >= last)
+			last = distance
+			ids = append(ids, record.(*placeRecord).ID)
+			return true
+		})
+		a.NoError(err)
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+	within := func(box GeoBox) string {
+		var ids []string
+		err := db.RangeWithin(&placeRecord{}, box, func(record Record) bool {
+			ids = append(ids, record.(*placeRecord).ID)
+			return true
+		})
+		a.NoError(err)
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+	bruteForce := func(match func(p GeoPoint) bool) string {
+		var ids []string
+		for i, p := range points {
+			if match(p) {
+				ids = append(ids, fmt.Sprintf("p%04d", i))
+			}
+		}
+		return fmt.Sprint(ids)
+	}
+
+	for _, center := range []GeoPoint{{0, 180}, {0, -179.5}, {5.25, 175}, {89, 0}, {-45, 10}} {
+		for _, radius := range []float64{1000, 60000, 250000, 2000000} {
+			a.Equal(
+				bruteForce(func(p GeoPoint) bool { return Distance(center, p) <= radius }),
+				near(center, radius),
+			)
+		}
+	}
+	boxes := []GeoBox{
+		{Min: GeoPoint{-1, 179}, Max: GeoPoint{1, -179}},
+		{Min: GeoPoint{-10, 170}, Max: GeoPoint{10, 175}},
+		{Min: GeoPoint{2.2, 171.3}, Max: GeoPoint{2.6, 171.6}},
+		{Min: GeoPoint{-90, -180}, Max: GeoPoint{90, 180}},
+		{Min: GeoPoint{30, -20}, Max: GeoPoint{60, 40}},
+	}
+	for _, box := range boxes {
+		a.Equal(bruteForce(box.Contains), within(box))
+	}
+	for i := 0; i < 20; i++ {
+		center := GeoPoint{Lat: rnd.Float64()*180 - 90, Lng: rnd.Float64()*360 - 180}
+		radius := rnd.Float64() * 3000000
+		a.Equal(
+			bruteForce(func(p GeoPoint) bool { return Distance(center, p) <= radius }),
+			near(center, radius),
+		)
+	}
+
+	// moving and deleting records updates the index
+	moved := &placeRecord{ID: "p0000"}
+	moved.Location.Lat = 50
+	moved.Location.Lng = 50
+	a.NoError(db.Write(moved))
+	a.NoError(db.Delete(&placeRecord{ID: "p0001"}))
+	a.Equal("[]", within(GeoBox{Min: GeoPoint{-10, 170}, Max: GeoPoint{-10, 170.5}}))
+	a.Equal("[p0000]", near(GeoPoint{50, 50}, 10))
+
+	count := 0
+	center := GeoPoint{0, 180}
+	a.NoError(db.RangeNear(&placeRecord{}, center, 500000, func(record Record, distance float64) bool {
+		count++
+		return count < 3
+	}))
+	a.Equal(3, count)
+}
+
+func TestBlobs(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db, err := New(st, []Record{&attachmentRecord{}})
+	a.NoError(err)
+
+	putBlob := func(id string, data []byte) {
+		w, err := db.PutBlob(id)
+		a.NoError(err)
+		// odd sized writes so chunks fill across writes
+		for len(data) > 0 {
+			n := 7777
+			if n > len(data) {
+				n = len(data)
+			}
+			written, err := w.Write(data[:n])
+			a.NoError(err)
+			a.Equal(n, written)
+			data = data[n:]
+		}
+		a.NoError(w.Close())
+	}
+	readBlob := func(id string) ([]byte, error) {
+		r, err := db.OpenBlob(id)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	data := make([]byte, blobChunkSize*2+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	putBlob("one", data)
+
+	read, err := readBlob("one")
+	a.NoError(err)
+	a.True(bytes.Equal(data, read))
+
+	info, err := db.BlobInfo("one")
+	a.NoError(err)
+	a.Equal(int64(len(data)), info.Size)
+	a.Equal(3, info.Chunks)
+	a.Equal(64, len(info.Checksum))
+
+	// seek across a chunk boundary
+	r, err := db.OpenBlob("one")
+	a.NoError(err)
+	pos, err := r.Seek(blobChunkSize-5, io.SeekStart)
+	a.NoError(err)
+	a.Equal(int64(blobChunkSize-5), pos)
+	part := make([]byte, 10)
+	_, err = io.ReadFull(r, part)
+	a.NoError(err)
+	a.True(bytes.Equal(data[blobChunkSize-5:blobChunkSize+5], part))
+	pos, err = r.Seek(-10, io.SeekEnd)
+	a.NoError(err)
+	a.Equal(int64(len(data)-10), pos)
+	_, err = io.ReadFull(r, part)
+	a.NoError(err)
+	a.True(bytes.Equal(data[len(data)-10:], part))
+	_, err = r.Read(part)
+	a.Equal(io.EOF, err)
+
+	// a reader opened before a replace keeps reading the old blob
+	r2, err := db.OpenBlob("one")
+	a.NoError(err)
+	putBlob("one", []byte("replaced"))
+	read, err = io.ReadAll(r2)
+	a.NoError(err)
+	a.True(bytes.Equal(data, read))
+	a.NoError(r2.Close())
+	a.NoError(r.Close())
+	read, err = readBlob("one")
+	a.NoError(err)
+	a.Equal("replaced", string(read))
+
+	_, err = readBlob("missing")
+	a.True(errors.Is(err, ErrNotFound))
+	a.True(errors.Is(db.DeleteBlob("missing"), ErrNotFound))
+
+	// one is unreferenced, two is referenced and the unclosed upload is abandoned
+	putBlob("two", []byte("two"))
+	a.NoError(db.Write(&attachmentRecord{ID: "a", Blob: "two"}))
+	a.NoError(db.Write(&attachmentRecord{ID: "b"}))
+	w, err := db.PutBlob("three")
+	a.NoError(err)
+	_, err = w.Write(make([]byte, blobChunkSize+1))
+	a.NoError(err)
+
+	count, err := db.CollectBlobs(time.Hour)
+	a.NoError(err)
+	a.Equal(0, count)
+	count, err = db.CollectBlobs(0)
+	a.NoError(err)
+	a.Equal(2, count)
+	_, err = db.BlobInfo("one")
+	a.True(errors.Is(err, ErrNotFound))
+	read, err = readBlob("two")
+	a.NoError(err)
+	a.Equal("two", string(read))
+	chunks := 0
+	a.NoError(db.(*recorderDB).DB.View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.Prefix = blobChunkPrefix
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			chunks++
+		}
+		return nil
+	}))
+	a.Equal(1, chunks)
+
+	// a corrupt chunk fails the checksum
+	a.NoError(db.(*recorderDB).DB.Update(func(txn *badger.Txn) error {
+		manifest, err := readBlobManifest(txn, "two")
+		if err != nil {
+			return err
+		}
+		return txn.Set(blobChunkKey(manifest.Upload, 0), []byte("tw0"))
+	}))
+	_, err = readBlob("two")
+	a.True(errors.Is(err, ErrInvalidBlob))
+
+	// a blob replaced after CollectBlobs scanned it is kept and not counted
+	putBlob("four", []byte("old"))
+	var scanned blobManifest
+	a.NoError(db.(*recorderDB).DB.View(func(txn *badger.Txn) error {
+		scanned, err = readBlobManifest(txn, "four")
+		return err
+	}))
+	putBlob("four", []byte("new"))
+	deleted, err := db.(*recorderDB).deleteUnreferencedBlob("four", scanned)
+	a.NoError(err)
+	a.False(deleted)
+	read, err = readBlob("four")
+	a.NoError(err)
+	a.Equal("new", string(read))
+	a.NoError(db.DeleteBlob("four"))
+	deleted, err = db.(*recorderDB).deleteUnreferencedBlob("four", scanned)
+	a.NoError(err)
+	a.False(deleted)
+}
+
+func TestCompression(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	_, err = New(st, []Record{&compressedRecord{algorithm: 9}})
+	a.True(errors.Is(err, ErrInvalidCompression))
+
+	long := strings.Repeat("compressible ", 100)
+	db, err := New(st, []Record{&otherRecord{}})
+	a.NoError(err)
+	a.NoError(db.Write(&otherRecord{ID: "a", Value: long + "a"}))
+
+	// values written before and with each algorithm are all read, short values are not compressed
+	db, err = New(st, []Record{&compressedRecord{algorithm: CompressSnappy}})
+	a.NoError(err)
+	a.NoError(db.Write(&otherRecord{ID: "b", Value: long + "b"}))
+	db, err = New(st, []Record{&compressedRecord{algorithm: CompressZstd}})
+	a.NoError(err)
+	a.NoError(db.Write(&otherRecord{ID: "c", Value: long + "c"}))
+	a.NoError(db.Write(&otherRecord{ID: "d", Value: "d"}))
+	for _, v := range []string{"a", "b", "c"} {
+		record := &otherRecord{ID: v}
+		a.NoError(db.Read(record))
+		a.Equal(long+v, record.Value)
+	}
+	var values []string
+	a.NoError(db.RangeWith(&otherRecord{}, nil, func(record Record) bool {
+		value := record.(*otherRecord).Value
+		values = append(values, value[len(value)-1:])
+		return true
+	}))
+	a.Equal("[a b c d]", fmt.Sprint(values))
+
+	types, err := db.ListTypes()
+	a.NoError(err)
+	a.Equal("json+zstd", types[0].Codec)
+	stats, err := db.TypeStats("oth")
+	a.NoError(err)
+	a.Equal(4, stats.Keys)
+	a.Equal(2, stats.CompressedKeys)
+	a.True(stats.RawValueBytes > stats.ValueBytes)
+	a.True(stats.CompressionRatio > 1)
+
+	// exports are not compressed and imports are compressed again
+	var buf bytes.Buffer
+	a.NoError(db.Export(&buf))
+	a.True(strings.Contains(buf.String(), long+"c"))
+	st2, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	db2, err := New(st2, []Record{&compressedRecord{algorithm: CompressSnappy}})
+	a.NoError(err)
+	result, err := db2.Import(&buf, nil)
+	a.NoError(err)
+	a.Equal(4, result.Written)
+	record := &otherRecord{ID: "a"}
+	a.NoError(db2.Read(record))
+	a.Equal(long+"a", record.Value)
+	stats, err = db2.TypeStats("oth")
+	a.NoError(err)
+	a.Equal(3, stats.CompressedKeys)
+}
+
+func TestEncryption(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	_, err = New(st, []Record{&badSecretRecord{}})
+	a.True(errors.Is(err, ErrInvalidEncryptedField))
+
+	db, err := New(st, []Record{&secretRecord{}})
+	a.NoError(err)
+	err = db.Write(&secretRecord{ID: "a", Token: "secret"})
+	a.True(errors.Is(err, ErrNoKeyProvider))
+
+	keys := &testKeyProvider{
+		keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+			"k3": bytes.Repeat([]byte{3}, 16),
+		},
+		current: map[string]string{"t1": "k1", "t2": "k2"},
+	}
+	db.SetKeyProvider(keys)
+	a.NoError(db.Write(&secretRecord{ID: "a", Tenant: "t1", Token: "secret", Data: []byte("data")}))
+	a.NoError(db.Write(&secretRecord{ID: "b", Tenant: "t2", Token: "hidden"}))
+	a.NoError(db.Write(&secretRecord{ID: "c", Tenant: "t1"}))
+
+	record := &secretRecord{ID: "a"}
+	a.NoError(db.Read(record))
+	a.Equal("secret", record.Token)
+	a.Equal("data", string(record.Data))
+	var tokens []string
+	a.NoError(db.RangeWith(&secretRecord{}, nil, func(record Record) bool {
+		tokens = append(tokens, record.(*secretRecord).Token)
+		return true
+	}))
+	a.Equal("[secret hidden ]", fmt.Sprint(tokens))
+
+	// exports only have the encrypted values
+	var buf bytes.Buffer
+	a.NoError(db.Export(&buf))
+	a.True(strings.Contains(buf.String(), `"Tenant":"t1"`))
+	a.False(strings.Contains(buf.String(), "secret"))
+	a.False(strings.Contains(buf.String(), "hidden"))
+
+	// a value moved to another field does not decrypt
+	a.NoError(db.(*recorderDB).DB.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("sec\x00b"))
+		if err != nil {
+			return err
+		}
+		var doc map[string]interface{}
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &doc)
+		})
+		if err != nil {
+			return err
+		}
+		doc["Token"], doc["Data"] = "", doc["Token"]
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("sec\x00d"), data)
+	}))
+	err = db.Read(&secretRecord{ID: "d"})
+	a.True(errors.Is(err, ErrInvalidCiphertext))
+	a.NoError(db.Delete(&secretRecord{ID: "d"}))
+
+	// a value copied to another record does not decrypt
+	a.NoError(db.(*recorderDB).DB.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("sec\x00b"))
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("sec\x00e"), data)
+	}))
+	err = db.Read(&secretRecord{ID: "e"})
+	a.True(errors.Is(err, ErrInvalidCiphertext))
+	a.NoError(db.Delete(&secretRecord{ID: "e"}))
+
+	// change hooks can compare the plain text of values that are encrypted again with new nonces
+	var changes []Change
+	db.OnChange(func(txn RecorderTxn, change Change) error {
+		changes = append(changes, change)
+		return nil
+	})
+	a.NoError(db.Write(&secretRecord{ID: "a", Tenant: "t1", Token: "secret", Data: []byte("data")}))
+	a.Equal(1, len(changes))
+	a.NotEqual(string(changes[0].Old), string(changes[0].New))
+	a.Equal(string(changes[0].OldPlain), string(changes[0].NewPlain))
+	a.True(strings.Contains(string(changes[0].NewPlain), `"Token":"secret"`))
+	a.False(strings.Contains(string(changes[0].New), "secret"))
+
+	// rotate the key of t1, only records with values encrypted by k1 are written again
+	keys.current["t1"] = "k3"
+	count, err := db.ReEncrypt(&secretRecord{})
+	a.NoError(err)
+	a.Equal(1, count)
+	count, err = db.ReEncrypt(&secretRecord{})
+	a.NoError(err)
+	a.Equal(0, count)
+	delete(keys.keys, "k1")
+	record = &secretRecord{ID: "a"}
+	a.NoError(db.Read(record))
+	a.Equal("secret", record.Token)
+	a.Equal("data", string(record.Data))
+	a.Equal("t1", record.Tenant)
+}
@@ -0,0 +1,309 @@
+package record
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrInvalidDropToken indicates DropType was called with a token not returned by DropTypeToken
+// for the same type or one that has expired
+var ErrInvalidDropToken = errors.New("invalid or expired drop token")
+
+// ErrTypeNotRegistered indicates a record type name that is not in the registry
+var ErrTypeNotRegistered = errors.New("record type not registered")
+
+// dropTokenTTL is how long a token from DropTypeToken can be used
+const dropTokenTTL = 5 * time.Minute
+
+// registryPrefix is the reserved prefix of registry keys, record type prefixes always start with
+// a lowercase letter so can not collide with it
+var registryPrefix = []byte("_types\x00")
+
+// TypeInfo is the registry entry kept for each record type ever provided to New
+type TypeInfo struct {
+	Name string
+
+	// GoType is the Go type of the record provided to New
+	GoType string
+
+	// Codec describes how values are encoded
+	Codec string
+
+	// SchemaVersion is provided by records that implement SchemaVersioner, otherwise 0
+	SchemaVersion int
+
+	RegisteredAt time.Time
+	UpdatedAt    time.Time
+
+	// Configured is true when the type was provided to New for this RecorderDB
+	Configured bool `json:"-"`
+}
+
+// TypeStats describes the amount of data stored for a record type
+type TypeStats struct {
+	// Keys is the number of records
+	Keys int
+
+	// Bytes is the estimated size of the keys and values of the records
+	Bytes int64
+
+	// CompressedKeys is the number of records with compressed values
+	CompressedKeys int
+
+	// ValueBytes is the size of the stored values and RawValueBytes their size uncompressed
+	ValueBytes    int64
+	RawValueBytes int64
+
+	// CompressionRatio is RawValueBytes divided by ValueBytes, 1 when nothing is compressed
+	CompressionRatio float64
+}
+
+// SchemaVersioner may be implemented by a Record to have its schema version kept in the registry
+type SchemaVersioner interface {
+	SchemaVersion() int
+}
+
+// TypeAdmin provides access to the registry of record types and per type administration
+type TypeAdmin interface {
+	// ListTypes returns every record type in the registry sorted by name including types that
+	// were not provided to New
+	ListTypes() ([]TypeInfo, error)
+
+	// TypeStats returns the number and size of records of the named type.  Every value is read
+	// to find how well it compressed
+	TypeStats(name string) (TypeStats, error)
+
+	// DropTypeToken returns a token that must be passed to DropType to confirm the named type
+	// should be dropped.  The token can be used once within 5 minutes
+	DropTypeToken(name string) (string, error)
+
+	// DropType deletes all records, indexes, text index, geo index, expiry entries, history,
+	// trash and sequences of the named type and removes it from the registry
+	DropType(name string, token string) error
+}
+
+type dropToken struct {
+	name    string
+	expires time.Time
+}
+
+// dropTokens holds the outstanding tokens from DropTypeToken
+type dropTokens struct {
+	mutex  sync.Mutex
+	tokens map[string]dropToken
+}
+
+// register updates the registry with the configured record types and warns about registered
+// types that are not configured
+func (r *recorderDB) register(records []Record) error {
+	now := time.Now().UTC()
+	var missing []string
+	err := r.DB.Update(func(txn *badger.Txn) error {
+		registered, err := readRegistry(txn)
+		if err != nil {
+			return err
+		}
+		for _, v := range records {
+			rt := r.types[v.Name()]
+			info := TypeInfo{
+				Name:         rt.name,
+				GoType:       reflect.TypeOf(v).String(),
+				Codec:        rt.codec(),
+				RegisteredAt: now,
+				UpdatedAt:    now,
+			}
+			if versioner, ok := v.(SchemaVersioner); ok {
+				info.SchemaVersion = versioner.SchemaVersion()
+			}
+			old, ok := registered[rt.name]
+			if ok {
+				delete(registered, rt.name)
+				info.RegisteredAt = old.RegisteredAt
+				if info.GoType == old.GoType &&
+					info.Codec == old.Codec &&
+					info.SchemaVersion == old.SchemaVersion {
+					continue
+				}
+			}
+			data, err := json.Marshal(&info)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(joinKey(registryPrefix, []byte(rt.name)), data)
+			if err != nil {
+				return err
+			}
+		}
+		for name := range registered {
+			missing = append(missing, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(missing)
+	for _, v := range missing {
+		fmt.Println("record type", v, "is registered in the store but was not provided to New")
+	}
+	return nil
+}
+
+func readRegistry(txn *badger.Txn) (map[string]TypeInfo, error) {
+	registered := make(map[string]TypeInfo)
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = registryPrefix
+	it := txn.NewIterator(itOps)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var info TypeInfo
+		err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &info)
+		})
+		if err != nil {
+			return nil, err
+		}
+		registered[info.Name] = info
+	}
+	return registered, nil
+}
+
+func (r *recorderDB) ListTypes() ([]TypeInfo, error) {
+	var registered map[string]TypeInfo
+	err := r.DB.View(func(txn *badger.Txn) error {
+		var err error
+		registered, err = readRegistry(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	types := make([]TypeInfo, 0, len(registered))
+	for name, info := range registered {
+		_, info.Configured = r.types[name]
+		types = append(types, info)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types, nil
+}
+
+func (r *recorderDB) TypeStats(name string) (TypeStats, error) {
+	var stats TypeStats
+	err := r.DB.View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.Prefix = append([]byte(name), 0)
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			stats.Keys++
+			stats.Bytes += it.Item().EstimatedSize()
+			err := it.Item().Value(func(val []byte) error {
+				data, err := decodeValue(val)
+				if err != nil {
+					return err
+				}
+				if isCompressed(val) {
+					stats.CompressedKeys++
+				}
+				stats.ValueBytes += int64(len(val))
+				stats.RawValueBytes += int64(len(data))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	stats.CompressionRatio = 1
+	if stats.ValueBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawValueBytes) / float64(stats.ValueBytes)
+	}
+	return stats, err
+}
+
+func (r *recorderDB) DropTypeToken(name string) (string, error) {
+	err := r.checkRegistered(name)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, 16)
+	_, err = rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(data)
+	r.dropTokens.mutex.Lock()
+	defer r.dropTokens.mutex.Unlock()
+	if r.dropTokens.tokens == nil {
+		r.dropTokens.tokens = make(map[string]dropToken)
+	}
+	now := time.Now()
+	for k, v := range r.dropTokens.tokens {
+		if now.After(v.expires) {
+			delete(r.dropTokens.tokens, k)
+		}
+	}
+	r.dropTokens.tokens[token] = dropToken{name: name, expires: now.Add(dropTokenTTL)}
+	return token, nil
+}
+
+func (r *recorderDB) DropType(name string, token string) error {
+	r.dropTokens.mutex.Lock()
+	dt, ok := r.dropTokens.tokens[token]
+	if ok {
+		delete(r.dropTokens.tokens, token)
+	}
+	r.dropTokens.mutex.Unlock()
+	if !ok || dt.name != name || time.Now().After(dt.expires) {
+		return ErrInvalidDropToken
+	}
+	err := r.checkRegistered(name)
+	if err != nil {
+		return err
+	}
+	// record keys are name, 0 while indexes, text index, geo index, expiry entries, history,
+	// trash and sequences use other bytes after the name
+	err = r.DB.DropPrefix(
+		append([]byte(name), 0),
+		append([]byte(name), indexKeyMark),
+		append([]byte(name), expiryKeyMark),
+		append([]byte(name), historyKeyMark),
+		append([]byte(name), trashKeyMark),
+		append([]byte(name), textKeyMark),
+		append([]byte(name), geoKeyMark),
+		append([]byte(name), sequenceKeyMark),
+	)
+	if err != nil {
+		return err
+	}
+	return r.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(joinKey(registryPrefix, []byte(name)))
+	})
+}
+
+func (r *recorderDB) checkRegistered(name string) error {
+	return r.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(joinKey(registryPrefix, []byte(name)))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w name: %v", ErrTypeNotRegistered, name)
+		}
+		return err
+	})
+}
+
+// isRegistryKey reports if key belongs to the registry or holds a secret of the RecorderDB,
+// these are written by New
+func isRegistryKey(key []byte) bool {
+	return bytes.HasPrefix(key, registryPrefix) || bytes.HasPrefix(key, secretPrefix)
+}
@@ -0,0 +1,291 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// ErrRestricted indicates a delete was stopped because the record has children of a type whose
+// relation is RestrictDelete
+var ErrRestricted = errors.New("record has children that restrict its delete")
+
+// ErrInvalidRelation indicates a Relation that names a record type not provided to New or has no
+// ParentKey function
+var ErrInvalidRelation = errors.New("invalid relation")
+
+// deleteChunkSize is the number of children deleted in each transaction when a delete is too big
+// for one transaction
+const deleteChunkSize = 1000
+
+// DeleteAction is what happens to children when their parent is deleted
+type DeleteAction int
+
+const (
+	// CascadeDelete deletes the children along with the parent
+	CascadeDelete DeleteAction = iota
+
+	// RestrictDelete stops the delete of a parent that has children with ErrRestricted
+	RestrictDelete
+)
+
+// Relation describes a child record type of a parent record type.  The key of every child starts
+// with the key of its parent
+type Relation struct {
+	// Child is the name of the child record type
+	Child string
+
+	OnDelete DeleteAction
+
+	// ParentKey returns the key of the parent of the child with childKey, it must be a prefix of
+	// childKey
+	ParentKey func(childKey []byte) []byte
+}
+
+// Relater may be implemented by a Record to declare the child record types of its type.
+// Relations is called once by New on the records provided to it.  Children of relations with
+// CascadeDelete are deleted without calling their hooks
+type Relater interface {
+	Relations() []Relation
+}
+
+// Orphan is a child record whose parent does not exist
+type Orphan struct {
+	// Parent is the name of the parent record type
+	Parent string
+
+	// Child is the name of the child record type
+	Child string
+
+	Key []byte
+}
+
+// setRelations fills in the relations of each record type, all types must be known so this is
+// done after they are all created
+func setRelations(types map[string]*recordType, records []Record) error {
+	for _, v := range records {
+		relater, ok := v.(Relater)
+		if !ok {
+			continue
+		}
+		rt := types[v.Name()]
+		rt.relations = relater.Relations()
+		for _, rel := range rt.relations {
+			_, ok := types[rel.Child]
+			if !ok || rel.ParentKey == nil {
+				return fmt.Errorf("%w name: %v child: %v", ErrInvalidRelation, rt.name, rel.Child)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *recorderDB) FindOrphans(cb func(orphan Orphan) bool) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	for _, rt := range r.types {
+		for _, rel := range rt.relations {
+			childRt := r.types[rel.Child]
+			more, err := txn.findOrphans(rt, childRt, rel, cb)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findOrphans calls cb with each child of rel that has no parent, false is returned if cb does
+func (r *recorderTxn) findOrphans(
+	rt *recordType,
+	childRt *recordType,
+	rel Relation,
+	cb func(orphan Orphan) bool,
+) (bool, error) {
+	itOps := badger.DefaultIteratorOptions
+	itOps.PrefetchValues = false
+	itOps.Prefix = childRt.prefix
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	var lastParent []byte
+	lastExists := false
+	for it.Rewind(); it.Valid(); it.Next() {
+		childKey := it.Item().KeyCopy(nil)[len(childRt.prefix):]
+		parentKey := rel.ParentKey(childKey)
+		// children of the same parent are together so the parent is only looked up once
+		if lastParent == nil || !bytes.Equal(parentKey, lastParent) {
+			lastParent = parentKey
+			_, err := r.Get(joinKey(rt.prefix, parentKey))
+			if err != nil && err != badger.ErrKeyNotFound {
+				return false, err
+			}
+			lastExists = err == nil
+		}
+		if !lastExists && !cb(Orphan{Parent: rt.name, Child: childRt.name, Key: childKey}) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deleteChunked deletes record and its children when they do not fit in one transaction.
+// Restrictions are checked once before anything is deleted, then children are deleted in chunks
+// and the record last so if this is interrupted deleting record again continues where it stopped.
+// The BeforeDelete hook is run by the final Delete
+func (r *recorderDB) deleteChunked(rt *recordType, record Record) error {
+	keyValue, err := record.Key()
+	if err != nil {
+		return err
+	}
+	err = r.View(context.Background(), func(txn RecorderTxn) error {
+		return txn.(*recorderTxn).checkRestricted(rt, keyValue)
+	})
+	if err != nil {
+		return err
+	}
+	for done := false; !done; {
+		err = r.Update(context.Background(), func(txn RecorderTxn) error {
+			budget := deleteChunkSize
+			var err error
+			done, err = txn.(*recorderTxn).deleteChildren(rt, keyValue, &budget)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.Delete(record)
+	})
+}
+
+// checkRestricted returns ErrRestricted if deleting the record of type rt at keyValue would
+// cascade to or directly delete a record with restricted children
+func (r *recorderTxn) checkRestricted(rt *recordType, keyValue []byte) error {
+	for _, rel := range rt.relations {
+		childRt := r.db.types[rel.Child]
+		if rel.OnDelete == RestrictDelete {
+			if len(r.childKeys(rel, childRt, keyValue, 1)) > 0 {
+				return fmt.Errorf("%w name: %v child: %v", ErrRestricted, rt.name, childRt.name)
+			}
+			continue
+		}
+		if len(childRt.relations) == 0 {
+			// children without relations of their own can not be restricted
+			continue
+		}
+		err := r.rangeChildKeys(rel, childRt, keyValue, func(childKey []byte) error {
+			return r.checkRestricted(childRt, childKey)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAllChildren deletes all descendants of the record of type rt at keyValue, restrictions
+// are checked first so nothing is deleted if any are violated
+func (r *recorderTxn) deleteAllChildren(rt *recordType, keyValue []byte) error {
+	if len(rt.relations) == 0 {
+		return nil
+	}
+	err := r.checkRestricted(rt, keyValue)
+	if err != nil {
+		return err
+	}
+	budget := math.MaxInt32
+	_, err = r.deleteChildren(rt, keyValue, &budget)
+	return err
+}
+
+// deleteChildren deletes at most budget descendants of the record of type rt at keyValue,
+// deepest first.  true is returned when none remain
+func (r *recorderTxn) deleteChildren(rt *recordType, keyValue []byte, budget *int) (bool, error) {
+	for _, rel := range rt.relations {
+		if rel.OnDelete != CascadeDelete {
+			continue
+		}
+		childRt := r.db.types[rel.Child]
+		for {
+			if *budget <= 0 {
+				return false, nil
+			}
+			// deletes in this transaction are seen by the next iterator so this makes progress
+			childKeys := r.childKeys(rel, childRt, keyValue, *budget)
+			if len(childKeys) == 0 {
+				break
+			}
+			for _, childKey := range childKeys {
+				done, err := r.deleteChildren(childRt, childKey, budget)
+				if err != nil || !done {
+					return false, err
+				}
+				if *budget <= 0 {
+					return false, nil
+				}
+				err = r.deleteKey(childRt, joinKey(childRt.prefix, childKey))
+				if err != nil {
+					return false, err
+				}
+				*budget--
+			}
+		}
+	}
+	return true, nil
+}
+
+// childKeys returns the keys of at most limit children of rel of the record at keyValue
+func (r *recorderTxn) childKeys(
+	rel Relation,
+	childRt *recordType,
+	keyValue []byte,
+	limit int,
+) [][]byte {
+	var keys [][]byte
+	_ = r.rangeChildKeys(rel, childRt, keyValue, func(childKey []byte) error {
+		keys = append(keys, childKey)
+		if len(keys) >= limit {
+			return errStopRange
+		}
+		return nil
+	})
+	return keys
+}
+
+// errStopRange stops rangeChildKeys without being returned
+var errStopRange = errors.New("stop range")
+
+// rangeChildKeys calls fn with a copy of the key of each child of rel, of type childRt, of the
+// record at keyValue.  Keys starting with keyValue that rel.ParentKey gives another parent, like
+// the children of "abc" when keyValue is "ab", are skipped
+func (r *recorderTxn) rangeChildKeys(
+	rel Relation,
+	childRt *recordType,
+	keyValue []byte,
+	fn func(childKey []byte) error,
+) error {
+	itOps := badger.DefaultIteratorOptions
+	itOps.PrefetchValues = false
+	itOps.Prefix = joinKey(childRt.prefix, keyValue)
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		childKey := it.Item().KeyCopy(nil)[len(childRt.prefix):]
+		if !bytes.Equal(rel.ParentKey(childKey), keyValue) {
+			continue
+		}
+		err := fn(childKey)
+		if err == errStopRange {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package record
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -41,3 +45,481 @@ func (r *testRecord) TTL() time.Duration {
 func (r *testRecord) Record() interface{} {
 	return r
 }
+
+type otherRecord struct {
+	ID string `json:"-"`
+
+	Value string
+}
+
+func (r *otherRecord) Name() string {
+	return "oth"
+}
+
+func (r *otherRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *otherRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *otherRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *otherRecord) Record() interface{} {
+	return r
+}
+
+// badRecord is never included in a config
+type badRecord struct {
+	otherRecord
+}
+
+func (r *badRecord) Name() string {
+	return "bad"
+}
+
+var errHookInvalid = errors.New("invalid hook record")
+
+// hookRecord implements all the lifecycle hooks
+type hookRecord struct {
+	ID string `json:"-"`
+
+	Value   string
+	Derived string `json:"-"`
+}
+
+func (r *hookRecord) Name() string {
+	return "hok"
+}
+
+func (r *hookRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *hookRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *hookRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *hookRecord) Record() interface{} {
+	return r
+}
+
+func (r *hookRecord) BeforeWrite() error {
+	if r.Value == "" {
+		r.Value = "default"
+	}
+	return nil
+}
+
+func (r *hookRecord) Validate() error {
+	if r.Value == "bad" {
+		return errHookInvalid
+	}
+	return nil
+}
+
+func (r *hookRecord) AfterRead() error {
+	r.Derived = strings.ToUpper(r.Value)
+	return nil
+}
+
+func (r *hookRecord) BeforeDelete() error {
+	if r.ID == "keep" {
+		return errHookInvalid
+	}
+	return nil
+}
+
+// parentRecord has 2 byte keys and children of types chi and oth
+type parentRecord struct {
+	ID string `json:"-"`
+}
+
+func (r *parentRecord) Name() string {
+	return "par"
+}
+
+func (r *parentRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *parentRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *parentRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *parentRecord) Record() interface{} {
+	return r
+}
+
+func (r *parentRecord) Relations() []Relation {
+	parentKey := func(childKey []byte) []byte { return childKey[:2] }
+	return []Relation{
+		{Child: "chi", OnDelete: CascadeDelete, ParentKey: parentKey},
+		{Child: "oth", OnDelete: RestrictDelete, ParentKey: parentKey},
+	}
+}
+
+// folderRecord has keys of any length and children of types chi and oth with keys of its key,
+// a slash then a name
+type folderRecord struct {
+	ID string `json:"-"`
+}
+
+func (r *folderRecord) Name() string {
+	return "fol"
+}
+
+func (r *folderRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *folderRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *folderRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *folderRecord) Record() interface{} {
+	return r
+}
+
+func (r *folderRecord) Relations() []Relation {
+	parentKey := func(childKey []byte) []byte {
+		i := bytes.LastIndexByte(childKey, '/')
+		if i < 0 {
+			return nil
+		}
+		return childKey[:i]
+	}
+	return []Relation{
+		{Child: "chi", OnDelete: CascadeDelete, ParentKey: parentKey},
+		{Child: "oth", OnDelete: RestrictDelete, ParentKey: parentKey},
+	}
+}
+
+// childRecord is a child of parentRecord
+type childRecord struct {
+	ID string `json:"-"`
+}
+
+func (r *childRecord) Name() string {
+	return "chi"
+}
+
+func (r *childRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *childRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *childRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *childRecord) Record() interface{} {
+	return r
+}
+
+// userRecord has a unique email and a unique case insensitive nick
+type userRecord struct {
+	ID string `json:"-"`
+
+	Email string
+	Nick  string
+}
+
+func (r *userRecord) Name() string {
+	return "usr"
+}
+
+func (r *userRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *userRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *userRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *userRecord) Record() interface{} {
+	return r
+}
+
+func (r *userRecord) Indexes() []Index {
+	return []Index{
+		{Name: "email", Path: "Email", Unique: true},
+		{
+			Name: "nick",
+			Path: "Nick",
+			Extract: func(doc interface{}) (interface{}, bool) {
+				value, ok := FieldValue(doc, "Nick")
+				if s, isString := value.(string); ok && isString {
+					return strings.ToLower(s), true
+				}
+				return nil, false
+			},
+			Unique: true,
+		},
+	}
+}
+
+// sessionRecord tracks expiry so it is found by Sweep
+type sessionRecord struct {
+	ID string `json:"-"`
+
+	User string
+}
+
+func (r *sessionRecord) Name() string {
+	return "ses"
+}
+
+func (r *sessionRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *sessionRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *sessionRecord) TTL() time.Duration {
+	return time.Hour
+}
+
+func (r *sessionRecord) Record() interface{} {
+	return r
+}
+
+func (r *sessionRecord) TrackExpiry() bool {
+	return true
+}
+
+// docRecord keeps its last 3 values
+type docRecord struct {
+	ID string `json:"-"`
+
+	Text string
+}
+
+func (r *docRecord) Name() string {
+	return "doc"
+}
+
+func (r *docRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *docRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *docRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *docRecord) Record() interface{} {
+	return r
+}
+
+func (r *docRecord) KeepHistory() HistoryRetention {
+	return HistoryRetention{MaxVersions: 3}
+}
+
+// articleRecord has a full text index
+type articleRecord struct {
+	ID string `json:"-"`
+
+	Title string
+	Body  string
+	Tags  []string
+}
+
+func (r *articleRecord) Name() string {
+	return "art"
+}
+
+func (r *articleRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *articleRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *articleRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *articleRecord) Record() interface{} {
+	return r
+}
+
+func (r *articleRecord) TextIndex() TextIndex {
+	return TextIndex{Fields: []string{"Title", "Body", "Tags"}}
+}
+
+// placeRecord has a geo index
+type placeRecord struct {
+	ID string `json:"-"`
+
+	Location struct {
+		Lat float64
+		Lng float64
+	}
+}
+
+func (r *placeRecord) Name() string {
+	return "plc"
+}
+
+func (r *placeRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *placeRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *placeRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *placeRecord) Record() interface{} {
+	return r
+}
+
+func (r *placeRecord) GeoIndex() GeoIndex {
+	return GeoIndex{LatPath: "Location.Lat", LngPath: "Location.Lng"}
+}
+
+// attachmentRecord references a blob
+type attachmentRecord struct {
+	ID   string `json:"-"`
+	Blob string
+}
+
+func (r *attachmentRecord) Name() string {
+	return "att"
+}
+
+func (r *attachmentRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *attachmentRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *attachmentRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *attachmentRecord) Record() interface{} {
+	return r
+}
+
+func (r *attachmentRecord) BlobIDs() []string {
+	if r.Blob == "" {
+		return nil
+	}
+	return []string{r.Blob}
+}
+
+// compressedRecord configures otherRecord values to be compressed with algorithm
+type compressedRecord struct {
+	otherRecord
+	algorithm CompressionAlgorithm
+}
+
+func (r *compressedRecord) Compression() Compression {
+	return Compression{Algorithm: r.algorithm, MinSize: 16}
+}
+
+// secretRecord has encrypted fields
+type secretRecord struct {
+	ID string `json:"-"`
+
+	Tenant string
+	Token  string `record:"encrypt"`
+	Data   []byte `record:"encrypt"`
+}
+
+func (r *secretRecord) Name() string {
+	return "sec"
+}
+
+func (r *secretRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *secretRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *secretRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *secretRecord) Record() interface{} {
+	return r
+}
+
+// badSecretRecord tags a field that can not be encrypted
+type badSecretRecord struct {
+	otherRecord
+
+	Count int `record:"encrypt"`
+}
+
+func (r *badSecretRecord) Record() interface{} {
+	return r
+}
+
+// testKeyProvider has a current key id for each tenant
+type testKeyProvider struct {
+	keys    map[string][]byte
+	current map[string]string
+}
+
+func (r *testKeyProvider) CurrentKey(record Record) (string, []byte, error) {
+	id := r.current[record.(*secretRecord).Tenant]
+	return id, r.keys[id], nil
+}
+
+func (r *testKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w key: %v", ErrNotFound, id)
+	}
+	return key, nil
+}
@@ -0,0 +1,515 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const textKeyMark = 'w'
+
+// maxTermLength is the longest term kept in a text index, longer words are not indexed
+const maxTermLength = 64
+
+// textFieldGap separates the positions of different text values so phrases do not match across
+// them
+const textFieldGap = 100
+
+// Token is a term found in text and its position, positions count all words including those
+// not indexed like stop words
+type Token struct {
+	Term     string
+	Position int
+}
+
+// Analyzer splits text into the terms kept in a text index
+type Analyzer interface {
+	Analyze(text string) []Token
+}
+
+// StandardAnalyzer splits text into words of letters and digits
+type StandardAnalyzer struct {
+	// Lowercase causes all words to be lower cased
+	Lowercase bool
+
+	// Stem causes common English suffixes like plurals, ing and ed to be removed
+	Stem bool
+
+	// StopWords are words that are not indexed, they are checked after lower casing
+	StopWords map[string]bool
+}
+
+// EnglishStopWords is a short list of common English words not worth indexing
+var EnglishStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "no": true, "not": true, "of": true, "on": true, "or": true, "such": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// DefaultAnalyzer lower cases, stems and removes English stop words
+var DefaultAnalyzer Analyzer = &StandardAnalyzer{
+	Lowercase: true,
+	Stem:      true,
+	StopWords: EnglishStopWords,
+}
+
+func (r *StandardAnalyzer) Analyze(text string) []Token {
+	words := strings.FieldsFunc(text, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	tokens := make([]Token, 0, len(words))
+	for i, word := range words {
+		if r.Lowercase {
+			word = strings.ToLower(word)
+		}
+		if r.StopWords[word] {
+			continue
+		}
+		if r.Stem {
+			word = stemLight(word)
+		}
+		if len(word) > maxTermLength {
+			continue
+		}
+		tokens = append(tokens, Token{Term: word, Position: i})
+	}
+	return tokens
+}
+
+// stemLight removes a few common English suffixes from word
+func stemLight(word string) string {
+	n := len(word)
+	switch {
+	case n <= 3:
+	case strings.HasSuffix(word, "ies") && n > 4:
+		return word[:n-3] + "y"
+	case strings.HasSuffix(word, "sses"):
+		return word[:n-2]
+	case strings.HasSuffix(word, "ing") && n > 5:
+		return word[:n-3]
+	case strings.HasSuffix(word, "ed") && n > 4:
+		return word[:n-2]
+	case strings.HasSuffix(word, "s") &&
+		!strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us") &&
+		!strings.HasSuffix(word, "is"):
+		return word[:n-1]
+	}
+	return word
+}
+
+// TextIndex describes the full text index of a record type
+type TextIndex struct {
+	// Fields are the dot separated paths of the string fields indexed, see FieldValue.  Arrays
+	// of strings are indexed as separate values
+	Fields []string
+
+	// Analyzer splits the fields and queries into terms, DefaultAnalyzer is used if nil
+	Analyzer Analyzer
+}
+
+// TextIndexer may be implemented by a Record to have a full text index maintained for its type.
+// TextIndex is called once by New on the records provided to it.  Record types with a text index
+// must always be written in a transaction
+type TextIndexer interface {
+	TextIndex() TextIndex
+}
+
+// SearchResult is a record found by Search
+type SearchResult struct {
+	Key   []byte
+	Score float64
+}
+
+// TextSearcher adds searching the full text index of record types that implement TextIndexer
+type TextSearcher interface {
+	// Search returns the keys of the records of the provided type that match query ranked by
+	// TF-IDF score, at most limit if limit is more than 0.  query is words a record must all
+	// contain, "quoted phrases" it must contain in order and words ending with * that are
+	// prefixes of words it must contain.  ErrIndexNotDefined is returned if the type has no text
+	// index
+	Search(record Record, query string, limit int) ([]SearchResult, error)
+}
+
+func (r *recorderDB) Search(record Record, query string, limit int) ([]SearchResult, error) {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.Search(record, query, limit)
+}
+
+// textPrefix returns the prefix of all keys in the text index of the record type.  Each key is
+// the prefix, a term, 0 then a record key and its value the positions of the term in the record
+func (r *recordType) textPrefix() []byte {
+	return append(r.prefix[:3:3], textKeyMark)
+}
+
+func (r *recordType) analyzer() Analyzer {
+	if r.text.Analyzer != nil {
+		return r.text.Analyzer
+	}
+	return DefaultAnalyzer
+}
+
+// textTerms returns the positions of each term in the text fields of doc
+func (r *recordType) textTerms(doc interface{}) map[string][]int {
+	terms := make(map[string][]int)
+	if doc == nil {
+		return terms
+	}
+	analyzer := r.analyzer()
+	base := 0
+	add := func(text string) {
+		last := 0
+		for _, token := range analyzer.Analyze(text) {
+			terms[token.Term] = append(terms[token.Term], base+token.Position)
+			last = token.Position
+		}
+		base += last + textFieldGap
+	}
+	for _, path := range r.text.Fields {
+		value, ok := FieldValue(doc, path)
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			add(v)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					add(s)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// updateText changes the text index entries of the record stored at key from those of the
+// current value to those of data, data is nil when the record is being deleted
+func (r *recorderTxn) updateText(
+	rt *recordType,
+	key []byte,
+	old *badger.Item,
+	data []byte,
+	expiresAt uint64,
+) error {
+	keyValue := key[len(rt.prefix):]
+	var oldDoc, newDoc interface{}
+	var err error
+	if old != nil {
+		err = old.Value(func(val []byte) error {
+			return unmarshalValue(val, &oldDoc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		err = json.Unmarshal(data, &newDoc)
+		if err != nil {
+			return err
+		}
+	}
+	oldTerms := rt.textTerms(oldDoc)
+	newTerms := rt.textTerms(newDoc)
+	prefix := rt.textPrefix()
+	for term := range oldTerms {
+		if _, ok := newTerms[term]; !ok {
+			err = r.Txn.Delete(textKey(prefix, term, keyValue))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for term, positions := range newTerms {
+		// always set so the entry gets the same expiration as the record
+		entry := badger.NewEntry(textKey(prefix, term, keyValue), encodePositions(positions))
+		entry.ExpiresAt = expiresAt
+		err = r.SetEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func textKey(prefix []byte, term string, keyValue []byte) []byte {
+	key := make([]byte, 0, len(prefix)+len(term)+1+len(keyValue))
+	key = append(key, prefix...)
+	key = append(key, term...)
+	key = append(key, 0)
+	return append(key, keyValue...)
+}
+
+func encodePositions(positions []int) []byte {
+	data := make([]byte, 0, len(positions)*2)
+	var buf [binary.MaxVarintLen64]byte
+	last := 0
+	for _, v := range positions {
+		data = append(data, buf[:binary.PutUvarint(buf[:], uint64(v-last))]...)
+		last = v
+	}
+	return data
+}
+
+func decodePositions(data []byte) []int {
+	var positions []int
+	last := 0
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			break
+		}
+		last += int(delta)
+		positions = append(positions, last)
+		data = data[n:]
+	}
+	return positions
+}
+
+// textClause is one part of a search query, a single term, a prefix or a phrase
+type textClause struct {
+	tokens []Token
+	prefix bool
+}
+
+// parseQuery splits query into clauses using analyzer, words that are all stop words are dropped
+func parseQuery(query string, analyzer Analyzer) []textClause {
+	var clauses []textClause
+	add := func(text string, prefix bool) {
+		tokens := analyzer.Analyze(text)
+		if len(tokens) == 0 {
+			return
+		}
+		if prefix {
+			clauses = append(clauses, textClause{tokens: tokens[len(tokens)-1:], prefix: true})
+			tokens = tokens[:len(tokens)-1]
+			if len(tokens) == 0 {
+				return
+			}
+		}
+		clauses = append(clauses, textClause{tokens: tokens})
+	}
+	for len(query) > 0 {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if strings.HasPrefix(query, `"`) {
+			end := strings.Index(query[1:], `"`)
+			if end < 0 {
+				end = len(query) - 1
+			}
+			add(query[1:end+1], false)
+			if end+2 > len(query) {
+				end = len(query) - 2
+			}
+			query = query[end+2:]
+			continue
+		}
+		end := strings.IndexFunc(query, unicode.IsSpace)
+		if end < 0 {
+			end = len(query)
+		}
+		word := query[:end]
+		query = query[end:]
+		if strings.HasSuffix(word, "*") {
+			add(strings.TrimSuffix(word, "*"), true)
+		} else {
+			add(word, false)
+		}
+	}
+	return clauses
+}
+
+func (r *recorderTxn) Search(record Record, query string, limit int) ([]SearchResult, error) {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return nil, err
+	}
+	if rt.text == nil {
+		return nil, fmt.Errorf("%w name: %v index: text", ErrIndexNotDefined, rt.name)
+	}
+	clauses := parseQuery(query, rt.analyzer())
+	if len(clauses) == 0 {
+		return nil, nil
+	}
+	docCount, err := r.Count(record, nil)
+	if err != nil {
+		return nil, err
+	}
+	idf := func(df int) float64 {
+		return math.Log(1 + float64(docCount)/float64(df))
+	}
+
+	var scores map[string]float64
+	for i, clause := range clauses {
+		var clauseScores map[string]float64
+		if clause.prefix {
+			clauseScores, err = r.searchPrefix(rt, clause.tokens[0].Term, idf)
+		} else {
+			clauseScores, err = r.searchPhrase(rt, clause.tokens, idf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// every clause must match, a clause without matches leaves none
+		if len(clauseScores) == 0 {
+			return nil, nil
+		}
+		if i == 0 {
+			scores = clauseScores
+			continue
+		}
+		for key, score := range scores {
+			clauseScore, ok := clauseScores[key]
+			if !ok {
+				delete(scores, key)
+				continue
+			}
+			scores[key] = score + clauseScore
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for key, score := range scores {
+		results = append(results, SearchResult{Key: []byte(key), Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return bytes.Compare(results[i].Key, results[j].Key) < 0
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// postings returns the positions of term in each record that contains it by record key
+func (r *recorderTxn) postings(rt *recordType, term string) (map[string][]int, error) {
+	prefix := textKey(rt.textPrefix(), term, nil)
+	result := make(map[string][]int)
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = prefix
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		err := item.Value(func(val []byte) error {
+			result[string(item.Key()[len(prefix):])] = decodePositions(val)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// searchPrefix scores records containing terms starting with prefix
+func (r *recorderTxn) searchPrefix(
+	rt *recordType,
+	prefix string,
+	idf func(df int) float64,
+) (map[string]float64, error) {
+	textPrefix := rt.textPrefix()
+	scores := make(map[string]float64)
+	// postings of each term are together so the score of a term is added once it is complete
+	var term []byte
+	var termTF map[string]int
+	flush := func() {
+		weight := idf(len(termTF))
+		for key, tf := range termTF {
+			scores[key] += float64(tf) * weight
+		}
+	}
+	itOps := badger.DefaultIteratorOptions
+	itOps.Prefix = joinKey(textPrefix, []byte(prefix))
+	it := r.NewIterator(itOps)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		rest := item.Key()[len(textPrefix):]
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			continue
+		}
+		if term == nil || !bytes.Equal(term, rest[:end]) {
+			if term != nil {
+				flush()
+			}
+			term = append([]byte{}, rest[:end]...)
+			termTF = make(map[string]int)
+		}
+		err := item.Value(func(val []byte) error {
+			termTF[string(rest[end+1:])] = len(decodePositions(val))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if term != nil {
+		flush()
+	}
+	return scores, nil
+}
+
+// searchPhrase scores records containing tokens at the same relative positions, a single token
+// is a plain term
+func (r *recorderTxn) searchPhrase(
+	rt *recordType,
+	tokens []Token,
+	idf func(df int) float64,
+) (map[string]float64, error) {
+	postings := make([]map[string][]int, len(tokens))
+	weight := 0.0
+	for i, token := range tokens {
+		var err error
+		postings[i], err = r.postings(rt, token.Term)
+		if err != nil {
+			return nil, err
+		}
+		if len(postings[i]) == 0 {
+			return nil, nil
+		}
+		weight += idf(len(postings[i]))
+	}
+	weight /= float64(len(tokens))
+	scores := make(map[string]float64)
+	for key, first := range postings[0] {
+		tf := 0
+		for _, start := range first {
+			match := true
+			for i := 1; i < len(tokens) && match; i++ {
+				want := start + tokens[i].Position - tokens[0].Position
+				match = containsInt(postings[i][key], want)
+			}
+			if match {
+				tf++
+			}
+		}
+		if tf > 0 {
+			scores[key] = float64(tf) * weight
+		}
+	}
+	return scores, nil
+}
+
+func containsInt(values []int, want int) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,9 @@
 package record
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 )
@@ -13,109 +13,217 @@ import (
 // so a good pattern is to defer Discard() right after RecorderDB.NewTransaction
 type RecorderTxn interface {
 	Recorder
+	ConditionalRecorder
+	ExpiryRecorder
+	HistoryRecorder
+	TrashRecorder
+	TextSearcher
+	GeoSearcher
 
 	Discard()
+
+	// Commit ends the transaction saving all changes, then calls the functions registered with
+	// OnCommit
 	Commit() error
+
+	// OnCommit registers fn to be called after the transaction is successfully committed.  Work
+	// like cache invalidation that must only happen once changes are durable belongs here
+	OnCommit(fn func())
+
+	// Context returns the context passed to Update or View, context.Background() for
+	// transactions from NewTransaction
+	Context() context.Context
 }
 
 type recorderTxn struct {
 	*badger.Txn
-	recPrefixes map[string][]byte
+	db       *recorderDB
+	ctx      context.Context
+	onCommit []func()
 }
 
 func (r *recorderTxn) Write(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+	return r.write(record, nil)
+}
+
+// write does the work of Write and WriteWithExpiry, expiresAt replaces record.TTL() if not nil
+func (r *recorderTxn) write(record Record, expiresAt *time.Time) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
 	}
-	keyValue, err := record.Key()
+	return r.db.handle(OpWrite, record, func(op Op, record Record) error {
+		entry, data, err := prepareEntry(rt, record)
+		if err != nil {
+			return err
+		}
+		if expiresAt != nil {
+			entry.ExpiresAt = 0
+			if !expiresAt.IsZero() {
+				entry.ExpiresAt = uint64(expiresAt.Unix())
+			}
+		}
+		return r.setEntry(rt, entry, data)
+	})
+}
+
+// setEntry sets entry holding data for a record of type rt along with the other keys kept for it.
+// data is the JSON encoded value before compression, expiry and history keep the stored value
+func (r *recorderTxn) setEntry(rt *recordType, entry *badger.Entry, data []byte) error {
+	old, err := r.readOld(rt, entry.Key)
 	if err != nil {
 		return err
 	}
-	data, err := json.Marshal(record.Record())
+	err = r.notifyChange(OpWrite, rt, entry.Key, old, data)
 	if err != nil {
 		return err
 	}
-	entry := badger.NewEntry(append(prefix, keyValue...), data)
-	ttl := record.TTL()
-	if ttl > 0 {
-		entry.WithTTL(ttl)
+	if len(rt.indexes) > 0 {
+		err := r.updateIndexes(rt, entry.Key, old, data, entry.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.trackExpiry {
+		err := r.updateExpiry(rt, entry.Key, old, entry.Value, entry.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.text != nil {
+		err := r.updateText(rt, entry.Key, old, data, entry.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.geo != nil {
+		err := r.updateGeo(rt, entry.Key, old, data, entry.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.history != nil {
+		err := r.updateHistory(rt, entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
 	}
 	return r.SetEntry(entry)
 }
 
 func (r *recorderTxn) Read(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
-	}
-	keyValue, err := record.Key()
+	_, err := r.readItem(record)
+	return err
+}
+
+func (r *recorderTxn) Delete(record Record) error {
+	rt, err := r.db.recordType(record)
 	if err != nil {
 		return err
 	}
-	item, err := r.Get(append(prefix, keyValue...))
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return ErrNotFound
+	return r.db.handle(OpDelete, record, func(op Op, record Record) error {
+		err := beforeDelete(record)
+		if err != nil {
+			return err
 		}
-		return err
-	}
-	return item.Value(func(val []byte) error {
-		return json.Unmarshal(val, record.Record())
+		keyValue, err := record.Key()
+		if err != nil {
+			return err
+		}
+		err = r.deleteAllChildren(rt, keyValue)
+		if err != nil {
+			return err
+		}
+		return r.deleteKey(rt, joinKey(rt.prefix, keyValue))
 	})
 }
 
-func (r *recorderTxn) Delete(record Record) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+// readOld returns the item of the record stored at key, nil if there is none.  It is read once by
+// setEntry and deleteKey for the change hooks and the keys kept for the record, and not at all
+// when none need it so key is not added to the reads of the transaction
+func (r *recorderTxn) readOld(rt *recordType, key []byte) (*badger.Item, error) {
+	if len(r.db.changeHooks) == 0 && len(rt.indexes) == 0 && !rt.trackExpiry && rt.text == nil &&
+		rt.geo == nil {
+		return nil, nil
 	}
-	keyValue, err := record.Key()
-	if err != nil {
-		return err
+	item, err := r.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
 	}
-	return r.Txn.Delete(append(prefix, keyValue...))
+	return item, err
 }
 
-func (r *recorderTxn) Range(record Record, prefixBytes int, reverse bool, cb func(record Record) bool) error {
-	name := record.Name()
-	prefix, ok := r.recPrefixes[name]
-	if !ok {
-		return fmt.Errorf("%w name: %v", ErrRecordNotDefined, name)
+// deleteKey deletes the record of type rt at key along with its index entries
+func (r *recorderTxn) deleteKey(rt *recordType, key []byte) error {
+	old, err := r.readOld(rt, key)
+	if err != nil {
+		return err
 	}
-	keyValue, err := record.Key()
+	err = r.notifyChange(OpDelete, rt, key, old, nil)
 	if err != nil {
 		return err
 	}
-	if prefixBytes >= len(keyValue) {
-		return errors.New("prefixBytes as long or longer than key bytes")
-	}
-	key := append(prefix, keyValue...)
-	if prefixBytes > 0 {
-		prefix = append(prefix, keyValue[:prefixBytes]...)
-	}
-	itOps := badger.DefaultIteratorOptions
-	itOps.Reverse = reverse
-	it := r.NewIterator(itOps)
-	defer it.Close()
-	for it.Seek(key); it.ValidForPrefix(prefix); it.Next() {
-		item := it.Item()
-		err = item.Value(func(val []byte) error {
-			return json.Unmarshal(val, record.Record())
-		})
+	if len(rt.indexes) > 0 {
+		err := r.updateIndexes(rt, key, old, nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.trackExpiry {
+		err := r.updateExpiry(rt, key, old, nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if rt.text != nil {
+		err := r.updateText(rt, key, old, nil, 0)
 		if err != nil {
 			return err
 		}
-		err = record.SetKey(item.Key()[4:])
+	}
+	if rt.geo != nil {
+		err := r.updateGeo(rt, key, old, nil, 0)
 		if err != nil {
 			return err
 		}
-		if !cb(record) {
-			return nil
+	}
+	if rt.history != nil {
+		err := r.updateHistory(rt, key, nil)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	return r.Txn.Delete(key)
+}
+
+func (r *recorderTxn) Range(record Record, prefixBytes int, reverse bool, cb func(record Record) bool) error {
+	keyValue, err := record.Key()
+	if err != nil {
+		return err
+	}
+	if prefixBytes > len(keyValue) {
+		return errors.New("prefixBytes longer than key bytes")
+	}
+	return r.RangeWith(
+		record,
+		&RangeOptions{Prefix: keyValue[:prefixBytes], Start: keyValue, Reverse: reverse},
+		cb,
+	)
+}
+
+func (r *recorderTxn) RangeWith(record Record, opts *RangeOptions, cb func(record Record) bool) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	return r.rangeRecords(rt.prefix, record, opts, rt.decodeRecord, cb)
+}
+
+func (r *recorderTxn) Page(
+	record Record,
+	opts *RangeOptions,
+	cursor string,
+	cb func(record Record) bool,
+) (string, error) {
+	return pageRecords(r, r.db.cursorSecret, record, opts, cursor, cb)
 }
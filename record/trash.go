@@ -0,0 +1,231 @@
+package record
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const trashKeyMark = 't'
+
+// ErrInvalidTrash indicates a value in the trash that is too short to hold its deletion time
+var ErrInvalidTrash = errors.New("invalid trash value")
+
+// TrashRetainer may be implemented by a Record to have soft deleted records of its type purged
+// automatically TrashTTL after they are deleted.  A TrashTTL of 0 keeps them until Purge
+type TrashRetainer interface {
+	TrashTTL() time.Duration
+}
+
+// TrashRecorder adds soft deletes which move records to the trash of their type where Read and
+// Range do not see them
+type TrashRecorder interface {
+	// SoftDelete moves the record with the key of the provided record to the trash.  Like Delete
+	// its hooks are called and its index entries removed but children are not deleted.
+	// record.Record() will not be used or updated.  ErrNotFound is returned if there is no such
+	// record
+	SoftDelete(record Record) error
+
+	// Undelete writes the record with the key of the provided record from the trash back the
+	// same way Write does and removes it from the trash.  The provided record is set to the
+	// undeleted value.  ErrNotFound is returned if it is not in the trash and ErrAlreadyExists
+	// if a record with the same key has been written since it was deleted
+	Undelete(record Record) error
+
+	// RangeDeleted works like RangeWith on the records in the trash.  deletedAt is the zero time
+	// when opts.KeysOnly is true
+	RangeDeleted(
+		record Record,
+		opts *RangeOptions,
+		cb func(record Record, deletedAt time.Time) bool,
+	) error
+}
+
+func (r *recorderDB) SoftDelete(record Record) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.SoftDelete(record)
+	})
+}
+
+func (r *recorderDB) Undelete(record Record) error {
+	return r.Update(context.Background(), func(txn RecorderTxn) error {
+		return txn.Undelete(record)
+	})
+}
+
+func (r *recorderDB) RangeDeleted(
+	record Record,
+	opts *RangeOptions,
+	cb func(record Record, deletedAt time.Time) bool,
+) error {
+	txn := r.newTxn(false)
+	defer txn.Discard()
+	return txn.RangeDeleted(record, opts, cb)
+}
+
+func (r *recorderDB) Purge(record Record, olderThan time.Duration) (int, error) {
+	rt, err := r.recordType(record)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan).UnixNano()
+	prefix := rt.trashPrefix()
+	count := 0
+	var next []byte
+	for more := true; more; {
+		err = r.DB.Update(func(txn *badger.Txn) error {
+			itOps := badger.DefaultIteratorOptions
+			itOps.Prefix = prefix
+			it := txn.NewIterator(itOps)
+			defer it.Close()
+			var keys [][]byte
+			more = false
+			for it.Seek(joinKey(prefix, next)); it.Valid(); it.Next() {
+				if len(keys) >= deleteChunkSize {
+					next = it.Item().KeyCopy(nil)[len(prefix):]
+					more = true
+					break
+				}
+				var deletedAt int64
+				err := it.Item().Value(func(val []byte) error {
+					if len(val) < 8 {
+						return ErrInvalidTrash
+					}
+					deletedAt = int64(binary.BigEndian.Uint64(val))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if deletedAt < cutoff {
+					keys = append(keys, it.Item().KeyCopy(nil))
+				}
+			}
+			for _, key := range keys {
+				err := txn.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+			count += len(keys)
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (r *recorderTxn) SoftDelete(record Record) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	return r.db.handle(OpDelete, record, func(op Op, record Record) error {
+		err := beforeDelete(record)
+		if err != nil {
+			return err
+		}
+		item, err := r.getItem(record)
+		if err != nil {
+			return err
+		}
+		key := item.KeyCopy(nil)
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		trashValue := make([]byte, 8+len(value))
+		binary.BigEndian.PutUint64(trashValue, uint64(time.Now().UnixNano()))
+		copy(trashValue[8:], value)
+		err = r.deleteKey(rt, key)
+		if err != nil {
+			return err
+		}
+		entry := badger.NewEntry(joinKey(rt.trashPrefix(), key[len(rt.prefix):]), trashValue)
+		if retainer, ok := record.(TrashRetainer); ok && retainer.TrashTTL() > 0 {
+			entry.WithTTL(retainer.TrashTTL())
+		}
+		return r.SetEntry(entry)
+	})
+}
+
+func (r *recorderTxn) Undelete(record Record) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	keyValue, err := record.Key()
+	if err != nil {
+		return err
+	}
+	trashKey := joinKey(rt.trashPrefix(), keyValue)
+	item, err := r.Get(trashKey)
+	if err == badger.ErrKeyNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = item.Value(func(val []byte) error {
+		return rt.decodeTrash(val, keyValue, record, nil)
+	})
+	if err != nil {
+		return err
+	}
+	err = r.WriteIfAbsent(record)
+	if err != nil {
+		return err
+	}
+	return r.Txn.Delete(trashKey)
+}
+
+func (r *recorderTxn) RangeDeleted(
+	record Record,
+	opts *RangeOptions,
+	cb func(record Record, deletedAt time.Time) bool,
+) error {
+	rt, err := r.db.recordType(record)
+	if err != nil {
+		return err
+	}
+	var deletedAt time.Time
+	return r.rangeRecords(
+		rt.trashPrefix(),
+		record,
+		opts,
+		func(val []byte, keyValue []byte, record Record) error {
+			return rt.decodeTrash(val, keyValue, record, &deletedAt)
+		},
+		func(record Record) bool {
+			return cb(record, deletedAt)
+		},
+	)
+}
+
+// trashPrefix returns the prefix of the trash keys of the record type, each is followed by the
+// record key.  Trash values are the big endian deletion time in nanoseconds then the record value
+func (r *recordType) trashPrefix() []byte {
+	return append(r.prefix[:3:3], trashKeyMark)
+}
+
+// decodeTrash sets record.Record() and deletedAt, if not nil, from the trash value of the record
+// at keyValue
+func (r *recordType) decodeTrash(
+	val []byte,
+	keyValue []byte,
+	record Record,
+	deletedAt *time.Time,
+) error {
+	if len(val) < 8 {
+		return ErrInvalidTrash
+	}
+	if deletedAt != nil {
+		*deletedAt = time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+	}
+	return r.decodeRecord(val[8:], keyValue, record)
+}
@@ -0,0 +1,102 @@
+package record
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// RetryPolicy controls how RecorderDB.Update retries transactions that fail to commit because of
+// a conflict with another transaction
+type RetryPolicy struct {
+	// MaxAttempts is the most times a transaction will be tried, values less than 1 mean 1
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, it doubles for each retry after that
+	Backoff time.Duration
+
+	// MaxBackoff limits how long the delay between retries can grow
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used by a RecorderDB until SetRetryPolicy is called
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	Backoff:     time.Millisecond,
+	MaxBackoff:  100 * time.Millisecond,
+}
+
+func (r *recorderDB) SetRetryPolicy(policy RetryPolicy) {
+	r.retryPolicy = policy
+}
+
+func (r *recorderDB) Update(ctx context.Context, fn func(txn RecorderTxn) error) error {
+	policy := r.retryPolicy
+	backoff := policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		txn := r.newTxn(true)
+		txn.ctx = ctx
+		err = fn(txn)
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+		err = txn.Commit()
+		if err != badger.ErrConflict || attempt >= policy.MaxAttempts {
+			return err
+		}
+		if backoff > 0 {
+			// sleep between half and all of backoff so conflicting writers spread out
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			backoff *= 2
+			if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+	}
+}
+
+func (r *recorderDB) View(ctx context.Context, fn func(txn RecorderTxn) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	txn := r.newTxn(false)
+	txn.ctx = ctx
+	defer txn.Discard()
+	return fn(txn)
+}
+
+func (r *recorderTxn) Context() context.Context {
+	return r.ctx
+}
+
+func (r *recorderTxn) OnCommit(fn func()) {
+	r.onCommit = append(r.onCommit, fn)
+}
+
+func (r *recorderTxn) Commit() error {
+	err := r.Txn.Commit()
+	if err != nil {
+		return err
+	}
+	for _, fn := range r.onCommit {
+		fn()
+	}
+	r.onCommit = nil
+	return nil
+}
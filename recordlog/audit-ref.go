@@ -0,0 +1,52 @@
+package recordlog
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blbgo/record/record"
+)
+
+// auditRef points from the record an AuditEvent is about to the log entry holding it
+type auditRef struct {
+	// prefix is from auditPrefix, the key is prefix followed by entryKey
+	prefix   []byte
+	entryKey time.Time
+
+	// Log is when the log holding the entry was created
+	Log time.Time
+}
+
+// **************** implement record.Record
+
+var auditRefRecordName = "aud"
+
+func (r *auditRef) Name() string {
+	return auditRefRecordName
+}
+
+func (r *auditRef) Key() ([]byte, error) {
+	return append(r.prefix[:len(r.prefix):len(r.prefix)], record.TimeToBytes(r.entryKey)...), nil
+}
+
+func (r *auditRef) SetKey(data []byte) error {
+	if len(data) < record.TimeBytesLength {
+		return errors.New("audit reference key too short")
+	}
+	split := len(data) - record.TimeBytesLength
+	entryKey, err := record.BytesToTime(data[split:])
+	if err != nil {
+		return err
+	}
+	r.prefix = append(r.prefix[:0], data[:split]...)
+	r.entryKey = entryKey
+	return nil
+}
+
+func (r *auditRef) TTL() time.Duration {
+	return 0
+}
+
+func (r *auditRef) Record() interface{} {
+	return r
+}
@@ -0,0 +1,227 @@
+package recordlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/blbgo/record/record"
+)
+
+// actorKey is the context key of the actor set by WithActor
+type actorKey struct{}
+
+// WithActor returns a context that names actor as the one making the changes of transactions run
+// with it, see record.RecorderDB.Update
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by WithActor or an empty string
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// Audit operations
+const (
+	AuditWrite  = "write"
+	AuditDelete = "delete"
+)
+
+// AuditEvent is one change in the audit trail
+type AuditEvent struct {
+	Time time.Time
+
+	// Type is the record type name
+	Type string
+
+	Key []byte
+
+	Actor string
+
+	// Op is AuditWrite or AuditDelete
+	Op string
+
+	// OldHash and NewHash are the hex SHA-256 of the JSON values before and after the change with
+	// any encrypted fields decrypted, empty when there was no value
+	OldHash string
+	NewHash string
+
+	// Fields are the names of the top level JSON fields that changed
+	Fields []string
+}
+
+// Auditor keeps an audit trail of every change made in a transaction to records of types other
+// than those of this package
+type Auditor interface {
+	// History calls cb with each audit event of the record of the named type with key, oldest
+	// first, until cb returns false.  Events whose log entries have been deleted are skipped
+	History(typeName string, key []byte, cb func(event AuditEvent) bool) error
+}
+
+type auditor struct {
+	recorderDB record.RecorderDB
+	log        *log
+}
+
+// NewAuditor adds a change hook to recorderDB that writes an AuditEvent for each change, in the
+// transaction of the change, to the log named logName which is created if it does not exist.
+// The records returned by NewRecords and NewAuditRecord must be provided to record.New
+func NewAuditor(recorderDB record.RecorderDB, logName string) (Auditor, error) {
+	rl := &recordLog{recorderDB: recorderDB}
+	var created time.Time
+	found := false
+	err := rl.Range(MinTime(), false, func(logCreated time.Time, name string) bool {
+		created = logCreated
+		found = name == logName
+		return !found
+	})
+	if err != nil {
+		return nil, err
+	}
+	var auditLog *log
+	if found {
+		openLog, err := rl.Open(created)
+		if err != nil {
+			return nil, err
+		}
+		auditLog = openLog.(*log)
+	} else {
+		newLog, err := rl.New(logName)
+		if err != nil {
+			return nil, err
+		}
+		auditLog = newLog.(*log)
+	}
+	r := &auditor{recorderDB: recorderDB, log: auditLog}
+	recorderDB.OnChange(r.onChange)
+	return r, nil
+}
+
+// NewAuditRecord returns an instance of the record type used by an Auditor
+func NewAuditRecord() record.Record {
+	return &auditRef{}
+}
+
+// **************** implement Auditor
+
+func (r *auditor) History(typeName string, key []byte, cb func(event AuditEvent) bool) error {
+	ref := &auditRef{}
+	return r.recorderDB.View(context.Background(), func(txn record.RecorderTxn) error {
+		var err error
+		rangeErr := txn.RangeWith(
+			ref,
+			&record.RangeOptions{Prefix: auditPrefix(typeName, key)},
+			func(rec record.Record) bool {
+				entry := &logEntry{logKey: ref.Log, entryKey: ref.entryKey}
+				err = txn.Read(entry)
+				if errors.Is(err, record.ErrNotFound) {
+					err = nil
+					return true
+				}
+				if err != nil {
+					return false
+				}
+				var event AuditEvent
+				err = json.Unmarshal([]byte(entry.Message), &event)
+				if err != nil {
+					return false
+				}
+				return cb(event)
+			},
+		)
+		if rangeErr != nil {
+			return rangeErr
+		}
+		return err
+	})
+}
+
+// **************** helpers
+
+// onChange is the record.ChangeHook that writes the audit trail
+func (r *auditor) onChange(txn record.RecorderTxn, change record.Change) error {
+	switch change.Type {
+	case logRecordName, logEntryRecordName, auditRefRecordName:
+		return nil
+	}
+	event := AuditEvent{
+		Time:    time.Now().UTC(),
+		Type:    change.Type,
+		Key:     change.Key,
+		Actor:   ActorFromContext(txn.Context()),
+		Op:      AuditWrite,
+		OldHash: hashValue(change.OldPlain),
+		NewHash: hashValue(change.NewPlain),
+		Fields:  changedFields(change.OldPlain, change.NewPlain),
+	}
+	if change.Op == record.OpDelete {
+		event.Op = AuditDelete
+	}
+	message, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	entry := &logEntry{
+		logKey:   r.log.created,
+		entryKey: r.log.makeEntryKey(),
+		Message:  string(message),
+	}
+	err = txn.Write(entry)
+	if err != nil {
+		return err
+	}
+	return txn.Write(&auditRef{
+		prefix:   auditPrefix(change.Type, change.Key),
+		entryKey: entry.entryKey,
+		Log:      r.log.created,
+	})
+}
+
+func hashValue(value []byte) string {
+	if value == nil {
+		return ""
+	}
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// changedFields returns the sorted names of the top level fields that differ between the JSON
+// objects old and new, a missing object has no fields
+func changedFields(old, new []byte) []string {
+	var oldFields, newFields map[string]json.RawMessage
+	// values that are not objects have no fields to compare
+	_ = json.Unmarshal(old, &oldFields)
+	_ = json.Unmarshal(new, &newFields)
+	var fields []string
+	for name, value := range oldFields {
+		newValue, ok := newFields[name]
+		if !ok || !bytes.Equal(value, newValue) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// auditPrefix returns the prefix of the keys of the audit references of a record, it includes
+// the length of key so it is not the prefix of the references of other records
+func auditPrefix(typeName string, key []byte) []byte {
+	prefix := make([]byte, 0, len(typeName)+binary.MaxVarintLen64+len(key))
+	prefix = append(prefix, typeName...)
+	var length [binary.MaxVarintLen64]byte
+	prefix = append(prefix, length[:binary.PutUvarint(length[:], uint64(len(key)))]...)
+	return append(prefix, key...)
+}
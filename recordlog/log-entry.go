@@ -51,3 +51,23 @@ func (r *logEntry) TTL() time.Duration {
 func (r *logEntry) Record() interface{} {
 	return r
 }
+
+// indexedLogEntry is an entry of a log created by NewIndexed, its messages have a text index so
+// they can be searched.  Entries of other logs are not indexed so they can be written buffered
+type indexedLogEntry struct {
+	logEntry
+}
+
+// **************** implement record.Record
+
+var indexedLogEntryRecordName = "lgi"
+
+func (r *indexedLogEntry) Name() string {
+	return indexedLogEntryRecordName
+}
+
+// **************** implement record.TextIndexer
+
+func (r *indexedLogEntry) TextIndex() record.TextIndex {
+	return record.TextIndex{Fields: []string{"Message"}}
+}
@@ -1,6 +1,7 @@
 package recordlog
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -20,6 +21,9 @@ type log struct {
 	created time.Time
 
 	LogName string
+
+	// Indexed is set for logs created by NewIndexed
+	Indexed bool
 }
 
 // **************** implement record.Record
@@ -53,32 +57,60 @@ func (r *log) Record() interface{} {
 	return r
 }
 
+// **************** implement record.Relater
+
+func (r *log) Relations() []record.Relation {
+	return []record.Relation{
+		{
+			Child:     logEntryRecordName,
+			OnDelete:  record.CascadeDelete,
+			ParentKey: entryLogKey,
+		},
+		{
+			Child:     indexedLogEntryRecordName,
+			OnDelete:  record.CascadeDelete,
+			ParentKey: entryLogKey,
+		},
+	}
+}
+
 // **************** implement general.Logger
 
 func (r *log) Log(v ...interface{}) error {
-	return r.recorderDB.WriteBuffered(
-		&logEntry{
-			ttl:      r.entryTTL,
-			logKey:   r.created,
-			entryKey: r.makeEntryKey(),
-			Message:  fmt.Sprint(v...),
-		},
-	)
+	return r.write(fmt.Sprint(v...))
 }
 
 func (r *log) Logf(format string, v ...interface{}) error {
-	return r.recorderDB.WriteBuffered(
-		&logEntry{
-			ttl:      r.entryTTL,
-			logKey:   r.created,
-			entryKey: r.makeEntryKey(),
-			Message:  fmt.Sprintf(format, v...),
-		},
-	)
+	return r.write(fmt.Sprintf(format, v...))
 }
 
 // **************** helpers
 
+// write writes an entry with message.  Entries of indexed logs are written in a transaction so
+// their text index entries are written with them, others are buffered
+func (r *log) write(message string) error {
+	entry := logEntry{
+		ttl:      r.entryTTL,
+		logKey:   r.created,
+		entryKey: r.makeEntryKey(),
+		Message:  message,
+	}
+	if !r.Indexed {
+		return r.recorderDB.WriteBuffered(&entry)
+	}
+	return r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		return txn.Write(&indexedLogEntry{logEntry: entry})
+	})
+}
+
+// entryLogKey returns the key of the log of the entry with childKey
+func entryLogKey(childKey []byte) []byte {
+	if len(childKey) < record.TimeBytesLength {
+		return nil
+	}
+	return childKey[:record.TimeBytesLength]
+}
+
 func (r *log) makeEntryKey() time.Time {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
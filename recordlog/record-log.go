@@ -1,7 +1,10 @@
 package recordlog
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -13,6 +16,10 @@ import (
 type RecordLog interface {
 	general.LoggerFactory
 
+	// NewIndexed creates a log like New with a text index of its messages so they can be
+	// searched.  Its entries are written in a transaction each instead of buffered
+	NewIndexed(name string) (general.Logger, error)
+
 	Open(created time.Time) (general.Logger, error)
 
 	SetTTL(generalLog general.Logger, ttl time.Duration) error
@@ -31,6 +38,15 @@ type RecordLog interface {
 		reverse bool,
 		cb func(created time.Time, message string) bool,
 	) error
+
+	// Search calls cb with the entries of the log created at logCreated with messages that match
+	// query, see record.TextSearcher, best match first until cb returns false.  Only logs created
+	// by NewIndexed can be searched, record.ErrIndexNotDefined is returned for others
+	Search(
+		logCreated time.Time,
+		query string,
+		cb func(created time.Time, message string) bool,
+	) error
 }
 
 var minTime = time.Unix(0, 0).UTC()
@@ -61,23 +77,18 @@ func New(recorderDB record.RecorderDB) RecordLog {
 }
 
 // NewRecords returns an instance of each record type in this package
-func NewRecords() (record.Record, record.Record) {
-	return &log{}, &logEntry{}
+func NewRecords() (record.Record, record.Record, record.Record) {
+	return &log{}, &logEntry{}, &indexedLogEntry{}
 }
 
 // **************** implement RecordLog
 
 func (r *recordLog) New(name string) (general.Logger, error) {
-	newLog := &log{
-		recorderDB: r.recorderDB,
-		created:    r.makeLogKey(),
-		LogName:    name,
-	}
-	err := r.recorderDB.Write(newLog)
-	if err != nil {
-		return nil, err
-	}
-	return newLog, nil
+	return r.newLog(name, false)
+}
+
+func (r *recordLog) NewIndexed(name string) (general.Logger, error) {
+	return r.newLog(name, true)
 }
 
 func (r *recordLog) Open(created time.Time) (general.Logger, error) {
@@ -107,14 +118,7 @@ func (r *recordLog) Delete(created time.Time) error {
 		return err
 	}
 
-	// next delete all log entries for this log
-	// unfortunately this can not be done in a transaction
-	err = r.recorderDB.DeletePrefix(&logEntry{}, record.TimeToBytes(created))
-	if err != nil {
-		return err
-	}
-
-	// last delete the log
+	// log entries are deleted along with the log by the relation declared by log
 	err = r.recorderDB.Delete(deleteLog)
 	if err != nil {
 		return err
@@ -145,9 +149,19 @@ func (r *recordLog) RangeLog(
 	reverse bool,
 	cb func(created time.Time, message string) bool,
 ) error {
+	indexed, err := r.isIndexed(logCreated)
+	if err != nil {
+		return err
+	}
 	rangeLogEntry := &logEntry{logKey: logCreated, entryKey: start}
+	var rangeRecord record.Record = rangeLogEntry
+	if indexed {
+		indexedEntry := &indexedLogEntry{logEntry: *rangeLogEntry}
+		rangeLogEntry = &indexedEntry.logEntry
+		rangeRecord = indexedEntry
+	}
 	return r.recorderDB.Range(
-		rangeLogEntry,
+		rangeRecord,
 		record.TimeBytesLength,
 		reverse,
 		func(record record.Record) bool {
@@ -156,8 +170,80 @@ func (r *recordLog) RangeLog(
 	)
 }
 
+func (r *recordLog) Search(
+	logCreated time.Time,
+	query string,
+	cb func(created time.Time, message string) bool,
+) error {
+	indexed, err := r.isIndexed(logCreated)
+	if err != nil {
+		return err
+	}
+	if !indexed {
+		return fmt.Errorf(
+			"%w name: %v index: text",
+			record.ErrIndexNotDefined,
+			logEntryRecordName,
+		)
+	}
+	logKey := record.TimeToBytes(logCreated)
+	return r.recorderDB.View(context.Background(), func(txn record.RecorderTxn) error {
+		results, err := txn.Search(&indexedLogEntry{}, query, 0)
+		if err != nil {
+			return err
+		}
+		for _, v := range results {
+			if !bytes.HasPrefix(v.Key, logKey) {
+				continue
+			}
+			entry := &indexedLogEntry{}
+			err = entry.SetKey(v.Key)
+			if err != nil {
+				return err
+			}
+			err = txn.Read(entry)
+			if errors.Is(err, record.ErrNotFound) {
+				// expired since its text index entries were read
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !cb(entry.entryKey, entry.Message) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
 // **************** helpers
 
+func (r *recordLog) newLog(name string, indexed bool) (general.Logger, error) {
+	newLog := &log{
+		recorderDB: r.recorderDB,
+		created:    r.makeLogKey(),
+		LogName:    name,
+		Indexed:    indexed,
+	}
+	err := r.recorderDB.Write(newLog)
+	if err != nil {
+		return nil, err
+	}
+	return newLog, nil
+}
+
+// isIndexed returns if the log created at logCreated was created by NewIndexed, a log that does
+// not exist is not
+func (r *recordLog) isIndexed(logCreated time.Time) (bool, error) {
+	readLog := &log{created: logCreated}
+	err := r.recorderDB.Read(readLog)
+	if errors.Is(err, record.ErrNotFound) {
+		return false, nil
+	}
+	return readLog.Indexed, err
+}
+
 func (r *recordLog) makeLogKey() time.Time {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -1,10 +1,17 @@
 package recordlog
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/blbgo/testing/assert"
+
+	"github.com/blbgo/general"
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
 )
 
 func TestLogWrittingAndReading(t *testing.T) {
@@ -73,3 +80,163 @@ func TestLogWrittingAndReading(t *testing.T) {
 	a.NoError(err)
 	a.Equal(0, count)
 }
+
+func TestSearch(t *testing.T) {
+	a := assert.New(t)
+
+	rl := createRecordLog(a)
+	defer closeRecordLog(rl)
+
+	plain, err := rl.New("plain log")
+	a.NoError(err)
+	indexed, err := rl.NewIndexed("indexed log")
+	a.NoError(err)
+	a.NoError(plain.Log("plain message"))
+	a.NoError(indexed.Log("log message after new"))
+
+	var created []time.Time
+	a.NoError(rl.Range(MinTime(), false, func(logCreated time.Time, name string) bool {
+		created = append(created, logCreated)
+		return true
+	}))
+	a.Equal(2, len(created))
+	err = rl.Search(created[0], "plain", func(created time.Time, message string) bool {
+		return true
+	})
+	a.True(errors.Is(err, record.ErrIndexNotDefined))
+
+	opened, err := rl.Open(created[1])
+	a.NoError(err)
+	time.Sleep(200)
+	a.NoError(opened.Log("log message after open"))
+
+	var messages []string
+	search := func(query string) {
+		messages = nil
+		a.NoError(rl.Search(created[1], query, func(created time.Time, message string) bool {
+			messages = append(messages, message)
+			return true
+		}))
+	}
+	search("open")
+	a.Equal("[log message after open]", fmt.Sprint(messages))
+	search("messages after")
+	a.Equal(2, len(messages))
+	search("missing")
+	a.Equal(0, len(messages))
+
+	count := 0
+	rangeLog := func(logCreated time.Time) {
+		count = 0
+		a.NoError(rl.RangeLog(
+			logCreated,
+			MinTime(),
+			false,
+			func(created time.Time, message string) bool {
+				count++
+				return true
+			},
+		))
+	}
+	rangeLog(created[1])
+	a.Equal(2, count)
+
+	// entries of indexed logs are deleted with them
+	a.NoError(rl.Delete(created[1]))
+	rangeLog(created[1])
+	a.Equal(0, count)
+	txn := rl.(*recordLog).recorderDB.NewTransaction(false)
+	defer txn.Discard()
+	results, err := txn.Search(&indexedLogEntry{}, "message", 0)
+	a.NoError(err)
+	a.Equal(0, len(results))
+}
+
+func TestAudit(t *testing.T) {
+	a := assert.New(t)
+
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+	logRecord, logEntryRecord, indexedLogEntryRecord := NewRecords()
+	db, err := record.New(
+		st,
+		[]record.Record{
+			logRecord,
+			logEntryRecord,
+			indexedLogEntryRecord,
+			NewAuditRecord(),
+			&noteRecord{},
+		},
+	)
+	a.NoError(err)
+	auditor, err := NewAuditor(db, "audit")
+	a.NoError(err)
+
+	write := func(actor string, note *noteRecord) {
+		ctx := WithActor(context.Background(), actor)
+		a.NoError(db.Update(ctx, func(txn record.RecorderTxn) error {
+			return txn.Write(note)
+		}))
+	}
+	write("alice", &noteRecord{ID: "n1", Text: "one"})
+	write("bob", &noteRecord{ID: "n1", Text: "two", Tag: "x"})
+	write("alice", &noteRecord{ID: "n", Text: "other"})
+	a.NoError(db.Update(
+		WithActor(context.Background(), "carol"),
+		func(txn record.RecorderTxn) error {
+			return txn.Delete(&noteRecord{ID: "n1"})
+		},
+	))
+	// deleting a record that does not exist and failed transactions are not audited
+	a.NoError(db.Delete(&noteRecord{ID: "n1"}))
+	failed := errors.New("failed")
+	err = db.Update(context.Background(), func(txn record.RecorderTxn) error {
+		err := txn.Write(&noteRecord{ID: "n1", Text: "three"})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	a.Equal(failed, err)
+
+	var events []AuditEvent
+	a.NoError(auditor.History("not", []byte("n1"), func(event AuditEvent) bool {
+		events = append(events, event)
+		return true
+	}))
+	a.Equal(3, len(events))
+	var summary []string
+	for _, v := range events {
+		summary = append(summary, fmt.Sprint(v.Op, v.Actor, v.Fields))
+	}
+	a.Equal("[writealice[Text] writebob[Tag Text] deletecarol[Tag Text]]", fmt.Sprint(summary))
+	a.Equal("", events[0].OldHash)
+	a.Equal(events[0].NewHash, events[1].OldHash)
+	a.Equal(events[1].NewHash, events[2].OldHash)
+	a.Equal("", events[2].NewHash)
+	a.Equal("n1", string(events[2].Key))
+
+	// the events are in a log that is used again by the next auditor
+	_, err = NewAuditor(db, "audit")
+	a.NoError(err)
+	rl := New(db)
+	logs := 0
+	var created time.Time
+	a.NoError(rl.Range(MinTime(), false, func(logCreated time.Time, name string) bool {
+		a.Equal("audit", name)
+		created = logCreated
+		logs++
+		return true
+	}))
+	a.Equal(1, logs)
+	entries := 0
+	a.NoError(rl.RangeLog(created, MinTime(), false, func(created time.Time, message string) bool {
+		entries++
+		return true
+	}))
+	a.Equal(4, entries)
+
+	doneChan := make(chan error)
+	db.(general.DelayCloser).Close(doneChan)
+	a.NoError(<-doneChan)
+}
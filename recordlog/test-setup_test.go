@@ -1,6 +1,8 @@
 package recordlog
 
 import (
+	"time"
+
 	"github.com/blbgo/testing/assert"
 
 	"github.com/blbgo/general"
@@ -12,6 +14,7 @@ import (
 var Records = []record.Record{
 	&log{},
 	&logEntry{},
+	&indexedLogEntry{},
 }
 
 type recordConfig struct{}
@@ -40,3 +43,32 @@ func closeRecordLog(rl RecordLog) {
 	rl.(*recordLog).recorderDB.(general.DelayCloser).Close(doneChan)
 	<-doneChan
 }
+
+// noteRecord is a record type to audit
+type noteRecord struct {
+	ID string `json:"-"`
+
+	Text string
+	Tag  string `json:",omitempty"`
+}
+
+func (r *noteRecord) Name() string {
+	return "not"
+}
+
+func (r *noteRecord) Key() ([]byte, error) {
+	return []byte(r.ID), nil
+}
+
+func (r *noteRecord) SetKey(data []byte) error {
+	r.ID = string(data)
+	return nil
+}
+
+func (r *noteRecord) TTL() time.Duration {
+	return 0
+}
+
+func (r *noteRecord) Record() interface{} {
+	return r
+}
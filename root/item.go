@@ -48,6 +48,9 @@ type Item interface {
 	// only valid during the callback as it is reused for the next callback. If an item is needed
 	// outsode the callback use Clone.
 	RangeChildren(start []byte, prefixCount int, reverse bool, cb func(item Item) bool) error
+	// RangeChildrenWith reads children as specified by opts calling cb for each one, the same
+	// rules about the item provided to the callback as RangeChildren apply
+	RangeChildrenWith(opts *RangeOptions, cb func(item Item) bool) error
 	// RangeChildKeys reads the keys of children calling cb for each one
 	RangeChildKeys(start []byte, prefixCount int, reverse bool, cb func(key []byte) bool) error
 }
@@ -0,0 +1,150 @@
+package root
+
+import (
+	"bytes"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// RangeOptions specifies the children read by Item.RangeChildrenWith, the fields work like those
+// of record.RangeOptions with keys that are child keys as returned by Item.CopyKey
+type RangeOptions struct {
+	Prefix         []byte
+	Start          []byte
+	StartExclusive bool
+	End            []byte
+	EndInclusive   bool
+	Reverse        bool
+	Skip           int
+	Limit          int
+	// KeysOnly causes children to be provided without loading their value or indexes
+	KeysOnly bool
+	Filter   func(item Item) bool
+}
+
+type rangeBound struct {
+	key       []byte
+	inclusive bool
+}
+
+func (r *item) RangeChildrenWith(opts *RangeOptions, cb func(item Item) bool) error {
+	if opts == nil {
+		opts = &RangeOptions{}
+	}
+	basePrefix := make([]byte, 0, len(r.fullKey)+1+len(opts.Prefix))
+	if r.depth >= 0 {
+		basePrefix = append(basePrefix, r.baseKey...)
+		basePrefix = append(basePrefix, byte(len(r.key)))
+		basePrefix = append(basePrefix, r.key...)
+	}
+	basePrefix = append(basePrefix, mainKeyPrefix)
+	preKeyLen := len(basePrefix)
+	fullPrefix := append(basePrefix, opts.Prefix...)
+
+	lower := rangeBound{key: fullPrefix, inclusive: true}
+	upper := rangeBound{key: prefixEnd(fullPrefix)}
+	var start, end *rangeBound
+	if opts.Start != nil {
+		start = &rangeBound{
+			key:       append(append([]byte{}, fullPrefix[:preKeyLen]...), opts.Start...),
+			inclusive: !opts.StartExclusive,
+		}
+	}
+	if opts.End != nil {
+		end = &rangeBound{
+			key:       append(append([]byte{}, fullPrefix[:preKeyLen]...), opts.End...),
+			inclusive: opts.EndInclusive,
+		}
+	}
+	if opts.Reverse {
+		start, end = end, start
+	}
+	if start != nil && bytes.Compare(start.key, lower.key) >= 0 {
+		lower = *start
+	}
+	if end != nil && bytes.Compare(end.key, upper.key) <= 0 {
+		upper = *end
+	}
+
+	return r.Store.BadgerDB().View(func(txn *badger.Txn) error {
+		itOps := badger.DefaultIteratorOptions
+		itOps.PrefetchValues = !opts.KeysOnly
+		itOps.Reverse = opts.Reverse
+		it := txn.NewIterator(itOps)
+		defer it.Close()
+		childItem := &item{
+			Store: r.Store,
+			depth: r.depth + 1,
+		}
+		seek := lower.key
+		if opts.Reverse {
+			seek = upper.key
+		}
+		skip := opts.Skip
+		count := 0
+		for it.Seek(seek); it.Valid(); it.Next() {
+			dbItem := it.Item()
+			itemKey := dbItem.Key()
+			c := bytes.Compare(itemKey, lower.key)
+			belowLower := c < 0 || c == 0 && !lower.inclusive
+			c = bytes.Compare(itemKey, upper.key)
+			aboveUpper := c > 0 || c == 0 && !upper.inclusive
+			if opts.Reverse {
+				if aboveUpper {
+					continue
+				}
+				if belowLower {
+					return nil
+				}
+			} else {
+				if belowLower {
+					continue
+				}
+				if aboveUpper {
+					return nil
+				}
+			}
+			childItem.fullKey = itemKey
+			childItem.baseKey = itemKey[:preKeyLen-1]
+			childItem.key = itemKey[preKeyLen:]
+			childItem.expiresAt = dbItem.ExpiresAt()
+			if opts.KeysOnly {
+				childItem.indexes = childItem.indexes[:0]
+				childItem.value = childItem.value[:0]
+			} else {
+				err := childItem.loadFromItem(dbItem)
+				if err != nil {
+					return err
+				}
+			}
+			if opts.Filter != nil && !opts.Filter(childItem) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if !cb(childItem) {
+				return nil
+			}
+			count++
+			if opts.Limit > 0 && count >= opts.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, prefix always
+// ends with mainKeyPrefix or more so there is a byte that can be incremented
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return end
+}
@@ -88,6 +88,29 @@ func TestCreate(t *testing.T) {
 	a.NoError(err)
 	a.Equal(1, calls)
 
+	calls = 0
+	err = testRoot.RangeChildrenWith(
+		&RangeOptions{Prefix: []byte("test child"), Reverse: true},
+		func(item Item) bool {
+			calls++
+			checkItem(a, item)
+			return true
+		},
+	)
+	a.NoError(err)
+	a.Equal(1, calls)
+
+	calls = 0
+	err = testRoot.RangeChildrenWith(
+		&RangeOptions{Start: []byte("test child"), StartExclusive: true},
+		func(item Item) bool {
+			calls++
+			return true
+		},
+	)
+	a.NoError(err)
+	a.Equal(0, calls)
+
 	err = item.QuickChild([]byte("child of child"), []byte("A child of the child of testRoot"))
 	a.NoError(err)
 
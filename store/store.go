@@ -3,6 +3,7 @@ package store
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -15,17 +16,33 @@ type Store interface {
 	GetSequence(key []byte) (Sequence, error)
 }
 
+// MergeOperatorStore may be implemented by a Store that provides merge operators
+type MergeOperatorStore interface {
+	// GetMergeOperator returns a badger.MergeOperator for key that merges the values added in the
+	// background every dur.  It is stopped, merging once more, when the store is closed
+	GetMergeOperator(key []byte, f badger.MergeFunc, dur time.Duration) MergeOperator
+}
+
 // Sequence provides a way to get ever incressing numbers
 // *** needs to be moved somwhere more general
 type Sequence interface {
 	Next() (uint64, error)
 }
 
+// MergeOperator adds values to a key that are merged when read, see badger.MergeOperator
+type MergeOperator interface {
+	Add(val []byte) error
+	Get() ([]byte, error)
+}
+
 type store struct {
 	*badger.DB
-	sequences []*badger.Sequence
-	writeChan chan *badger.Entry
-	doneChan  chan<- error
+	mutex          sync.Mutex
+	sequences      []*badger.Sequence
+	mergeOperators []*badger.MergeOperator
+	writeChan      chan *badger.Entry
+	doneChan       chan<- error
+	closeOnce      sync.Once
 }
 
 // New creates a Store
@@ -53,9 +70,20 @@ func New(config Config) (Store, error) {
 	return newItem, nil
 }
 
+// Close implements general.DelayCloser, only the first call closes the store and later calls
+// send nil to their doneChan
 func (r *store) Close(doneChan chan<- error) {
-	r.doneChan = doneChan
-	close(r.writeChan)
+	closing := false
+	r.closeOnce.Do(func() {
+		closing = true
+		r.doneChan = doneChan
+		close(r.writeChan)
+	})
+	if !closing {
+		go func() {
+			doneChan <- nil
+		}()
+	}
 }
 
 func (r *store) background() {
@@ -115,6 +143,12 @@ func (r *store) background() {
 }
 
 func (r *store) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// merge operators write their final merge so must stop before the db closes
+	for _, v := range r.mergeOperators {
+		v.Stop()
+	}
 	for _, v := range r.sequences {
 		v.Release()
 	}
@@ -134,6 +168,16 @@ func (r *store) GetSequence(key []byte) (Sequence, error) {
 	if err != nil {
 		return nil, err
 	}
+	r.mutex.Lock()
 	r.sequences = append(r.sequences, sequence)
+	r.mutex.Unlock()
 	return sequence, nil
 }
+
+func (r *store) GetMergeOperator(key []byte, f badger.MergeFunc, dur time.Duration) MergeOperator {
+	mergeOperator := r.DB.GetMergeOperator(key, f, dur)
+	r.mutex.Lock()
+	r.mergeOperators = append(r.mergeOperators, mergeOperator)
+	r.mutex.Unlock()
+	return mergeOperator
+}
@@ -66,4 +66,8 @@ func TestOpenAndCloseDb(t *testing.T) {
 	doneChan := make(chan error, 100)
 	c.Close(doneChan)
 	a.Nil(<-doneChan)
+
+	// closing again, as a RecorderDB closing its Store does, is harmless
+	c.Close(doneChan)
+	a.Nil(<-doneChan)
 }
@@ -0,0 +1,155 @@
+package timeseries
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/blbgo/record/record"
+)
+
+// bucket holds the raw samples or the rollup aggregates of one series for a span of time.  Each
+// Add writes its samples to a new part of the bucket, so adds never read what another wrote and
+// do not conflict, and the parts are merged when read
+type bucket struct {
+	series string
+
+	// resolution is the interval of the aggregates or 0 for raw samples
+	resolution time.Duration
+	start      time.Time
+	part       uint64
+
+	Samples    []sample    `json:",omitempty"`
+	Aggregates []aggregate `json:",omitempty"`
+}
+
+// sample is a raw value, Offset is nanoseconds from the start of its bucket
+type sample struct {
+	Offset int64   `json:"o"`
+	Value  float64 `json:"v"`
+}
+
+// aggregate summarizes the samples of interval Interval of its bucket
+type aggregate struct {
+	Interval int     `json:"i"`
+	Count    int     `json:"n"`
+	Min      float64 `json:"l"`
+	Max      float64 `json:"h"`
+	Sum      float64 `json:"s"`
+}
+
+// bucketPrefix returns the start of the keys of all buckets of series at resolution.  A bucket key
+// is the uvarint length of the series key, the series key, the big endian resolution, the bucket
+// start from record.TimeToBytes then the big endian part
+func bucketPrefix(series string, resolution time.Duration) []byte {
+	prefix := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(series)+8)
+	prefix = prefix[:binary.PutUvarint(prefix, uint64(len(series)))]
+	prefix = append(prefix, series...)
+	var res [8]byte
+	binary.BigEndian.PutUint64(res[:], uint64(resolution))
+	return append(prefix, res[:]...)
+}
+
+// joinTime returns a new slice of prefix followed by record.TimeToBytes(t)
+func joinTime(prefix []byte, t time.Time) []byte {
+	key := make([]byte, len(prefix), len(prefix)+record.TimeBytesLength)
+	copy(key, prefix)
+	return append(key, record.TimeToBytes(t)...)
+}
+
+// addSample adds a sample at t keeping Samples in time order, samples at the same time are kept
+// in the order added
+func (r *bucket) addSample(t time.Time, value float64) {
+	r.insertSample(sample{Offset: int64(t.Sub(r.start)), Value: value})
+}
+
+func (r *bucket) insertSample(s sample) {
+	i := sort.Search(len(r.Samples), func(i int) bool { return r.Samples[i].Offset > s.Offset })
+	r.Samples = append(r.Samples, sample{})
+	copy(r.Samples[i+1:], r.Samples[i:])
+	r.Samples[i] = s
+}
+
+// addToAggregate adds value to the aggregate of the interval containing t
+func (r *bucket) addToAggregate(t time.Time, value float64) {
+	r.mergeAggregate(aggregate{
+		Interval: int(t.Sub(r.start) / r.resolution),
+		Count:    1,
+		Min:      value,
+		Max:      value,
+		Sum:      value,
+	})
+}
+
+// mergeAggregate adds agg to the aggregate of its interval keeping Aggregates in interval order
+func (r *bucket) mergeAggregate(agg aggregate) {
+	i := sort.Search(len(r.Aggregates), func(i int) bool {
+		return r.Aggregates[i].Interval >= agg.Interval
+	})
+	if i == len(r.Aggregates) || r.Aggregates[i].Interval != agg.Interval {
+		r.Aggregates = append(r.Aggregates, aggregate{})
+		copy(r.Aggregates[i+1:], r.Aggregates[i:])
+		r.Aggregates[i] = agg
+		return
+	}
+	existing := &r.Aggregates[i]
+	existing.Count += agg.Count
+	existing.Sum += agg.Sum
+	if agg.Min < existing.Min {
+		existing.Min = agg.Min
+	}
+	if agg.Max > existing.Max {
+		existing.Max = agg.Max
+	}
+}
+
+// merge adds the samples and aggregates of part, a later part of the same bucket
+func (r *bucket) merge(part *bucket) {
+	for _, v := range part.Samples {
+		r.insertSample(v)
+	}
+	for _, v := range part.Aggregates {
+		r.mergeAggregate(v)
+	}
+}
+
+// **************** implement record.Record
+
+var bucketRecordName = "tsb"
+
+func (r *bucket) Name() string {
+	return bucketRecordName
+}
+
+func (r *bucket) Key() ([]byte, error) {
+	key := joinTime(bucketPrefix(r.series, r.resolution), r.start)
+	var part [8]byte
+	binary.BigEndian.PutUint64(part[:], r.part)
+	return append(key, part[:]...), nil
+}
+
+func (r *bucket) SetKey(data []byte) error {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != length+8+record.TimeBytesLength+8 {
+		return errors.New("timeseries: invalid bucket key")
+	}
+	data = data[n:]
+	start, err := record.BytesToTime(data[length+8 : length+8+record.TimeBytesLength])
+	if err != nil {
+		return err
+	}
+	r.series = string(data[:length])
+	r.resolution = time.Duration(binary.BigEndian.Uint64(data[length:]))
+	r.start = start.UTC()
+	r.part = binary.BigEndian.Uint64(data[length+8+record.TimeBytesLength:])
+	return nil
+}
+
+func (r *bucket) TTL() time.Duration {
+	return 0
+}
+
+func (r *bucket) Record() interface{} {
+	return r
+}
@@ -0,0 +1,87 @@
+package timeseries
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Series identifies a time series by name and tags
+type Series struct {
+	Name string
+	Tags map[string]string
+}
+
+// String returns the series as name{key=value,...} with the tags sorted by key
+func (r Series) String() string {
+	var b strings.Builder
+	b.WriteString(r.Name)
+	b.WriteByte('{')
+	for i, k := range r.sortedTagKeys() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(r.Tags[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// key returns the name then each tag key and value sorted by tag key, all 0 terminated, so the
+// same series always has the same key whatever order its tags were added in
+func (r Series) key() string {
+	var b strings.Builder
+	b.WriteString(r.Name)
+	b.WriteByte(0)
+	for _, k := range r.sortedTagKeys() {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(r.Tags[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (r Series) sortedTagKeys() []string {
+	keys := make([]string, 0, len(r.Tags))
+	for k := range r.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// seriesEntry records that a series has had samples added
+type seriesEntry struct {
+	key string
+
+	SeriesName string
+	Tags       map[string]string `json:",omitempty"`
+}
+
+// **************** implement record.Record
+
+var seriesRecordName = "tss"
+
+func (r *seriesEntry) Name() string {
+	return seriesRecordName
+}
+
+func (r *seriesEntry) Key() ([]byte, error) {
+	return []byte(r.key), nil
+}
+
+func (r *seriesEntry) SetKey(data []byte) error {
+	r.key = string(data)
+	return nil
+}
+
+func (r *seriesEntry) TTL() time.Duration {
+	return 0
+}
+
+func (r *seriesEntry) Record() interface{} {
+	return r
+}
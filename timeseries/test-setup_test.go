@@ -0,0 +1,23 @@
+package timeseries
+
+import (
+	"github.com/blbgo/testing/assert"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+func createTimeSeries(a *assert.Assert, config Config) TimeSeries {
+	st, err := store.New(store.NewConfigInMem())
+	a.NoError(err)
+
+	series, buckets := NewRecords()
+	db, err := record.New(st, []record.Record{series, buckets})
+	a.NoError(err)
+
+	ts, err := New(db, config)
+	a.NoError(err)
+	a.NotNil(ts)
+
+	return ts
+}
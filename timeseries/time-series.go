@@ -0,0 +1,540 @@
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blbgo/record/record"
+	"github.com/blbgo/record/store"
+)
+
+// ErrInvalidConfig indicates a Config with a bucket size or rollup resolution that is not
+// positive
+var ErrInvalidConfig = errors.New("invalid time series config")
+
+// ErrResolutionNotConfigured indicates RangeRollup was called with a resolution that is not one
+// of the configured rollups
+var ErrResolutionNotConfigured = errors.New("rollup resolution not configured")
+
+// rollupBucketIntervals is the number of rollup intervals stored in each rollup bucket
+const rollupBucketIntervals = 100
+
+// retentionChunkSize is the most buckets EnforceRetention deletes in one transaction
+const retentionChunkSize = 1000
+
+// Config controls how samples are stored, rolled up and retained
+type Config struct {
+	// BucketSize is the span of time covered by each record of raw samples
+	BucketSize time.Duration
+
+	// Retention is how long raw samples are kept after the end of their bucket, 0 means forever
+	Retention time.Duration
+
+	// Rollups are the resolutions aggregates are kept at
+	Rollups []Rollup
+}
+
+// Rollup is a resolution aggregates are kept at and how long they are kept
+type Rollup struct {
+	Resolution time.Duration
+
+	// Retention is how long aggregates are kept after the end of their bucket, 0 means forever.
+	// Each rollup bucket covers 100 intervals of Resolution
+	Retention time.Duration
+}
+
+// Sample is a value of a series at a time
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Aggregate summarizes the samples of a series in the interval starting at Time
+type Aggregate struct {
+	Time  time.Time
+	Count int
+	Min   float64
+	Max   float64
+	Sum   float64
+}
+
+// Avg returns the mean of the samples
+func (r Aggregate) Avg() float64 {
+	return r.Sum / float64(r.Count)
+}
+
+// TimeSeries stores samples of series in time buckets with rollups and retention
+type TimeSeries interface {
+	// Add adds samples to series and updates its rollups in one transaction.  Samples and
+	// aggregates are written to new parts of their buckets without reading the existing ones so
+	// concurrent adds to the same series do not conflict
+	Add(series Series, samples ...Sample) error
+
+	// Range calls cb with the raw samples of series in [from, to) in time order until cb returns
+	// false
+	Range(series Series, from, to time.Time, cb func(sample Sample) bool) error
+
+	// RangeRollup calls cb with the aggregates at resolution of series for the intervals that
+	// start in [from, to) in time order until cb returns false.  Intervals without samples are
+	// skipped
+	RangeRollup(
+		series Series,
+		resolution time.Duration,
+		from, to time.Time,
+		cb func(aggregate Aggregate) bool,
+	) error
+
+	// RangeSeries calls cb with each series that has had samples added until cb returns false
+	RangeSeries(cb func(series Series) bool) error
+
+	// EnforceRetention deletes the buckets of every series that ended longer ago than the
+	// retention of their resolution and returns the number of bucket parts deleted.  It also
+	// merges the parts of each bucket that has ended into one
+	EnforceRetention() (int, error)
+
+	// StartRetention calls EnforceRetention every interval in a background goroutine until the
+	// returned function is called.  Errors are printed
+	StartRetention(interval time.Duration) func()
+}
+
+type timeSeries struct {
+	recorderDB record.RecorderDB
+	config     Config
+
+	// parts gives the part of the buckets written by each Add.  It is a store sequence so parts
+	// are unique across TimeSeries and processes using the store
+	parts store.Sequence
+}
+
+// bucketID identifies a bucket of a series being added to
+type bucketID struct {
+	resolution time.Duration
+	start      int64
+}
+
+// New creates a TimeSeries
+func New(recorderDB record.RecorderDB, config Config) (TimeSeries, error) {
+	if config.BucketSize <= 0 {
+		return nil, fmt.Errorf("%w bucket size: %v", ErrInvalidConfig, config.BucketSize)
+	}
+	for _, v := range config.Rollups {
+		if v.Resolution <= 0 {
+			return nil, fmt.Errorf("%w resolution: %v", ErrInvalidConfig, v.Resolution)
+		}
+	}
+	parts, err := recorderDB.GetSequence(&bucket{}, []byte("part"))
+	if err != nil {
+		return nil, err
+	}
+	return &timeSeries{recorderDB: recorderDB, config: config, parts: parts}, nil
+}
+
+// NewRecords returns an instance of each record type in this package
+func NewRecords() (record.Record, record.Record) {
+	return &seriesEntry{}, &bucket{}
+}
+
+// **************** implement TimeSeries
+
+func (r *timeSeries) Add(series Series, samples ...Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	seriesKey := series.key()
+	part, err := r.parts.Next()
+	if err != nil {
+		return err
+	}
+	buckets := make(map[bucketID]*bucket)
+	for _, s := range samples {
+		t := s.Time.UTC()
+		addBucket(buckets, seriesKey, 0, r.config.BucketSize, t, part).addSample(t, s.Value)
+		for _, v := range r.config.Rollups {
+			rollup := addBucket(
+				buckets,
+				seriesKey,
+				v.Resolution,
+				v.Resolution*rollupBucketIntervals,
+				t,
+				part,
+			)
+			rollup.addToAggregate(t, s.Value)
+		}
+	}
+	return r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+		// only the first add to a series writes this so reading it does not cause conflicts
+		err := txn.WriteIfAbsent(&seriesEntry{
+			key:        seriesKey,
+			SeriesName: series.Name,
+			Tags:       series.Tags,
+		})
+		if err != nil && !errors.Is(err, record.ErrAlreadyExists) {
+			return err
+		}
+		for _, v := range buckets {
+			err = txn.Write(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *timeSeries) Range(series Series, from, to time.Time, cb func(sample Sample) bool) error {
+	from = from.UTC()
+	return r.rangeBuckets(series, 0, r.config.BucketSize, from, to, func(b *bucket) bool {
+		for _, v := range b.Samples {
+			t := b.start.Add(time.Duration(v.Offset))
+			if t.Before(from) {
+				continue
+			}
+			if !t.Before(to) || !cb(Sample{Time: t, Value: v.Value}) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (r *timeSeries) RangeRollup(
+	series Series,
+	resolution time.Duration,
+	from, to time.Time,
+	cb func(aggregate Aggregate) bool,
+) error {
+	configured := false
+	for _, v := range r.config.Rollups {
+		configured = configured || v.Resolution == resolution
+	}
+	if !configured {
+		return fmt.Errorf("%w resolution: %v", ErrResolutionNotConfigured, resolution)
+	}
+	from = from.UTC()
+	bucketSize := resolution * rollupBucketIntervals
+	return r.rangeBuckets(series, resolution, bucketSize, from, to, func(b *bucket) bool {
+		for _, v := range b.Aggregates {
+			t := b.start.Add(time.Duration(v.Interval) * resolution)
+			if t.Before(from) {
+				continue
+			}
+			if !t.Before(to) {
+				return false
+			}
+			more := cb(Aggregate{Time: t, Count: v.Count, Min: v.Min, Max: v.Max, Sum: v.Sum})
+			if !more {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (r *timeSeries) RangeSeries(cb func(series Series) bool) error {
+	entry := &seriesEntry{}
+	return r.recorderDB.RangeWith(entry, &record.RangeOptions{}, func(record.Record) bool {
+		more := cb(Series{Name: entry.SeriesName, Tags: entry.Tags})
+		entry.Tags = nil
+		return more
+	})
+}
+
+func (r *timeSeries) EnforceRetention() (int, error) {
+	var seriesKeys []string
+	entry := &seriesEntry{}
+	err := r.recorderDB.RangeWith(
+		entry,
+		&record.RangeOptions{KeysOnly: true},
+		func(record.Record) bool {
+			seriesKeys = append(seriesKeys, entry.key)
+			return true
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	count := 0
+	for _, seriesKey := range seriesKeys {
+		n, err := r.enforceResolution(
+			seriesKey,
+			0,
+			r.config.BucketSize,
+			r.config.Retention,
+			now,
+		)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		for _, v := range r.config.Rollups {
+			n, err := r.enforceResolution(
+				seriesKey,
+				v.Resolution,
+				v.Resolution*rollupBucketIntervals,
+				v.Retention,
+				now,
+			)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+func (r *timeSeries) StartRetention(interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, err := r.EnforceRetention()
+				if err != nil {
+					fmt.Println("timeseries retention error:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// **************** helpers
+
+// addBucket returns the part of the bucket of seriesKey at resolution containing t from buckets,
+// creating an empty one and adding it to buckets if it is not there
+func addBucket(
+	buckets map[bucketID]*bucket,
+	seriesKey string,
+	resolution time.Duration,
+	bucketSize time.Duration,
+	t time.Time,
+	part uint64,
+) *bucket {
+	start := t.Truncate(bucketSize)
+	id := bucketID{resolution: resolution, start: start.UnixNano()}
+	b, ok := buckets[id]
+	if !ok {
+		b = &bucket{series: seriesKey, resolution: resolution, start: start, part: part}
+		buckets[id] = b
+	}
+	return b
+}
+
+// rangeBuckets calls cb with the buckets of series at resolution that may hold times in
+// [from, to) in time order until cb returns false
+func (r *timeSeries) rangeBuckets(
+	series Series,
+	resolution time.Duration,
+	bucketSize time.Duration,
+	from, to time.Time,
+	cb func(b *bucket) bool,
+) error {
+	prefix := bucketPrefix(series.key(), resolution)
+	part := &bucket{}
+	var current *bucket
+	more := true
+	err := r.recorderDB.RangeWith(
+		part,
+		&record.RangeOptions{
+			Prefix: prefix,
+			Start:  joinTime(prefix, from.Truncate(bucketSize)),
+			End:    joinTime(prefix, to),
+		},
+		func(record.Record) bool {
+			// the parts of a bucket are together and merged before it is passed to cb
+			if current != nil && !current.start.Equal(part.start) {
+				more = cb(current)
+				current = nil
+				if !more {
+					return false
+				}
+			}
+			if current == nil {
+				current = &bucket{series: part.series, resolution: resolution, start: part.start}
+			}
+			current.merge(part)
+			part.Samples = nil
+			part.Aggregates = nil
+			return true
+		},
+	)
+	if err != nil || current == nil || !more {
+		return err
+	}
+	cb(current)
+	return nil
+}
+
+// enforceResolution deletes the buckets of seriesKey at resolution that ended more than retention
+// before now then compacts the rest, the number of parts deleted is returned
+func (r *timeSeries) enforceResolution(
+	seriesKey string,
+	resolution time.Duration,
+	bucketSize time.Duration,
+	retention time.Duration,
+	now time.Time,
+) (int, error) {
+	count, err := r.deleteBefore(seriesKey, resolution, bucketSize, retention, now)
+	if err != nil {
+		return count, err
+	}
+	return count, r.compact(seriesKey, resolution, bucketSize, now)
+}
+
+// deleteBefore deletes the parts of the buckets of seriesKey at resolution that ended more than
+// retention before now, nothing is deleted if retention is 0
+func (r *timeSeries) deleteBefore(
+	seriesKey string,
+	resolution time.Duration,
+	bucketSize time.Duration,
+	retention time.Duration,
+	now time.Time,
+) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	prefix := bucketPrefix(seriesKey, resolution)
+	cutoff := now.Add(-retention).Add(-bucketSize)
+	b := &bucket{}
+	var old []bucket
+	err := r.recorderDB.RangeWith(
+		b,
+		&record.RangeOptions{
+			Prefix: prefix,
+			// the parts of the bucket starting at cutoff follow its start
+			End:      joinTime(prefix, cutoff.Add(time.Nanosecond)),
+			KeysOnly: true,
+		},
+		func(record.Record) bool {
+			old = append(old, bucket{
+				series:     b.series,
+				resolution: b.resolution,
+				start:      b.start,
+				part:       b.part,
+			})
+			return true
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for len(old) > 0 {
+		chunk := old
+		if len(chunk) > retentionChunkSize {
+			chunk = chunk[:retentionChunkSize]
+		}
+		err = r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+			for i := range chunk {
+				err := txn.Delete(&chunk[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(chunk)
+		old = old[len(chunk):]
+	}
+	return count, nil
+}
+
+// compact merges the parts of each bucket of seriesKey at resolution that ended before now into
+// its first part.  An add of a late sample to a bucket being compacted makes the compaction
+// conflict and be retried
+func (r *timeSeries) compact(
+	seriesKey string,
+	resolution time.Duration,
+	bucketSize time.Duration,
+	now time.Time,
+) error {
+	prefix := bucketPrefix(seriesKey, resolution)
+	b := &bucket{}
+	var split []time.Time
+	var last time.Time
+	parts := 0
+	err := r.recorderDB.RangeWith(
+		b,
+		&record.RangeOptions{
+			Prefix:   prefix,
+			End:      joinTime(prefix, now.Add(-bucketSize).Add(time.Nanosecond)),
+			KeysOnly: true,
+		},
+		func(record.Record) bool {
+			if parts == 0 || !b.start.Equal(last) {
+				last = b.start
+				parts = 0
+			}
+			parts++
+			if parts == 2 {
+				split = append(split, b.start)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return err
+	}
+	for _, start := range split {
+		err = r.recorderDB.Update(context.Background(), func(txn record.RecorderTxn) error {
+			part := &bucket{}
+			var merged *bucket
+			var old []bucket
+			err := txn.RangeWith(
+				part,
+				&record.RangeOptions{Prefix: joinTime(prefix, start)},
+				func(record.Record) bool {
+					if merged == nil {
+						merged = &bucket{
+							series:     seriesKey,
+							resolution: resolution,
+							start:      start,
+							part:       part.part,
+						}
+					} else {
+						old = append(old, bucket{
+							series:     seriesKey,
+							resolution: resolution,
+							start:      start,
+							part:       part.part,
+						})
+					}
+					merged.merge(part)
+					part.Samples = nil
+					part.Aggregates = nil
+					return true
+				},
+			)
+			if err != nil || len(old) == 0 {
+				return err
+			}
+			for i := range old {
+				err = txn.Delete(&old[i])
+				if err != nil {
+					return err
+				}
+			}
+			return txn.Write(merged)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blbgo/testing/assert"
+)
+
+func TestAddAndRange(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := New(nil, Config{})
+	a.True(errors.Is(err, ErrInvalidConfig))
+
+	ts := createTimeSeries(a, Config{
+		BucketSize: time.Minute,
+		Rollups:    []Rollup{{Resolution: 10 * time.Second}, {Resolution: time.Minute}},
+	})
+
+	cpu := Series{Name: "cpu", Tags: map[string]string{"host": "a", "core": "0"}}
+	base := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	// a sample every second for 3 minutes with value the second, added out of order in batches
+	for batch := 2; batch >= 0; batch-- {
+		var samples []Sample
+		for i := batch * 60; i < (batch+1)*60; i++ {
+			samples = append(samples, Sample{
+				Time:  base.Add(time.Duration(i) * time.Second),
+				Value: float64(i),
+			})
+		}
+		a.NoError(ts.Add(cpu, samples...))
+	}
+
+	// the same series with tags in a different order
+	same := Series{Name: "cpu", Tags: map[string]string{"core": "0", "host": "a"}}
+	var values []float64
+	from := base.Add(55 * time.Second)
+	a.NoError(ts.Range(same, from, from.Add(10*time.Second), func(sample Sample) bool {
+		values = append(values, sample.Value)
+		return true
+	}))
+	a.Equal("[55 56 57 58 59 60 61 62 63 64]", fmt.Sprint(values))
+
+	count := 0
+	a.NoError(ts.Range(cpu, base, base.Add(time.Hour), func(sample Sample) bool {
+		a.Equal(base.Add(time.Duration(count)*time.Second), sample.Time)
+		count++
+		return count < 100
+	}))
+	a.Equal(100, count)
+
+	var aggregates []string
+	from = base.Add(50 * time.Second)
+	a.NoError(ts.RangeRollup(cpu, 10*time.Second, from, from.Add(30*time.Second),
+		func(aggregate Aggregate) bool {
+			aggregates = append(aggregates, fmt.Sprint(
+				aggregate.Time.Sub(base),
+				aggregate.Count,
+				aggregate.Min,
+				aggregate.Max,
+				aggregate.Avg(),
+			))
+			return true
+		},
+	))
+	a.Equal("[50s 10 50 59 54.5 1m0s 10 60 69 64.5 1m10s 10 70 79 74.5]", fmt.Sprint(aggregates))
+
+	aggregates = nil
+	to := base.Add(time.Hour)
+	a.NoError(ts.RangeRollup(cpu, time.Minute, base, to, func(aggregate Aggregate) bool {
+		aggregates = append(aggregates, fmt.Sprint(
+			aggregate.Count,
+			aggregate.Min,
+			aggregate.Max,
+			aggregate.Sum,
+		))
+		return true
+	}))
+	a.Equal("[60 0 59 1770 60 60 119 5370 60 120 179 8970]", fmt.Sprint(aggregates))
+
+	err = ts.RangeRollup(cpu, time.Hour, base, to, func(Aggregate) bool { return true })
+	a.True(errors.Is(err, ErrResolutionNotConfigured))
+
+	a.NoError(ts.Add(Series{Name: "mem"}, Sample{Time: base, Value: 1}))
+	var names []string
+	a.NoError(ts.RangeSeries(func(series Series) bool {
+		names = append(names, series.String())
+		return true
+	}))
+	a.Equal("[cpu{core=0,host=a} mem{}]", fmt.Sprint(names))
+}
+
+func TestRetention(t *testing.T) {
+	a := assert.New(t)
+
+	ts := createTimeSeries(a, Config{
+		BucketSize: time.Minute,
+		Retention:  time.Hour,
+		Rollups: []Rollup{
+			{Resolution: time.Second, Retention: 2 * time.Hour},
+			{Resolution: time.Minute},
+		},
+	})
+	disk := Series{Name: "disk"}
+	now := time.Now()
+	for _, age := range []time.Duration{3 * time.Hour, 90 * time.Minute, time.Minute} {
+		a.NoError(ts.Add(disk, Sample{Time: now.Add(-age), Value: 1}))
+	}
+
+	counts := func() string {
+		raw := 0
+		a.NoError(ts.Range(disk, now.Add(-4*time.Hour), now, func(Sample) bool {
+			raw++
+			return true
+		}))
+		var rollups []int
+		for _, resolution := range []time.Duration{time.Second, time.Minute} {
+			n := 0
+			a.NoError(ts.RangeRollup(disk, resolution, now.Add(-4*time.Hour), now,
+				func(Aggregate) bool {
+					n++
+					return true
+				},
+			))
+			rollups = append(rollups, n)
+		}
+		return fmt.Sprint(raw, rollups)
+	}
+	a.Equal("3 [3 3]", counts())
+
+	// raw buckets older than an hour, second rollup buckets older than 2 hours
+	deleted, err := ts.EnforceRetention()
+	a.NoError(err)
+	a.Equal(3, deleted)
+	a.Equal("1 [2 3]", counts())
+
+	stop := ts.StartRetention(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	a.Equal("1 [2 3]", counts())
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{
+		BucketSize: time.Minute,
+		Rollups:    []Rollup{{Resolution: 10 * time.Second}},
+	}
+	ts := createTimeSeries(a, config)
+	// a second TimeSeries on the same store does not write parts the first also writes
+	other, err := New(ts.(*timeSeries).recorderDB, config)
+	a.NoError(err)
+	net := Series{Name: "net"}
+	base := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	// adds to the same buckets at the same time do not conflict
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			var samples []Sample
+			for j := 0; j < 6; j++ {
+				samples = append(samples, Sample{
+					Time:  base.Add(time.Duration(j*10+i) * time.Second),
+					Value: float64(j*10 + i),
+				})
+			}
+			if i%2 == 1 {
+				errs <- other.Add(net, samples...)
+				return
+			}
+			errs <- ts.Add(net, samples...)
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		a.NoError(<-errs)
+	}
+
+	check := func() {
+		var values []float64
+		a.NoError(ts.Range(net, base, base.Add(time.Minute), func(sample Sample) bool {
+			values = append(values, sample.Value)
+			return true
+		}))
+		a.Equal(60, len(values))
+		for i, v := range values {
+			a.Equal(float64(i), v)
+		}
+		var sums []float64
+		a.NoError(ts.RangeRollup(net, 10*time.Second, base, base.Add(time.Minute),
+			func(aggregate Aggregate) bool {
+				sums = append(sums, aggregate.Sum)
+				return true
+			},
+		))
+		a.Equal("[45 145 245 345 445 545]", fmt.Sprint(sums))
+	}
+	check()
+	parts, err := ts.(*timeSeries).recorderDB.Count(&bucket{}, nil)
+	a.NoError(err)
+	a.Equal(20, parts)
+
+	// the parts of buckets that have ended are merged
+	deleted, err := ts.EnforceRetention()
+	a.NoError(err)
+	a.Equal(0, deleted)
+	check()
+	parts, err = ts.(*timeSeries).recorderDB.Count(&bucket{}, nil)
+	a.NoError(err)
+	a.Equal(2, parts)
+}